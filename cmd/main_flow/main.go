@@ -8,9 +8,14 @@ import (
 	// "example.com/storage"
 	log "github.com/Sirupsen/logrus"
 	"github.com/khiemm/listener/pkg/storage"
+	"github.com/khiemm/listener/util"
 )
 
 func init() {
+	err := util.InitializeViper()
+	if err != nil {
+		panic(err)
+	}
 	log.WithFields(log.Fields{
 		"animal": "walrus",
 	}).Info("A walrus appears")
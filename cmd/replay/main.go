@@ -0,0 +1,243 @@
+// Command replay feeds archived or captured device traffic through the
+// interactors, the same way a live connection does. It's used to re-ingest
+// the original bytes when a parser bug corrupted stored data.
+//
+// Inputs are archive directories, archive segments or text files holding
+// a hex encoded frame per line:
+//
+//	replay -from 2026-10-01T00:00:00Z -imei 352093081452251 archive/
+//	replay -dry-run -hex-imei 352093081452251 frames.txt
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/pkg/archive"
+	"github.com/khiemm/listener/pkg/storage"
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+var (
+	from     = flag.String("from", "", "skip frames received before this RFC 3339 time")
+	to       = flag.String("to", "", "skip frames received after this RFC 3339 time")
+	imeis    = flag.String("imei", "", "comma separated IMEIs to replay, all when empty")
+	speed    = flag.Float64("speed", 0, "replay speed relative to the recorded pace, as fast as possible when 0")
+	dryRun   = flag.Bool("dry-run", false, "parse and validate without storing anything")
+	debug    = flag.Bool("debug", false, "log every frame and position")
+	source   = flag.String("source", "teltonika", "protocol of hex input, as registered in devices/common")
+	hexIMEI  = flag.String("hex-imei", "", "IMEI of hex input that doesn't start with a handshake")
+	hexStart = flag.String("hex-time", "", "RFC 3339 time assigned to hex input, for -from and -to")
+)
+
+func init() {
+	err := util.InitializeViper()
+	if err != nil {
+		panic(err)
+	}
+	log.SetOutput(os.Stdout)
+}
+
+func main() {
+	flag.Parse()
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay [flags] archive-dir|segment|hex-file...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	f, err := makeFilter()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid flags")
+	}
+	r, err := makeReplayer()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't set up replay")
+	}
+	defer storage.Disconnect()
+
+	for _, path := range flag.Args() {
+		err = readInput(path, func(e *archive.Entry) error {
+			if !f.match(e) {
+				return nil
+			}
+			return r.replay(e)
+		})
+		if err != nil {
+			log.WithError(err).WithField("input", path).Fatal("Replay failed")
+		}
+	}
+	log.Info(r.stats)
+	if r.stats.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+type filter struct {
+	from, to time.Time
+	imeis    map[string]bool
+}
+
+func makeFilter() (f filter, err error) {
+	if *from != "" {
+		f.from, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			return
+		}
+	}
+	if *to != "" {
+		f.to, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			return
+		}
+	}
+	if *imeis != "" {
+		f.imeis = make(map[string]bool)
+		for _, imei := range strings.Split(*imeis, ",") {
+			f.imeis[strings.TrimSpace(imei)] = true
+		}
+	}
+	return
+}
+
+func (f filter) match(e *archive.Entry) bool {
+	if e.Direction != common.DirectionIn {
+		return false
+	}
+	if f.imeis != nil && !f.imeis[e.IMEI] {
+		return false
+	}
+	if !f.from.IsZero() && e.Time.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && e.Time.After(f.to) {
+		return false
+	}
+	return true
+}
+
+// readInput calls fn with every entry of the input at path.
+func readInput(path string, fn func(*archive.Entry) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		segments, err := archive.Segments(path)
+		if err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			err = readSegment(segment, fn)
+			if err != nil {
+				return errors.Wrap(err, filepath.Base(segment))
+			}
+		}
+		return nil
+	}
+	if strings.HasSuffix(path, ".gz") {
+		return readSegment(path, fn)
+	}
+	return readHex(path, fn)
+}
+
+func readSegment(path string, fn func(*archive.Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := archive.NewReader(file)
+	if err != nil {
+		return err
+	}
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readHex reads a frame per line. Empty lines and lines starting with
+// # are skipped. A line holding an IMEI handshake starts a new session
+// for that IMEI.
+func readHex(path string, fn func(*archive.Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var start time.Time
+	if *hexStart != "" {
+		start, err = time.Parse(time.RFC3339, *hexStart)
+		if err != nil {
+			return err
+		}
+	}
+	imei := *hexIMEI
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		data, err := hex.DecodeString(text)
+		if err != nil {
+			return errors.Wrapf(err, "line %d", line)
+		}
+		handshake := false
+		if id, ok := handshakeIMEI(data); ok {
+			imei, handshake = id, true
+		}
+		err = fn(&archive.Entry{
+			Time:       start,
+			Source:     *source,
+			IMEI:       imei,
+			RemoteAddr: path,
+			Direction:  common.DirectionIn,
+			Handshake:  handshake,
+			Data:       data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// handshakeIMEI recognizes the IMEI handshake of Teltonika devices, the
+// length of the IMEI followed by its digits.
+func handshakeIMEI(data []byte) (imei string, ok bool) {
+	if len(data) < 3 || int(data[0])<<8|int(data[1]) != len(data)-2 {
+		return "", false
+	}
+	for _, b := range data[2:] {
+		if b < '0' || b > '9' {
+			return "", false
+		}
+	}
+	return string(data[2:]), true
+}
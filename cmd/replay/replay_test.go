@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/pkg/archive"
+)
+
+const (
+	replayIMEI = "356307042441013"
+	handshake  = "000f333536333037303432343431303133"
+	// Codec 8 packets of one and two records.
+	packetOne = "000000000000003608010000016B40D8EA30010000000000000000000000000000000105021503010101425E0F01F10000601A014E0000000000000000010000C7CF"
+	packetTwo = "000000000000004308020000016B40D57B480100000000000000000000000000000001010101000000000000016B40D5C198010000000000000000000000000000000101010101000000020000252C"
+)
+
+// memStore keeps the number of positions stored and rejected by IMEI.
+type memStore struct {
+	stored, rejected map[string]int
+}
+
+func newMemStore() *memStore {
+	return &memStore{stored: make(map[string]int), rejected: make(map[string]int)}
+}
+
+func (s *memStore) SavePositions(h *common.Handler, positions []*common.Position) error {
+	s.stored[h.IMEI] += len(positions)
+	return nil
+}
+
+func (s *memStore) QuarantinePositions(h *common.Handler, rejections []*common.Rejection) error {
+	s.rejected[h.IMEI] += len(rejections)
+	return nil
+}
+
+func newTestReplayer(t *testing.T, store *memStore) *replayer {
+	logger := log.StandardLogger()
+	out := logger.Out
+	logger.Out = ioutil.Discard
+	t.Cleanup(func() { logger.Out = out })
+	r := &replayer{
+		sessions: make(map[string]*session),
+		stats:    &stats{startedAt: time.Now()},
+	}
+	r.store, r.quarantine = countingStore{r.stats, store}, countingStore{r.stats, store}
+	return r
+}
+
+func replayAll(t *testing.T, r *replayer, f filter, paths ...string) {
+	for _, path := range paths {
+		err := readInput(path, func(e *archive.Entry) error {
+			if !f.match(e) {
+				return nil
+			}
+			return r.replay(e)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeHex(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "frames.txt")
+	err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplayHex(t *testing.T) {
+	store := newMemStore()
+	r := newTestReplayer(t, store)
+	path := writeHex(t,
+		"# Captured from "+replayIMEI,
+		handshake,
+		"",
+		packetOne,
+		strings.ToLower(packetTwo),
+		// The CRC doesn't match.
+		packetOne[:len(packetOne)-4]+"0000",
+	)
+	replayAll(t, r, filter{}, path)
+
+	want := stats{frames: 4, failed: 1, stored: 3, sessions: 1}
+	if got := *r.stats; got.frames != want.frames || got.failed != want.failed ||
+		got.stored != want.stored || got.sessions != want.sessions || got.skipped != 0 {
+		t.Errorf("%s, want %d frames, %d failed, %d stored", r.stats, want.frames, want.failed, want.stored)
+	}
+	if store.stored[replayIMEI] != 3 {
+		t.Errorf("stored %v", store.stored)
+	}
+
+	if err := readInput(writeHex(t, "00zz"), func(*archive.Entry) error { return nil }); err == nil {
+		t.Error("invalid hex read")
+	}
+}
+
+func TestReplayHexWithoutHandshake(t *testing.T) {
+	defer func(imei, start string) { *hexIMEI, *hexStart = imei, start }(*hexIMEI, *hexStart)
+	*hexIMEI = replayIMEI
+	*hexStart = "2026-10-01T00:00:00Z"
+	store := newMemStore()
+	r := newTestReplayer(t, store)
+	path := writeHex(t, packetOne, packetTwo)
+
+	// Frames get the time of the input.
+	f := filter{from: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)}
+	replayAll(t, r, f, path)
+	if r.stats.frames != 0 {
+		t.Errorf("%d frames before -from replayed", r.stats.frames)
+	}
+	replayAll(t, r, filter{}, path)
+	if r.stats.frames != 2 || r.stats.failed != 0 || store.stored[replayIMEI] != 3 {
+		t.Errorf("%s, stored %v", r.stats, store.stored)
+	}
+}
+
+func TestReplayArchive(t *testing.T) {
+	dir := t.TempDir()
+	a, err := archive.New(archive.Config{Dir: dir, SegmentSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		a.Serve()
+		close(done)
+	}()
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	const other = "352093086403655"
+	for i, f := range []struct {
+		imei, addr, dir string
+		handshake       bool
+		data            string
+	}{
+		{"", "203.0.113.7:56324", common.DirectionIn, true, handshake},
+		{replayIMEI, "203.0.113.7:56324", common.DirectionOut, false, "01"},
+		{replayIMEI, "203.0.113.7:56324", common.DirectionIn, false, packetOne},
+		{replayIMEI, "203.0.113.7:56324", common.DirectionOut, false, "00000001"},
+		{"", "203.0.113.8:40100", common.DirectionIn, true, "000f" + fmt.Sprintf("%x", other)},
+		{other, "203.0.113.8:40100", common.DirectionIn, false, packetTwo},
+	} {
+		data := mustDecodeHex(t, f.data)
+		imei := f.imei
+		if f.handshake {
+			// The IMEI is only known once the handshake is read.
+			imei = string(data[2:])
+		}
+		a.Archive(&common.RawFrame{
+			Time:       start.Add(time.Duration(i) * time.Minute),
+			Source:     "teltonika",
+			IMEI:       imei,
+			RemoteAddr: f.addr,
+			Network:    "tcp",
+			Direction:  f.dir,
+			Handshake:  f.handshake,
+			Outcome:    common.OutcomeOK,
+			Data:       data,
+		})
+	}
+	a.Stop()
+	<-done
+	segments, err := archive.Segments(dir)
+	if err != nil || len(segments) < 2 {
+		t.Fatalf("%d segments, error %v", len(segments), err)
+	}
+
+	tests := []struct {
+		name   string
+		filter filter
+		paths  []string
+		frames int
+		stored map[string]int
+	}{
+		{"directory", filter{}, []string{dir}, 4, map[string]int{replayIMEI: 1, other: 2}},
+		{"segments", filter{}, segments, 4, map[string]int{replayIMEI: 1, other: 2}},
+		{"IMEI", filter{imeis: map[string]bool{other: true}}, []string{dir}, 2, map[string]int{other: 2}},
+		{"time", filter{to: start.Add(3 * time.Minute)}, []string{dir}, 2, map[string]int{replayIMEI: 1}},
+	}
+	for _, tt := range tests {
+		store := newMemStore()
+		r := newTestReplayer(t, store)
+		replayAll(t, r, tt.filter, tt.paths...)
+		if r.stats.frames != tt.frames || r.stats.failed != 0 {
+			t.Errorf("%s: %s", tt.name, r.stats)
+		}
+		if fmt.Sprint(store.stored) != fmt.Sprint(tt.stored) {
+			t.Errorf("%s: stored %v, want %v", tt.name, store.stored, tt.stored)
+		}
+	}
+
+	if err = readInput(filepath.Join(dir, "missing.jsonl.gz"), func(*archive.Entry) error { return nil }); !os.IsNotExist(err) {
+		t.Errorf("missing segment: %v", err)
+	}
+}
+
+func TestHandshakeIMEI(t *testing.T) {
+	tests := []struct {
+		data string
+		imei string
+		ok   bool
+	}{
+		{handshake, replayIMEI, true},
+		{packetOne, "", false},
+		{"000f3335", "", false},
+		{"00", "", false},
+	}
+	for _, tt := range tests {
+		imei, ok := handshakeIMEI(mustDecodeHex(t, tt.data))
+		if imei != tt.imei || ok != tt.ok {
+			t.Errorf("%s: %q, %t", tt.data, imei, ok)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
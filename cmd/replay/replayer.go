@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	_ "github.com/khiemm/listener/devices/gt06"
+	_ "github.com/khiemm/listener/devices/queclink"
+	_ "github.com/khiemm/listener/devices/ruptela"
+	"github.com/khiemm/listener/devices/teltonika"
+	"github.com/khiemm/listener/pkg/archive"
+	"github.com/khiemm/listener/pkg/storage"
+	"github.com/pkg/errors"
+)
+
+type stats struct {
+	frames    int
+	failed    int
+	skipped   int
+	stored    int
+	rejected  int
+	sessions  int
+	startedAt time.Time
+}
+
+func (s *stats) String() string {
+	return fmt.Sprintf("Replayed %d frames of %d sessions in %s: %d failed, %d skipped, %d positions stored, %d rejected",
+		s.frames, s.sessions, time.Since(s.startedAt).Round(time.Millisecond), s.failed, s.skipped, s.stored, s.rejected)
+}
+
+type replayer struct {
+	store      common.Store
+	quarantine common.Quarantine
+	validator  *common.Validator
+	// installations is only set when storing, dry runs
+	// validate without installation dates.
+	installations common.Installations
+	sessions      map[string]*session
+	stats         *stats
+	last          time.Time
+}
+
+// session replays the frames of a single connection.
+type session struct {
+	handler *common.Handler
+	conn    *replayConn
+}
+
+func makeReplayer() (r *replayer, err error) {
+	r = &replayer{
+		sessions: make(map[string]*session),
+		stats:    &stats{startedAt: time.Now()},
+	}
+	r.validator, err = common.LoadValidator()
+	if err != nil {
+		return
+	}
+	err = teltonika.LoadNXDecoders()
+	if err != nil {
+		return
+	}
+	if *dryRun {
+		r.store, r.quarantine = countingStore{r.stats, nil}, countingStore{r.stats, nil}
+		return
+	}
+	err = storage.Connect()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't connect to the database")
+	}
+	r.store, r.quarantine = countingStore{r.stats, storage.MySQLStore{}}, countingStore{r.stats, storage.MySQLStore{}}
+	r.installations = storage.MySQLStore{}
+	return
+}
+
+// replay feeds a frame to the interactor of its session and
+// handles what it parses.
+func (r *replayer) replay(e *archive.Entry) (err error) {
+	s, err := r.session(e)
+	if err != nil {
+		log.WithError(err).WithField("imei", e.IMEI).Warn("Frame skipped")
+		r.stats.skipped++
+		return nil
+	}
+	r.pace(e.Time)
+	r.stats.frames++
+	h := s.handler
+	h.IMEI = e.IMEI
+	s.conn.feed(e.Data)
+
+	if e.Handshake {
+		err = h.InitializeConnection(h)
+		if err != nil {
+			h.Log().WithError(err).Error("Handshake failed")
+			r.stats.failed++
+			return nil
+		}
+		h.DebugLog().Debugf("Handshake replies: %x", s.conn.takeReplies())
+	}
+
+	// Handshakes may carry a message too, which is returned
+	// by the first ParseMessage.
+	for {
+		var msg interface{}
+		msg, err = h.ParseMessage(h)
+		if errors.Cause(err) == io.EOF {
+			return nil
+		}
+		if err != nil {
+			h.Log().WithError(err).Errorf("Frame parsing failed: %x", e.Data)
+			r.stats.failed++
+			return nil
+		}
+		err = h.HandleMessage(h, msg)
+		if err != nil {
+			h.Log().WithError(err).Error("Frame handling failed")
+			r.stats.failed++
+			return nil
+		}
+		h.DebugLog().Debugf("Replies: %x", s.conn.takeReplies())
+	}
+}
+
+func (r *replayer) session(e *archive.Entry) (*session, error) {
+	key := e.Source + "/" + e.RemoteAddr + "/" + e.IMEI
+	if s, ok := r.sessions[key]; ok {
+		return s, nil
+	}
+	p, ok := common.LookupProtocol(e.Source)
+	if !ok {
+		return nil, fmt.Errorf("unknown protocol %s", e.Source)
+	}
+	network := p.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn := &replayConn{addr: replayAddr{network, e.RemoteAddr}}
+	s := &session{
+		conn: conn,
+		handler: &common.Handler{
+			Name:          e.Source,
+			Conn:          conn,
+			IMEI:          e.IMEI,
+			Debug:         *debug,
+			Store:         r.store,
+			AckPolicy:     common.AckStored,
+			Validator:     r.validator,
+			Quarantine:    r.quarantine,
+			Installations: r.installations,
+			Logger:        log.StandardLogger(),
+			Interactor:    p.NewInteractor(common.NewServer(p, nil)),
+		},
+	}
+	s.handler.LoadInstallation()
+	r.sessions[key] = s
+	r.stats.sessions++
+	return s, nil
+}
+
+// pace sleeps so that frames are replayed at the recorded pace
+// multiplied by the speed factor.
+func (r *replayer) pace(t time.Time) {
+	if *speed <= 0 || t.IsZero() {
+		return
+	}
+	if !r.last.IsZero() && t.After(r.last) {
+		time.Sleep(time.Duration(float64(t.Sub(r.last)) / *speed))
+	}
+	r.last = t
+}
+
+// countingStore counts positions and hands them to next, which
+// is nil for dry runs.
+type countingStore struct {
+	stats *stats
+	next  interface {
+		common.Store
+		common.Quarantine
+	}
+}
+
+func (cs countingStore) SavePositions(h *common.Handler, positions []*common.Position) (err error) {
+	if cs.next != nil {
+		err = cs.next.SavePositions(h, positions)
+		if err != nil {
+			return
+		}
+	}
+	for _, p := range positions {
+		h.DebugLog().Debugf("Position %s %f,%f", p.Timestamp.Format(time.RFC3339), p.Latitude, p.Longitude)
+	}
+	cs.stats.stored += len(positions)
+	return nil
+}
+
+func (cs countingStore) QuarantinePositions(h *common.Handler, rejections []*common.Rejection) (err error) {
+	if cs.next != nil {
+		err = cs.next.QuarantinePositions(h, rejections)
+		if err != nil {
+			return
+		}
+	}
+	for _, r := range rejections {
+		h.DebugLog().Debugf("Position %s rejected by %s: %s", r.Position.Timestamp.Format(time.RFC3339), r.Rule, r.Reason)
+	}
+	cs.stats.rejected += len(rejections)
+	return nil
+}
+
+// replayConn is the connection of a session. Reads return the frames fed
+// to it and io.EOF once they're consumed, replies are kept for logging.
+type replayConn struct {
+	in      bytes.Buffer
+	replies bytes.Buffer
+	addr    replayAddr
+}
+
+func (c *replayConn) feed(data []byte) { c.in.Write(data) }
+
+func (c *replayConn) takeReplies() []byte {
+	replies := append([]byte(nil), c.replies.Bytes()...)
+	c.replies.Reset()
+	return replies
+}
+
+func (c *replayConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *replayConn) Write(b []byte) (int, error)        { return c.replies.Write(b) }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return c.addr }
+func (c *replayConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayAddr struct {
+	network string
+	addr    string
+}
+
+func (a replayAddr) Network() string { return a.network }
+func (a replayAddr) String() string  { return a.addr }
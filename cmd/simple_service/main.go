@@ -1,20 +1,101 @@
+// Command simple_service receives positions from phone trackers over HTTP,
+// see ingestServer. It's configured by the [http] section of listener.toml.
 package main
 
 import (
-	"io"
-	"log"
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/pkg/storage"
+	"github.com/khiemm/listener/util"
+	"github.com/spf13/viper"
 )
 
+func init() {
+	err := util.InitializeViper()
+	if err != nil {
+		panic(err)
+	}
+	log.SetOutput(os.Stdout)
+	log.SetLevel(log.DebugLevel)
+}
+
 func main() {
-	log1()
-	// Hello world, the web server
+	err := storage.Connect()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't connect to the database")
+	}
+	defer storage.Disconnect()
+	store := storage.MySQLStore{}
+	validator, err := common.LoadValidator()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid validation config")
+	}
+	ackPolicy, err := common.ParseAckPolicy(viper.GetString("http.ack_policy"))
+	if err != nil {
+		log.WithError(err).Fatal("Invalid HTTP config")
+	}
 
-	helloHandler := func(w http.ResponseWriter, req *http.Request) {
-		io.WriteString(w, "Hello, world!\n")
+	ingest := &ingestServer{
+		Store:         store,
+		AckPolicy:     ackPolicy,
+		Validator:     validator,
+		Quarantine:    store,
+		Installations: store,
+		Debug:         viper.GetBool("http.debug"),
+		MaxBodySize:   viper.GetInt64("http.max_body_size"),
+		MaxBatchSize:  viper.GetInt("http.max_batch_size"),
 	}
+	if ingest.MaxBodySize <= 0 {
+		ingest.MaxBodySize = defaultMaxBodySize
+	}
+	if ingest.MaxBatchSize <= 0 {
+		ingest.MaxBatchSize = defaultMaxBatchSize
+	}
+	srv := &http.Server{
+		Addr:         viper.GetString("http.address"),
+		Handler:      ingest,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	if viper.IsSet("http.tls") {
+		t := &common.TLS{
+			CertFile: viper.GetString("http.tls.cert"),
+			KeyFile:  viper.GetString("http.tls.key"),
+		}
+		srv.TLSConfig, err = t.Config()
+		if err != nil {
+			log.WithError(err).Fatal("Invalid HTTP TLS config")
+		}
+	}
+
+	go func() {
+		log.WithField("addr", srv.Addr).Info("Listening for HTTP requests")
+		var err error
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig.
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.WithError(err).Fatal("HTTP server failed")
+		}
+	}()
 
-	http.HandleFunc("/hello", helloHandler)
-	log.Println("Listing for requests at http://localhost:8000/hello")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	<-sigchan
+	log.Info("Terminating")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	log.Info("Terminated")
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+// knotsToKmh converts OsmAnd speeds, which are in knots.
+const knotsToKmh = 1.852
+
+// Limits applied when [http] doesn't set them.
+const (
+	defaultMaxBodySize  = 1 << 20
+	defaultMaxBatchSize = 1000
+)
+
+var errMissingCoordinates = errors.New("lat and lon are required")
+
+// ingestServer receives positions from phone apps over HTTP, either as
+// OsmAnd query parameters, e.g. /?id=&lat=&lon=&timestamp=&speed=, or as
+// a JSON object or array of objects with the same keys. Positions go
+// through the same validation, quarantine and store as the ones received
+// by the TCP protocols. A batch whose devices were only partly stored, or
+// that has devices with invalid IMEIs among valid ones, gets a 207 with
+// the outcome of every device, to be sent again selectively.
+type ingestServer struct {
+	Store         common.Store
+	AckPolicy     common.AckPolicy
+	Validator     *common.Validator
+	Quarantine    common.Quarantine
+	Installations common.Installations
+	Debug         bool
+	MaxBodySize   int64
+	MaxBatchSize  int
+}
+
+// report is a single position as sent by the app, by parameter name.
+type report func(name string) string
+
+func (s *ingestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	reports, err := readReports(r)
+	if err == nil && len(reports) > s.MaxBatchSize {
+		err = errors.Errorf("batch of %d positions exceeds %d", len(reports), s.MaxBatchSize)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"addr":  r.RemoteAddr,
+			"error": err,
+		}).Info("Malformed request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Positions are handed to a handler per device, as if every device
+	// had a connection of its own.
+	var ids []string
+	byID := make(map[string][]*common.Position)
+	unauthorized := make(map[string]bool)
+	for i, rep := range reports {
+		id := deviceID(rep)
+		if _, ok := byID[id]; !ok && !unauthorized[id] {
+			ids = append(ids, id)
+		}
+		if !util.ValidIMEI(id) {
+			unauthorized[id] = true
+			continue
+		}
+		p, err := parsePosition(rep)
+		if err != nil {
+			http.Error(w, errors.Wrapf(err, "position %d", i).Error(), http.StatusBadRequest)
+			return
+		}
+		byID[id] = append(byID[id], p)
+	}
+
+	// Devices are stored independently, one failing doesn't stop the others.
+	results := make([]deviceResult, 0, len(ids))
+	stored := 0
+	for _, id := range ids {
+		if unauthorized[id] {
+			log.WithFields(log.Fields{
+				"addr": r.RemoteAddr,
+				"imei": id,
+			}).Info("Unauthorized device")
+			results = append(results, deviceResult{ID: id, Error: common.ErrUnauthorizedDevice.Error()})
+			continue
+		}
+		h := s.newHandler(r, id)
+		result := deviceResult{ID: id, Stored: true}
+		err = h.SaveAndAcknowledge(byID[id], func() error { return nil })
+		if err != nil {
+			h.Log().WithError(err).Error("Couldn't save positions")
+			result = deviceResult{ID: id, Error: "positions couldn't be stored"}
+		} else {
+			stored++
+		}
+		results = append(results, result)
+	}
+	switch {
+	case stored == len(ids):
+		w.WriteHeader(http.StatusOK)
+	case len(unauthorized) == len(ids):
+		http.Error(w, common.ErrUnauthorizedDevice.Error(), http.StatusForbidden)
+	case stored == 0 && len(unauthorized) == 0:
+		// Apps send the positions again when the request fails.
+		http.Error(w, "positions couldn't be stored", http.StatusServiceUnavailable)
+	default:
+		// Sending the whole batch again would duplicate the positions
+		// that were stored, or be refused again, so clients are told
+		// which devices failed.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+// deviceResult is the outcome of storing the positions of a device,
+// returned for batches that were only partly stored.
+type deviceResult struct {
+	ID     string `json:"id"`
+	Stored bool   `json:"stored"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *ingestServer) newHandler(r *http.Request, id string) *common.Handler {
+	h := &common.Handler{
+		Name:          "osmand",
+		Conn:          requestConn{addr: requestAddr(r.RemoteAddr)},
+		IMEI:          id,
+		Logger:        log.StandardLogger(),
+		Store:         s.Store,
+		AckPolicy:     s.AckPolicy,
+		Validator:     s.Validator,
+		Quarantine:    s.Quarantine,
+		Installations: s.Installations,
+		Debug:         s.Debug,
+	}
+	h.LoadInstallation()
+	return h
+}
+
+// readReports returns the positions of an OsmAnd request, or of a JSON
+// body holding either a single object or an array of them.
+func readReports(r *http.Request) ([]report, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := r.ParseForm(); err != nil {
+			return nil, errors.Wrap(err, "invalid parameters")
+		}
+		return []report{r.Form.Get}, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "body read failed")
+	}
+	var objects []map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = d.Decode(&objects)
+	} else {
+		objects = make([]map[string]interface{}, 1)
+		err = d.Decode(&objects[0])
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+	reports := make([]report, len(objects))
+	for i, o := range objects {
+		reports[i] = jsonReport(o)
+	}
+	return reports, nil
+}
+
+func jsonReport(o map[string]interface{}) report {
+	return func(name string) string {
+		switch v := o[name].(type) {
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		case bool:
+			return strconv.FormatBool(v)
+		}
+		return ""
+	}
+}
+
+func deviceID(rep report) string {
+	if id := rep("id"); id != "" {
+		return id
+	}
+	return rep("deviceid")
+}
+
+// parsePosition converts an OsmAnd report. Only the coordinates are
+// required, the time of the request is used when there is no timestamp.
+func parsePosition(rep report) (p *common.Position, err error) {
+	if rep("lat") == "" || rep("lon") == "" {
+		return nil, errMissingCoordinates
+	}
+	p = &common.Position{Satellites: common.UnknownSatellites}
+	for _, f := range []struct {
+		name  string
+		value *float64
+	}{
+		{"lat", &p.Latitude},
+		{"lon", &p.Longitude},
+		{"altitude", &p.Altitude},
+		{"bearing", &p.Heading},
+		{"heading", &p.Heading},
+		{"speed", &p.Speed},
+	} {
+		if v := rep(f.name); v != "" {
+			*f.value, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid %s %q", f.name, v)
+			}
+		}
+	}
+	p.Speed *= knotsToKmh
+	p.Timestamp, err = parseTimestamp(rep("timestamp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"accuracy", "hdop", "batt"} {
+		if v := rep(name); v != "" {
+			value, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid %s %q", name, v)
+			}
+			p.SetAttribute(name, value)
+		}
+	}
+	return p, nil
+}
+
+// parseTimestamp accepts seconds or milliseconds since the epoch,
+// and RFC 3339 times.
+func parseTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now().UTC(), nil
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if n > 1e12 {
+			return time.Unix(0, int64(n)*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(int64(n), 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid timestamp %q", s)
+	}
+	return t.UTC(), nil
+}
+
+// requestConn stands for the connection of a request in the handlers
+// positions are saved with. Only its addresses are used.
+type requestConn struct {
+	net.Conn
+	addr requestAddr
+}
+
+func (c requestConn) RemoteAddr() net.Addr { return c.addr }
+func (c requestConn) LocalAddr() net.Addr  { return c.addr }
+
+// requestAddr is the address of the client of a request.
+type requestAddr string
+
+func (a requestAddr) Network() string { return "http" }
+func (a requestAddr) String() string  { return string(a) }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	goerr "errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+)
+
+// IMEIs of the devices of the tests.
+const (
+	imeiA   = "356307042441013"
+	imeiB   = "353288040073284"
+	invalid = "356307042441014"
+)
+
+// memStore keeps the positions it's given by IMEI, except for the IMEIs
+// in fail.
+type memStore struct {
+	positions map[string][]*common.Position
+	fail      map[string]bool
+}
+
+func (s *memStore) SavePositions(h *common.Handler, positions []*common.Position) error {
+	if s.fail[h.IMEI] {
+		return goerr.New("database down")
+	}
+	if s.positions == nil {
+		s.positions = make(map[string][]*common.Position)
+	}
+	s.positions[h.IMEI] = append(s.positions[h.IMEI], positions...)
+	return nil
+}
+
+func newIngestServer(store *memStore) *ingestServer {
+	return &ingestServer{
+		Store:        store,
+		MaxBodySize:  defaultMaxBodySize,
+		MaxBatchSize: 3,
+	}
+}
+
+func muteLog(t *testing.T) {
+	logger := log.StandardLogger()
+	out := logger.Out
+	logger.Out = ioutil.Discard
+	t.Cleanup(func() { logger.Out = out })
+}
+
+func TestIngestReports(t *testing.T) {
+	muteLog(t)
+	form := url.Values{"id": {imeiA}, "lat": {"54.6872"}, "lon": {"25.2797"}, "timestamp": {"1700000000"}, "speed": {"10"}}
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		contentType string
+		body        string
+		status      int
+		stored      map[string]int
+	}{
+		{"GET query", "GET", form.Encode(), "", "", http.StatusOK, map[string]int{imeiA: 1}},
+		{"POST form", "POST", "", "application/x-www-form-urlencoded", form.Encode(), http.StatusOK, map[string]int{imeiA: 1}},
+		{"JSON object", "POST", "", "application/json",
+			`{"deviceid": "` + imeiA + `", "lat": 54.6872, "lon": 25.2797, "timestamp": "2023-11-14T22:13:20Z", "speed": 10}`,
+			http.StatusOK, map[string]int{imeiA: 1}},
+		{"JSON array", "POST", "", "application/json; charset=utf-8",
+			`[{"id": "` + imeiA + `", "lat": 54.6872, "lon": 25.2797, "timestamp": 1700000000000},` +
+				`{"id": "` + imeiB + `", "lat": 54.6873, "lon": 25.2798},` +
+				`{"id": "` + imeiA + `", "lat": 54.6874, "lon": 25.2799, "timestamp": 1700000060}]`,
+			http.StatusOK, map[string]int{imeiA: 2, imeiB: 1}},
+		{"no coordinates", "GET", "id=" + imeiA + "&lat=54.6872", "", "", http.StatusBadRequest, nil},
+		{"invalid coordinates", "GET", "id=" + imeiA + "&lat=north&lon=25.2797", "", "", http.StatusBadRequest, nil},
+		{"invalid JSON", "POST", "", "application/json", `[{"id": `, http.StatusBadRequest, nil},
+		{"batch size", "POST", "", "application/json", `[{}, {}, {}, {}]`, http.StatusBadRequest, nil},
+		{"invalid IMEI", "GET", "id=" + invalid + "&lat=54.6872&lon=25.2797", "", "", http.StatusForbidden, nil},
+		{"no IMEI", "GET", "lat=54.6872&lon=25.2797", "", "", http.StatusForbidden, nil},
+		{"method", "PUT", form.Encode(), "", "", http.StatusMethodNotAllowed, nil},
+	}
+	for _, tt := range tests {
+		store := &memStore{}
+		r := httptest.NewRequest(tt.method, "/?"+tt.query, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		newIngestServer(store).ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if len(store.positions) != len(tt.stored) {
+			t.Errorf("%s: positions of %d devices stored, want %d", tt.name, len(store.positions), len(tt.stored))
+		}
+		for imei, n := range tt.stored {
+			if len(store.positions[imei]) != n {
+				t.Errorf("%s: %d positions of %s stored, want %d", tt.name, len(store.positions[imei]), imei, n)
+			}
+		}
+	}
+}
+
+func TestIngestPosition(t *testing.T) {
+	muteLog(t)
+	store := &memStore{}
+	r := httptest.NewRequest("GET", "/?id="+imeiA+"&lat=54.6872&lon=25.2797&altitude=112.5&bearing=90&speed=10&timestamp=1700000000&hdop=0.9", nil)
+	newIngestServer(store).ServeHTTP(httptest.NewRecorder(), r)
+	if len(store.positions[imeiA]) != 1 {
+		t.Fatalf("%d positions stored", len(store.positions[imeiA]))
+	}
+	p := store.positions[imeiA][0]
+	if p.Latitude != 54.6872 || p.Longitude != 25.2797 || p.Altitude != 112.5 || p.Heading != 90 {
+		t.Errorf("position %+v", p)
+	}
+	// Speeds are sent in knots.
+	if p.Speed != 10*knotsToKmh {
+		t.Errorf("speed %v, want %v", p.Speed, 10*knotsToKmh)
+	}
+	if !p.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("timestamp %s", p.Timestamp)
+	}
+}
+
+func TestIngestPartlyStored(t *testing.T) {
+	muteLog(t)
+	report := func(imei string) string {
+		return fmt.Sprintf(`{"id": "%s", "lat": 54.6872, "lon": 25.2797}`, imei)
+	}
+	tests := []struct {
+		name    string
+		imeis   []string
+		fail    string
+		status  int
+		results []deviceResult
+	}{
+		{"store failure", []string{imeiA, imeiB}, imeiB, http.StatusMultiStatus, []deviceResult{
+			{ID: imeiA, Stored: true},
+			{ID: imeiB, Error: "positions couldn't be stored"},
+		}},
+		{"invalid IMEI", []string{imeiA, invalid, imeiB}, "", http.StatusMultiStatus, []deviceResult{
+			{ID: imeiA, Stored: true},
+			{ID: invalid, Error: common.ErrUnauthorizedDevice.Error()},
+			{ID: imeiB, Stored: true},
+		}},
+		// Sending the batch again would be refused again.
+		{"invalid IMEI and store failure", []string{invalid, imeiB}, imeiB, http.StatusMultiStatus, []deviceResult{
+			{ID: invalid, Error: common.ErrUnauthorizedDevice.Error()},
+			{ID: imeiB, Error: "positions couldn't be stored"},
+		}},
+		{"nothing stored", []string{imeiA, imeiA}, imeiA, http.StatusServiceUnavailable, nil},
+		{"only invalid IMEIs", []string{invalid, invalid}, "", http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		var reports []string
+		for _, imei := range tt.imeis {
+			reports = append(reports, report(imei))
+		}
+		store := &memStore{fail: map[string]bool{tt.fail: true}}
+		r := httptest.NewRequest("POST", "/", strings.NewReader("["+strings.Join(reports, ",")+"]"))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		newIngestServer(store).ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.results == nil {
+			continue
+		}
+		var results []deviceResult
+		if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(results) != fmt.Sprint(tt.results) {
+			t.Errorf("%s: results %+v, want %+v", tt.name, results, tt.results)
+		}
+	}
+}
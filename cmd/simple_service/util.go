@@ -1,9 +0,0 @@
-package main
-
-import (
-	"log"
-)
-
-func log1() {
-	log.Println("log1")
-}
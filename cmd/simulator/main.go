@@ -0,0 +1,299 @@
+// Command simulator drives the listener with fake Teltonika devices.
+// Every device connects over TCP, sends its IMEI and then streams
+// Codec 8 or 8E frames along a route, checking that each frame is
+// acknowledged with its record count.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/devices/teltonika"
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+var (
+	addr        = flag.String("addr", "127.0.0.1:1207", "listener address")
+	devices     = flag.Int("devices", 10, "number of concurrent devices")
+	codec       = flag.String("codec", "8e", "codec to send, 8 or 8e")
+	interval    = flag.Duration("interval", 10*time.Second, "time between two frames of a device")
+	records     = flag.Int("records", 1, "records per frame")
+	duration    = flag.Duration("duration", 0, "how long to run, forever when 0")
+	gpxPath     = flag.String("gpx", "", "GPX track to drive along instead of a synthetic route")
+	speed       = flag.Float64("speed", 50, "vehicle speed in km/h")
+	centerLat   = flag.Float64("lat", 10.7769, "latitude of the synthetic route center")
+	centerLon   = flag.Float64("lon", 106.7009, "longitude of the synthetic route center")
+	radius      = flag.Float64("radius", 2000, "radius of the synthetic route in meters")
+	imeiPrefix  = flag.String("imei-prefix", "35000000", "first 8 digits of the generated IMEIs")
+	ackTimeout  = flag.Duration("ack-timeout", 30*time.Second, "how long to wait for an acknowledgement")
+	rampUp      = flag.Duration("ramp-up", 5*time.Second, "time over which devices connect")
+	reportEvery = flag.Duration("report", 10*time.Second, "interval between progress reports")
+)
+
+// stats are shared by all devices.
+type stats struct {
+	connected   int64
+	refused     int64
+	frames      int64
+	acked       int64
+	badAcks     int64
+	failures    int64
+	ackNanos    int64
+	maxAckNanos int64
+}
+
+func (s *stats) observeAck(d time.Duration) {
+	atomic.AddInt64(&s.ackNanos, int64(d))
+	for {
+		max := atomic.LoadInt64(&s.maxAckNanos)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&s.maxAckNanos, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (s *stats) String() string {
+	acked := atomic.LoadInt64(&s.acked)
+	avg := time.Duration(0)
+	if acked > 0 {
+		avg = time.Duration(atomic.LoadInt64(&s.ackNanos) / acked)
+	}
+	return fmt.Sprintf("connected=%d refused=%d frames=%d acked=%d bad_acks=%d failures=%d avg_ack=%s max_ack=%s",
+		atomic.LoadInt64(&s.connected), atomic.LoadInt64(&s.refused), atomic.LoadInt64(&s.frames),
+		acked, atomic.LoadInt64(&s.badAcks), atomic.LoadInt64(&s.failures),
+		avg, time.Duration(atomic.LoadInt64(&s.maxAckNanos)))
+}
+
+func init() {
+	log.SetOutput(os.Stdout)
+	log.SetLevel(log.InfoLevel)
+}
+
+func main() {
+	flag.Parse()
+	if *codec != "8" && *codec != "8e" {
+		log.Fatalf("Unsupported codec %q", *codec)
+	}
+	if len(*imeiPrefix) != 8 {
+		log.Fatal("IMEI prefix must be 8 digits long")
+	}
+
+	var route []waypoint
+	if *gpxPath != "" {
+		var err error
+		route, err = loadGPX(*gpxPath)
+		if err != nil {
+			log.WithError(err).Fatal("Couldn't load route")
+		}
+	} else {
+		route = circleRoute(*centerLat, *centerLon, *radius, 36)
+	}
+	if routeLength(route) == 0 {
+		log.Fatal("Route has no length")
+	}
+
+	done := make(chan struct{})
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigchan:
+		case <-timeout(*duration):
+		}
+		close(done)
+	}()
+
+	s := new(stats)
+	go func() {
+		ticker := time.NewTicker(*reportEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Info(s)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < *devices; i++ {
+		d := &device{
+			imei:   makeIMEI(*imeiPrefix, i),
+			cursor: &cursor{route: route, leg: rand.Intn(len(route)), speed: *speed},
+			stats:  s,
+		}
+		wg.Add(1)
+		go func(delay time.Duration) {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-done:
+				return
+			}
+			err := d.run(done)
+			if err != nil {
+				atomic.AddInt64(&s.failures, 1)
+				log.WithError(err).WithField("imei", d.imei).Error("Device failed")
+			}
+		}(*rampUp * time.Duration(i) / time.Duration(*devices))
+	}
+	wg.Wait()
+	log.Info("Finished: ", s)
+	if atomic.LoadInt64(&s.failures) > 0 || atomic.LoadInt64(&s.badAcks) > 0 {
+		os.Exit(1)
+	}
+}
+
+func timeout(d time.Duration) <-chan time.Time {
+	if d == 0 {
+		return nil
+	}
+	return time.After(d)
+}
+
+// makeIMEI returns the n-th IMEI with the given prefix and a valid check digit.
+func makeIMEI(prefix string, n int) string {
+	body := fmt.Sprintf("%s%06d", prefix, n)
+	return fmt.Sprintf("%s%d", body, util.LuhnCheckDigit(body))
+}
+
+type device struct {
+	imei   string
+	cursor *cursor
+	stats  *stats
+	last   time.Time
+}
+
+func (d *device) run(done <-chan struct{}) (err error) {
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		return errors.Wrap(err, "dial failed")
+	}
+	defer conn.Close()
+
+	accepted, err := d.handshake(conn)
+	if err != nil {
+		return errors.Wrap(err, "handshake failed")
+	}
+	if !accepted {
+		atomic.AddInt64(&d.stats.refused, 1)
+		log.WithField("imei", d.imei).Warn("Device refused")
+		return nil
+	}
+	atomic.AddInt64(&d.stats.connected, 1)
+	defer atomic.AddInt64(&d.stats.connected, -1)
+
+	d.last = time.Now()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		err = d.sendFrame(conn)
+		if err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// handshake sends the IMEI and reads the single byte reply.
+func (d *device) handshake(conn net.Conn) (accepted bool, err error) {
+	msg := make([]byte, 2+len(d.imei))
+	binary.BigEndian.PutUint16(msg, uint16(len(d.imei)))
+	copy(msg[2:], d.imei)
+	conn.SetDeadline(time.Now().Add(*ackTimeout))
+	_, err = conn.Write(msg)
+	if err != nil {
+		return
+	}
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return
+	}
+	return reply[0] == 1, nil
+}
+
+// sendFrame sends the positions travelled since the previous frame
+// and waits for the acknowledgement.
+func (d *device) sendFrame(conn net.Conn) (err error) {
+	now := time.Now()
+	step := now.Sub(d.last) / time.Duration(*records)
+	positions := make([]*common.Position, *records)
+	for i := range positions {
+		wp, heading := d.cursor.advance(step)
+		positions[i] = &common.Position{
+			Timestamp:  d.last.Add(step * time.Duration(i+1)),
+			Latitude:   wp.Lat,
+			Longitude:  wp.Lon,
+			Altitude:   wp.Ele,
+			Heading:    heading,
+			Speed:      *speed,
+			Satellites: 9 + rand.Intn(4),
+			IO: map[uint16][]byte{
+				239: {1},
+				240: {1},
+				66:  {0x30, 0x8e},
+			},
+		}
+	}
+	d.last = now
+
+	frame, err := encode(positions)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(*ackTimeout))
+	_, err = conn.Write(frame)
+	if err != nil {
+		return errors.Wrap(err, "frame write failed")
+	}
+	atomic.AddInt64(&d.stats.frames, 1)
+
+	var count uint32
+	err = binary.Read(conn, binary.BigEndian, &count)
+	if err != nil {
+		return errors.Wrap(err, "ack read failed")
+	}
+	d.stats.observeAck(time.Since(now))
+	if int(count) != len(positions) {
+		atomic.AddInt64(&d.stats.badAcks, 1)
+		log.WithField("imei", d.imei).Warnf("Acknowledged %d of %d records", count, len(positions))
+		return nil
+	}
+	atomic.AddInt64(&d.stats.acked, 1)
+	return nil
+}
+
+func encode(positions []*common.Position) ([]byte, error) {
+	if *codec == "8" {
+		records := make([]*teltonika.Record, len(positions))
+		for i, p := range positions {
+			records[i] = teltonika.NewRecord(p)
+		}
+		return teltonika.Encode(records)
+	}
+	records := make([]*teltonika.Record8e, len(positions))
+	for i, p := range positions {
+		records[i] = teltonika.NewRecord8e(p)
+	}
+	return teltonika.Encode(records)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/xml"
+	"math"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const earthRadius = 6371000.0
+
+// waypoint is a point of a route. Time is only known for GPX tracks.
+type waypoint struct {
+	Lat  float64
+	Lon  float64
+	Ele  float64
+	Time time.Time
+}
+
+type gpx struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []struct {
+				Lat  float64 `xml:"lat,attr"`
+				Lon  float64 `xml:"lon,attr"`
+				Ele  float64 `xml:"ele"`
+				Time string  `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// loadGPX reads the track points of every track in a GPX file.
+func loadGPX(path string) (route []waypoint, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc := gpx{}
+	err = xml.NewDecoder(f).Decode(&doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "GPX parsing failed")
+	}
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, pt := range seg.Points {
+				wp := waypoint{Lat: pt.Lat, Lon: pt.Lon, Ele: pt.Ele}
+				wp.Time, _ = time.Parse(time.RFC3339, pt.Time)
+				route = append(route, wp)
+			}
+		}
+	}
+	if len(route) < 2 {
+		return nil, errors.New("GPX file needs at least two track points")
+	}
+	return route, nil
+}
+
+// circleRoute makes a closed route of n points around a center.
+func circleRoute(lat, lon, radius float64, n int) []waypoint {
+	route := make([]waypoint, n)
+	for i := range route {
+		bearing := 2 * math.Pi * float64(i) / float64(n)
+		route[i] = destination(lat, lon, radius, bearing)
+	}
+	return route
+}
+
+// destination returns the point reached from lat, lon after
+// distance meters along bearing (radians).
+func destination(lat, lon, distance, bearing float64) waypoint {
+	φ1 := lat * math.Pi / 180
+	λ1 := lon * math.Pi / 180
+	δ := distance / earthRadius
+	φ2 := math.Asin(math.Sin(φ1)*math.Cos(δ) + math.Cos(φ1)*math.Sin(δ)*math.Cos(bearing))
+	λ2 := λ1 + math.Atan2(math.Sin(bearing)*math.Sin(δ)*math.Cos(φ1), math.Cos(δ)-math.Sin(φ1)*math.Sin(φ2))
+	return waypoint{Lat: φ2 * 180 / math.Pi, Lon: λ2 * 180 / math.Pi}
+}
+
+// distance returns the great circle distance between a and b in meters.
+func distance(a, b waypoint) float64 {
+	φ1 := a.Lat * math.Pi / 180
+	φ2 := b.Lat * math.Pi / 180
+	Δφ := φ2 - φ1
+	Δλ := (b.Lon - a.Lon) * math.Pi / 180
+	h := math.Sin(Δφ/2)*math.Sin(Δφ/2) + math.Cos(φ1)*math.Cos(φ2)*math.Sin(Δλ/2)*math.Sin(Δλ/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// routeLength returns the length of the closed route in meters.
+func routeLength(route []waypoint) (length float64) {
+	for i := range route {
+		length += distance(route[i], route[(i+1)%len(route)])
+	}
+	return
+}
+
+// bearing returns the initial heading from a to b in degrees.
+func bearing(a, b waypoint) float64 {
+	φ1 := a.Lat * math.Pi / 180
+	φ2 := b.Lat * math.Pi / 180
+	Δλ := (b.Lon - a.Lon) * math.Pi / 180
+	y := math.Sin(Δλ) * math.Cos(φ2)
+	x := math.Cos(φ1)*math.Sin(φ2) - math.Sin(φ1)*math.Cos(φ2)*math.Cos(Δλ)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// cursor moves along a route at a constant speed, looping at its end.
+type cursor struct {
+	route []waypoint
+	leg   int
+	// offset is the distance travelled along the current leg.
+	offset float64
+	speed  float64
+}
+
+// advance moves the cursor by elapsed time and returns the new
+// position together with the heading of the current leg. The route
+// must have a non-zero length.
+func (c *cursor) advance(elapsed time.Duration) (wp waypoint, heading float64) {
+	remaining := c.speed / 3.6 * elapsed.Seconds()
+	for {
+		a := c.route[c.leg]
+		b := c.route[(c.leg+1)%len(c.route)]
+		length := distance(a, b)
+		if c.offset+remaining < length {
+			c.offset += remaining
+			heading = bearing(a, b)
+			wp = destination(a.Lat, a.Lon, c.offset, heading*math.Pi/180)
+			wp.Ele = a.Ele
+			return wp, heading
+		}
+		remaining -= length - c.offset
+		c.offset = 0
+		c.leg = (c.leg + 1) % len(c.route)
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"net"
+	"time"
+)
+
+// Directions of a RawFrame.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// OutcomeOK is the outcome of frames that were parsed or sent successfully.
+const OutcomeOK = "ok"
+
+// RawFrame holds the exact bytes of a frame exchanged with a device.
+type RawFrame struct {
+	Time       time.Time
+	Source     string
+	IMEI       string
+	RemoteAddr string
+	// Network is the network of RemoteAddr, "tcp" or "udp".
+	Network   string
+	Direction string
+	// Handshake is set for the frames read by InitializeConnection.
+	Handshake bool
+	// Outcome is OutcomeOK or the error the frame caused.
+	Outcome string
+	Data    []byte
+}
+
+// Archiver keeps the raw frames exchanged with devices. Archive must not
+// block the handler for long and must not keep f.Data past the call
+// unless it owns it, which it does for frames built by Handler.
+type Archiver interface {
+	Archive(f *RawFrame)
+}
+
+func (h *Handler) archiveRaw(raw []byte, err error) {
+	h.archive(DirectionIn, raw, err)
+}
+
+func (h *Handler) archive(direction string, data []byte, err error) {
+	if h.Archiver == nil || len(data) == 0 {
+		return
+	}
+	outcome := OutcomeOK
+	if err != nil {
+		outcome = err.Error()
+	}
+	f := &RawFrame{
+		Time:      time.Now(),
+		Source:    h.Name,
+		IMEI:      h.IMEI,
+		Direction: direction,
+		Handshake: h.handshaking,
+		Outcome:   outcome,
+		Data:      data,
+	}
+	if addr := h.RemoteAddr(); addr != nil {
+		f.RemoteAddr = addr.String()
+		f.Network = addr.Network()
+	}
+	h.Archiver.Archive(f)
+}
+
+// archivingConn archives everything written to conn as outgoing frames.
+type archivingConn struct {
+	net.Conn
+	h *Handler
+}
+
+func (ac archivingConn) Write(b []byte) (n int, err error) {
+	// Replies sent during the handshake follow what the device sent so far.
+	// The handshake is read by the goroutine writing them, so the raw
+	// message can be taken here.
+	if ac.h.handshaking {
+		ac.h.archiveRaw(ac.h.takeRawMessage(), nil)
+	}
+	n, err = ac.Conn.Write(b)
+	data := make([]byte, n)
+	copy(data, b)
+	ac.h.archive(DirectionOut, data, err)
+	return
+}
+
+func (ac archivingConn) Peek(n int) ([]byte, error) {
+	if p, ok := ac.Conn.(Peeker); ok {
+		return p.Peek(n)
+	}
+	return nil, ErrCantPeek
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	goerr "errors"
+	"time"
+)
+
+var (
+	ErrCommandsUnsupported = goerr.New("protocol doesn't support outbound commands")
+	ErrNotConnected        = goerr.New("device not connected")
+	ErrCommandTimeout      = goerr.New("device didn't reply to command in time")
+	ErrCommandQueueFull    = goerr.New("command queue is full")
+)
+
+// commandQueueSize is the number of commands that can wait for
+// a single connection before new ones are refused.
+const commandQueueSize = 16
+
+// Commander is implemented by Interactors whose protocol can carry
+// commands from the server to the device.
+type Commander interface {
+	// EncodeCommand wraps payload into a frame that's written to
+	// the device as is.
+	EncodeCommand(h *Handler, payload []byte) (frame []byte, err error)
+}
+
+// CommandReply is the outcome of a command sent to a device.
+type CommandReply struct {
+	Payload []byte
+	Err     error
+}
+
+// command is a queued outbound command. Commands are sent one at a time,
+// so the next reply received from the device always belongs to the
+// command in flight.
+type command struct {
+	payload  []byte
+	timeout  time.Duration
+	deadline time.Time
+	reply    chan CommandReply
+}
+
+func (c *command) resolve(r CommandReply) {
+	c.reply <- r
+}
+
+// SendCommand queues payload for the device on this connection and waits
+// until the device replies or timeout elapses.
+func (h *Handler) SendCommand(payload []byte, timeout time.Duration) (reply []byte, err error) {
+	if _, ok := h.Interactor.(Commander); !ok {
+		return nil, ErrCommandsUnsupported
+	}
+	cmd := &command{
+		payload: payload,
+		timeout: timeout,
+		reply:   make(chan CommandReply, 1),
+	}
+	select {
+	case h.commands <- cmd:
+	case <-h.done:
+		return nil, ErrNotConnected
+	default:
+		return nil, ErrCommandQueueFull
+	}
+	select {
+	case r := <-cmd.reply:
+		return r.Payload, r.Err
+	case <-h.done:
+		return nil, ErrNotConnected
+	}
+}
+
+// ResolveCommand hands a reply received from the device to the command
+// in flight. It returns false if no command was waiting for a reply.
+// It must only be called from HandleMessage.
+func (h *Handler) ResolveCommand(payload []byte) bool {
+	if h.inFlight == nil {
+		return false
+	}
+	h.inFlight.resolve(CommandReply{Payload: payload})
+	h.inFlight = nil
+	return true
+}
+
+// dispatchCommand writes cmd to the device and marks it as in flight.
+func (h *Handler) dispatchCommand(cmd *command) (err error) {
+	frame, err := h.Interactor.(Commander).EncodeCommand(h, cmd.payload)
+	if err != nil {
+		cmd.resolve(CommandReply{Err: err})
+		return nil
+	}
+	_, err = h.Conn.Write(frame)
+	if err != nil {
+		cmd.resolve(CommandReply{Err: err})
+		return
+	}
+	h.DebugLog().Debugf("Command sent: %x", frame)
+	cmd.deadline = time.Now().Add(cmd.timeout)
+	h.inFlight = cmd
+	return
+}
+
+// expireCommand fails the command in flight if its reply is overdue.
+func (h *Handler) expireCommand(now time.Time) {
+	if h.inFlight != nil && now.After(h.inFlight.deadline) {
+		h.inFlight.resolve(CommandReply{Err: ErrCommandTimeout})
+		h.inFlight = nil
+	}
+}
+
+// failCommands fails every command that is still waiting when
+// the connection goes away.
+func (h *Handler) failCommands() {
+	if h.inFlight != nil {
+		h.inFlight.resolve(CommandReply{Err: ErrNotConnected})
+		h.inFlight = nil
+	}
+	for {
+		select {
+		case cmd := <-h.commands:
+			cmd.resolve(CommandReply{Err: ErrNotConnected})
+		default:
+			return
+		}
+	}
+}
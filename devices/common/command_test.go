@@ -0,0 +1,296 @@
+package common
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const commandIMEI = "356307042441013"
+
+// commandInteractor sends commands prefixed with '>' and takes every
+// byte received as the reply to the command in flight.
+type commandInteractor struct {
+	byteInteractor
+}
+
+func (commandInteractor) EncodeCommand(h *Handler, payload []byte) ([]byte, error) {
+	return append([]byte(">"), payload...), nil
+}
+
+func (commandInteractor) HandleMessage(h *Handler, msg interface{}) error {
+	h.ResolveCommand(msg.([]byte))
+	return nil
+}
+
+// serveCommands serves a device taking commands on one end of a pipe and
+// returns the other end once the device can be reached through sessions.
+func serveCommands(t *testing.T) (device net.Conn, sessions *Sessions, done <-chan struct{}) {
+	device, conn := net.Pipe()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	sessions = NewSessions()
+	h := &Handler{
+		Name:       "commands",
+		Conn:       conn,
+		IMEI:       commandIMEI,
+		Logger:     logger,
+		Timeout:    10 * time.Second,
+		Interactor: commandInteractor{},
+		Unregister: func() {},
+		sessions:   sessions,
+	}
+	d := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(d)
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+	for deadline := time.Now().Add(5 * time.Second); sessions.Get(commandIMEI) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("device not connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return device, sessions, d
+}
+
+// sendCommand sends payload in the background and returns its outcome.
+func sendCommand(sessions *Sessions, payload string, timeout time.Duration) <-chan CommandReply {
+	c := make(chan CommandReply, 1)
+	go func() {
+		reply, err := sessions.SendCommand(commandIMEI, []byte(payload), timeout)
+		c <- CommandReply{reply, err}
+	}()
+	return c
+}
+
+// receive reads the next frame sent to device and checks it.
+func receive(t *testing.T, device net.Conn, want string) {
+	frame := make([]byte, len(want))
+	_, err := io.ReadFull(device, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame) != want {
+		t.Errorf("frame %q, want %q", frame, want)
+	}
+}
+
+func reply(t *testing.T, device net.Conn, b string) {
+	_, err := device.Write([]byte(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkReply(t *testing.T, c <-chan CommandReply, want string, wantErr error) {
+	select {
+	case r := <-c:
+		if string(r.Payload) != want || r.Err != wantErr {
+			t.Errorf("reply %q with error %v, want %q with %v", r.Payload, r.Err, want, wantErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	device, sessions, done := serveCommands(t)
+	first := sendCommand(sessions, "ab", time.Second)
+	receive(t, device, ">ab")
+
+	// The second command waits until the first one got its reply.
+	second := sendCommand(sessions, "cd", time.Second)
+	device.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := device.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("read %d bytes while a command was in flight, error %v", n, err)
+	}
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+	reply(t, device, "A")
+	checkReply(t, first, "A", nil)
+
+	receive(t, device, ">cd")
+	reply(t, device, "B")
+	checkReply(t, second, "B", nil)
+
+	device.Close()
+	<-done
+	if _, err := sessions.SendCommand(commandIMEI, []byte("ef"), time.Second); err != ErrNotConnected {
+		t.Errorf("command after disconnect: %v", err)
+	}
+}
+
+func TestCommandExpiry(t *testing.T) {
+	device, sessions, done := serveCommands(t)
+	defer func() {
+		device.Close()
+		<-done
+	}()
+	expired := sendCommand(sessions, "ab", 10*time.Millisecond)
+	receive(t, device, ">ab")
+	checkReply(t, expired, "", ErrCommandTimeout)
+
+	// The next command is sent once the expired one is given up.
+	next := sendCommand(sessions, "cd", time.Second)
+	receive(t, device, ">cd")
+	reply(t, device, "C")
+	checkReply(t, next, "C", nil)
+}
+
+func TestCommandsFailOnDisconnect(t *testing.T) {
+	device, sessions, done := serveCommands(t)
+	inFlight := sendCommand(sessions, "ab", time.Second)
+	receive(t, device, ">ab")
+	queued := sendCommand(sessions, "cd", time.Second)
+	h := sessions.Get(commandIMEI)
+	for deadline := time.Now().Add(5 * time.Second); len(h.commands) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("command not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	device.Close()
+	checkReply(t, inFlight, "", ErrNotConnected)
+	checkReply(t, queued, "", ErrNotConnected)
+	<-done
+}
+
+func TestSendCommandErrors(t *testing.T) {
+	h := &Handler{Interactor: byteInteractor{}}
+	if _, err := h.SendCommand([]byte("ab"), time.Second); err != ErrCommandsUnsupported {
+		t.Errorf("unsupported: %v", err)
+	}
+
+	h = &Handler{
+		Interactor: commandInteractor{},
+		commands:   make(chan *command, commandQueueSize),
+		done:       make(chan struct{}),
+	}
+	for i := 0; i < commandQueueSize; i++ {
+		h.commands <- &command{reply: make(chan CommandReply, 1)}
+	}
+	if _, err := h.SendCommand([]byte("ab"), time.Second); err != ErrCommandQueueFull {
+		t.Errorf("full queue: %v", err)
+	}
+	close(h.done)
+	if _, err := h.SendCommand([]byte("ab"), time.Second); err != ErrNotConnected {
+		t.Errorf("closed connection: %v", err)
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	h := &Handler{}
+	if h.ResolveCommand([]byte("A")) {
+		t.Error("resolved without a command in flight")
+	}
+	cmd := &command{reply: make(chan CommandReply, 1)}
+	h.inFlight = cmd
+	if !h.ResolveCommand([]byte("A")) {
+		t.Fatal("command in flight not resolved")
+	}
+	if r := <-cmd.reply; string(r.Payload) != "A" || r.Err != nil {
+		t.Errorf("reply %q with error %v", r.Payload, r.Err)
+	}
+	// Only the first reply belongs to the command.
+	if h.inFlight != nil || h.ResolveCommand([]byte("B")) {
+		t.Error("resolved twice")
+	}
+}
+
+func TestExpireCommand(t *testing.T) {
+	now := time.Now()
+	cmd := &command{deadline: now, reply: make(chan CommandReply, 1)}
+	h := &Handler{inFlight: cmd}
+	h.expireCommand(now)
+	if h.inFlight != cmd {
+		t.Fatal("expired at its deadline")
+	}
+	h.expireCommand(now.Add(time.Millisecond))
+	if r := <-cmd.reply; h.inFlight != nil || r.Err != ErrCommandTimeout {
+		t.Errorf("in flight %v, error %v", h.inFlight, r.Err)
+	}
+}
+
+func TestFailCommands(t *testing.T) {
+	h := &Handler{commands: make(chan *command, commandQueueSize)}
+	h.inFlight = &command{reply: make(chan CommandReply, 1)}
+	cmds := []*command{h.inFlight}
+	for i := 0; i < 2; i++ {
+		cmd := &command{reply: make(chan CommandReply, 1)}
+		h.commands <- cmd
+		cmds = append(cmds, cmd)
+	}
+	h.failCommands()
+	for i, cmd := range cmds {
+		if r := <-cmd.reply; r.Err != ErrNotConnected {
+			t.Errorf("command %d: error %v", i, r.Err)
+		}
+	}
+	if h.inFlight != nil || len(h.commands) != 0 {
+		t.Error("commands left")
+	}
+}
+
+func TestCommandAPI(t *testing.T) {
+	logger := log.StandardLogger()
+	out := logger.Out
+	defer func() { logger.Out = out }()
+	logger.Out = ioutil.Discard
+
+	device, sessions, done := serveCommands(t)
+	defer func() {
+		device.Close()
+		<-done
+	}()
+	unsupported := NewSessions()
+	unsupported.Add(&Handler{IMEI: "353288040073284", Interactor: byteInteractor{}})
+	api := &CommandAPI{Servers: []*Server{{Name: "gt06", Sessions: unsupported}, {Name: "commands", Sessions: sessions}}}
+
+	go func() {
+		frame := make([]byte, 3)
+		// The command with the default timeout is answered,
+		// the one with a short timeout isn't.
+		for _, b := range []string{"A", ""} {
+			if _, err := io.ReadFull(device, frame); err != nil {
+				return
+			}
+			device.Write([]byte(b))
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		reply  string
+	}{
+		{"reply", "POST", "/devices/" + commandIMEI + "/commands", "ab", http.StatusOK, "A"},
+		{"no reply", "POST", "/devices/" + commandIMEI + "/commands?timeout=10ms", "cd", http.StatusGatewayTimeout, ""},
+		{"not connected", "POST", "/devices/356307042441014/commands", "ab", http.StatusNotFound, ""},
+		{"unsupported", "POST", "/devices/353288040073284/commands", "ab", http.StatusNotImplemented, ""},
+		{"method", "GET", "/devices/" + commandIMEI + "/commands", "", http.StatusMethodNotAllowed, ""},
+		{"path", "POST", "/devices/" + commandIMEI, "ab", http.StatusNotFound, ""},
+		{"timeout", "POST", "/devices/" + commandIMEI + "/commands?timeout=soon", "ab", http.StatusBadRequest, ""},
+		{"empty", "POST", "/devices/" + commandIMEI + "/commands", "", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if tt.reply != "" && w.Body.String() != tt.reply {
+			t.Errorf("%s: reply %q, want %q", tt.name, w.Body, tt.reply)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxCommandSize bounds the body of a command request.
+	maxCommandSize = 4096
+	// defaultCommandTimeout applies when neither the request
+	// nor CommandAPI set a timeout.
+	defaultCommandTimeout = 30 * time.Second
+)
+
+// CommandAPI sends commands to the devices connected to Servers over HTTP.
+// The command is the body of
+//
+//	POST /devices/<imei>/commands?timeout=30s
+//
+// and the reply of the device is the body of the response. Commands are
+// queued behind the ones already sent to the device, their timeout only
+// runs once they are sent.
+type CommandAPI struct {
+	Servers []*Server
+	// Timeout applies to requests without a timeout parameter.
+	Timeout time.Duration
+}
+
+func (a *CommandAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "devices" || parts[2] != "commands" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	imei := parts[1]
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil || timeout <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCommandSize))
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "body read failed").Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload) == 0 {
+		http.Error(w, "empty command", http.StatusBadRequest)
+		return
+	}
+
+	entry := log.WithFields(log.Fields{
+		"addr": r.RemoteAddr,
+		"imei": imei,
+	})
+	reply, err := a.sendCommand(imei, payload, timeout)
+	if err != nil {
+		entry.WithError(err).Infof("Command %q failed", payload)
+		http.Error(w, err.Error(), commandStatus(err))
+		return
+	}
+	entry.Infof("Command %q answered", payload)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(reply)
+}
+
+// sendCommand sends payload to the device on whichever server it's
+// connected to.
+func (a *CommandAPI) sendCommand(imei string, payload []byte, timeout time.Duration) ([]byte, error) {
+	for _, s := range a.Servers {
+		if s.Sessions == nil {
+			continue
+		}
+		if h := s.Sessions.Get(imei); h != nil {
+			return h.SendCommand(payload, timeout)
+		}
+	}
+	return nil, ErrNotConnected
+}
+
+// commandStatus returns the HTTP status of a failed command.
+func commandStatus(err error) int {
+	switch errors.Cause(err) {
+	case ErrNotConnected:
+		return http.StatusNotFound
+	case ErrCommandsUnsupported:
+		return http.StatusNotImplemented
+	case ErrCommandQueueFull:
+		return http.StatusServiceUnavailable
+	case ErrCommandTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -1,6 +1,8 @@
 package common
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
 	"time"
@@ -18,6 +20,15 @@ type teeConn struct {
 	reader io.Reader
 }
 
+// Peek returns the next n bytes of conn without consuming them, so they
+// are only written to dst once they're read.
+func (tc teeConn) Peek(n int) ([]byte, error) {
+	if p, ok := tc.conn.(Peeker); ok {
+		return p.Peek(n)
+	}
+	return nil, ErrCantPeek
+}
+
 func (tc teeConn) Read(b []byte) (n int, err error)   { return tc.reader.Read(b) }
 func (tc teeConn) Write(b []byte) (n int, err error)  { return tc.conn.Write(b) }
 func (tc teeConn) Close() error                       { return tc.conn.Close() }
@@ -26,3 +37,30 @@ func (tc teeConn) RemoteAddr() net.Addr               { return tc.conn.RemoteAdd
 func (tc teeConn) SetDeadline(t time.Time) error      { return tc.conn.SetDeadline(t) }
 func (tc teeConn) SetReadDeadline(t time.Time) error  { return tc.conn.SetReadDeadline(t) }
 func (tc teeConn) SetWriteDeadline(t time.Time) error { return tc.conn.SetWriteDeadline(t) }
+
+// ErrCantPeek is returned by connections that wrap one that can't peek.
+var ErrCantPeek = errors.New("connection doesn't support peeking")
+
+// Peeker is implemented by connections that can look at the data they
+// received before it's read.
+type Peeker interface {
+	Peek(n int) ([]byte, error)
+}
+
+// BufferedConn is a net.Conn whose reads go through a bufio.Reader, so that
+// interactors can sniff what a device sent before deciding how to read it.
+type BufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewBufferedConn wraps conn in a BufferedConn.
+func NewBufferedConn(conn net.Conn) *BufferedConn {
+	return &BufferedConn{conn, bufio.NewReader(conn)}
+}
+
+func (bc *BufferedConn) Read(b []byte) (n int, err error) { return bc.r.Read(b) }
+
+// Peek returns the next n bytes without consuming them. It blocks until
+// n bytes have arrived or the read deadline expires.
+func (bc *BufferedConn) Peek(n int) ([]byte, error) { return bc.r.Peek(n) }
@@ -0,0 +1,226 @@
+package common
+
+import (
+	goerr "errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thejerf/suture"
+)
+
+var errConnClosed = goerr.New("connection closed")
+
+// maxDatagramSize is large enough for any UDP payload.
+const maxDatagramSize = 65535
+
+// datagramBacklog is the number of datagrams buffered for a single
+// session before new ones are dropped.
+const datagramBacklog = 32
+
+// serveDatagrams is the UDP counterpart of the TCP accept loop. Datagrams
+// are grouped into pseudo-connections by the IMEI returned by DatagramIMEI,
+// so that Handlers and Interactors see a UDP device the same way as a TCP one.
+func (s *Server) serveDatagrams() {
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"src":   s.Name,
+		}).Error("Couldn't create listener")
+		return
+	}
+	log.WithFields(log.Fields{
+		"addr": s.Addr,
+		"src":  s.Name,
+	}).Info("Listening for datagrams")
+
+	var mu sync.Mutex
+	conns := make(map[string]*datagramConn)
+
+	dgChan, errChan := datagramReader(pc)
+	for {
+		select {
+		case dg := <-dgChan:
+			imei, err := s.DatagramIMEI(dg.data)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"addr":  dg.addr,
+					"src":   s.Name,
+				}).Debug("Dropping datagram")
+				continue
+			}
+			mu.Lock()
+			conn, ok := conns[imei]
+			if !ok && !s.acquireConnection() {
+				mu.Unlock()
+				log.WithFields(log.Fields{
+					"addr": dg.addr,
+					"imei": imei,
+					"src":  s.Name,
+				}).Warn("Too many sessions, dropping datagram")
+				continue
+			}
+			if !ok {
+				log.WithFields(log.Fields{
+					"addr": dg.addr,
+					"imei": imei,
+					"src":  s.Name,
+				}).Info("New session")
+				conn = newDatagramConn(pc, dg.addr)
+				conns[imei] = conn
+				handler := s.newHandler(conn, s.Name, s.InteractorGenerator)
+				handler.IMEI = imei
+				token := make(chan suture.ServiceToken, 1)
+				handler.Unregister = func() {
+					mu.Lock()
+					if conns[imei] == conn {
+						delete(conns, imei)
+					}
+					mu.Unlock()
+					s.ConnectionSupervisor.Remove(<-token)
+					s.releaseConnection()
+				}
+				token <- s.ConnectionSupervisor.Add(handler)
+			}
+			mu.Unlock()
+			conn.deliver(dg)
+		case readErr := <-errChan:
+			log.WithFields(log.Fields{
+				"error": readErr,
+				"src":   s.Name,
+			}).Error("Error when reading datagram. Restarting listener.")
+			pc.Close()
+			return
+		case <-s.stop:
+			if closeErr := pc.Close(); closeErr != nil {
+				log.WithFields(log.Fields{
+					"error": closeErr,
+					"src":   s.Name,
+				}).Error("Error when closing listener")
+			}
+			return
+		}
+	}
+}
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// datagramReader reads datagrams from pc using a separate goroutine
+// and sends them through dgChan.
+func datagramReader(pc net.PacketConn) (dgChan <-chan datagram, errChan <-chan error) {
+	dc := make(chan datagram, 1)
+	ec := make(chan error, 1)
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				ec <- err
+				return
+			}
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			dc <- datagram{data: data, addr: addr}
+		}
+	}()
+	return dc, ec
+}
+
+// datagramConn is a net.Conn made of the datagrams of a single device.
+// Like with a net.UDPConn, every read returns a single datagram, so that
+// a malformed one can't run into the next. Writes are sent to the address
+// the last datagram came from.
+type datagramConn struct {
+	pc     net.PacketConn
+	in     chan datagram
+	closed chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	remote   net.Addr
+	deadline time.Time
+}
+
+func newDatagramConn(pc net.PacketConn, remote net.Addr) *datagramConn {
+	return &datagramConn{
+		pc:     pc,
+		remote: remote,
+		in:     make(chan datagram, datagramBacklog),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *datagramConn) deliver(dg datagram) {
+	select {
+	case c.in <- dg:
+	case <-c.closed:
+	default:
+		log.WithField("addr", dg.addr).Warn("Session backlog full, dropping datagram")
+	}
+}
+
+// Read returns the next datagram, cut to the size of b.
+func (c *datagramConn) Read(b []byte) (n int, err error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case dg := <-c.in:
+		c.mu.Lock()
+		c.remote = dg.addr
+		c.mu.Unlock()
+		return copy(b, dg.data), nil
+	case <-timeout:
+		return 0, &net.OpError{Op: "read", Net: "udp", Addr: c.RemoteAddr(), Err: timeoutError{}}
+	case <-c.closed:
+		return 0, errConnClosed
+	}
+}
+
+func (c *datagramConn) Write(b []byte) (n int, err error) {
+	return c.pc.WriteTo(b, c.RemoteAddr())
+}
+
+func (c *datagramConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *datagramConn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+
+func (c *datagramConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+func (c *datagramConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *datagramConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
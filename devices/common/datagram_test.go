@@ -0,0 +1,47 @@
+package common
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatagramConnReads(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	first := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	second := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	c := newDatagramConn(pc, first)
+	c.deliver(datagram{data: []byte("abc"), addr: first})
+	c.deliver(datagram{data: []byte("defgh"), addr: second})
+	c.deliver(datagram{data: []byte("ij"), addr: second})
+
+	// Every read returns a single datagram, cut to the size of the buffer.
+	for _, want := range []string{"abc", "def", "ij"} {
+		b := make([]byte, 3)
+		n, err := c.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != want {
+			t.Errorf("read %q, want %q", b[:n], want)
+		}
+	}
+	if c.RemoteAddr() != second {
+		t.Errorf("replies go to %v, want %v", c.RemoteAddr(), second)
+	}
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = c.Read(make([]byte, 3))
+	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Errorf("read after the deadline: %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	c.Close()
+	if _, err = c.Read(make([]byte, 3)); err != errConnClosed {
+		t.Errorf("read after close: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package common_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/khiemm/listener/devices/common"
+	_ "github.com/khiemm/listener/devices/gt06"
+	_ "github.com/khiemm/listener/devices/queclink"
+	_ "github.com/khiemm/listener/devices/ruptela"
+	_ "github.com/khiemm/listener/devices/teltonika"
+)
+
+// TestDetectRegisteredProtocols runs the detection of every registered
+// protocol on the first bytes sent by real devices.
+func TestDetectRegisteredProtocols(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    string
+		protocol string
+	}{
+		{"Teltonika IMEI", hex.EncodeToString([]byte("\x00\x0f356307042441013")), "teltonika"},
+		{"DirectIP", "01004c01001c0b7c3a25333030323334303130373533333730", "teltonika"},
+		{"GT06 login", "78780d010353288040073284000120c50d0a", "gt06"},
+		{"GT06 long packet", "7979000c9400000000000001d9dc0d0a", "gt06"},
+		{"Ruptela", "0150000141504821c84401", "ruptela"},
+		{"Ruptela short packet", "001a000310834c7adc3601", "ruptela"},
+		{"Queclink report", hex.EncodeToString([]byte("+RESP:GTFRI,060100,862581040012342,")), "queclink"},
+		{"Queclink buffered report", hex.EncodeToString([]byte("+BUFF:GTFRI,060100,862581040012342,")), "queclink"},
+		{"Queclink heartbeat", hex.EncodeToString([]byte("+ACK:GTHBD,060100,862581040012342,")), "queclink"},
+	}
+	for _, tt := range tests {
+		first, err := hex.DecodeString(tt.first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := first[:common.DetectLength]
+		var matches []string
+		for _, name := range common.Protocols() {
+			p, _ := common.LookupProtocol(name)
+			if p.Detect != nil && p.Detect(head) {
+				matches = append(matches, p.Name)
+			}
+		}
+		if len(matches) != 1 || matches[0] != tt.protocol {
+			t.Errorf("%s: %x detected as %v, want %s", tt.name, head, matches, tt.protocol)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package common
+
+// RequireClientCertificate makes h refuse devices whose client
+// certificate wasn't issued to their IMEI, as a TLS server with
+// VerifyIMEI does.
+func RequireClientCertificate(h *Handler) {
+	h.verifyIMEI = true
+}
+
+// Counted is counted for the external tests.
+var Counted = counted
@@ -2,10 +2,12 @@ package common
 
 import (
 	"bytes"
+	"crypto/tls"
 	goerr "errors"
 	"io"
 	"io/ioutil"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -30,16 +32,36 @@ func (f emptyFormatter) Format(_ *log.Entry) ([]byte, error) {
 }
 
 type Handler struct {
-	Name       string
-	Conn       net.Conn
-	ID         int64
-	Debug      bool
-	Unregister func()
-	stop       chan struct{}
-	Logger     *log.Logger
+	Name          string
+	Conn          net.Conn
+	ID            int64
+	IMEI          string
+	Debug         bool
+	Store         Store
+	AckPolicy     AckPolicy
+	Validator     *Validator
+	Quarantine    Quarantine
+	Installations Installations
+	Archiver      Archiver
+	Unregister    func()
+	stop          chan struct{}
+	done          chan struct{}
+	Logger        *log.Logger
 	Interactor
 	lastRawMessage *bytes.Buffer
-	MessageData string
+	rawMessage     []byte
+	handshaking    bool
+	MessageData    string
+	InstalledAt    time.Time
+	Timeout        time.Duration
+	sessions       *Sessions
+	commands       chan *command
+	inFlight       *command
+	tlsState       *tls.ConnectionState
+	verifyIMEI     bool
+	// remoteAddr is captured before Serve starts, since Conn
+	// is reset while the parser goroutine may still log.
+	remoteAddr net.Addr
 }
 
 type Interactor interface {
@@ -57,20 +79,41 @@ func (h *Handler) Serve() {
 		h.Unregister()
 	}()
 	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	h.commands = make(chan *command, commandQueueSize)
+	if h.remoteAddr == nil {
+		h.remoteAddr = h.Conn.RemoteAddr()
+	}
+	defer func() {
+		close(h.done)
+		h.failCommands()
+	}()
 
-	h.Conn.SetDeadline(makeTimeout(h.GetConnectionTimeout(*h)))
+	h.Conn.SetDeadline(makeTimeout(h.connectionTimeout()))
 
 	authorized := true
+	h.handshaking = true
 	err := h.InitializeConnection(h)
+	h.archiveRaw(h.takeRawMessage(), err)
+	h.handshaking = false
+	if err == nil {
+		err = h.VerifyIMEI(h.IMEI)
+	}
 	if err != nil {
 		h.Log().WithError(err).Info("Couldn't initialize connection")
-		if errors.Cause(err) == ErrUnauthorizedDevice {
+		if errors.Cause(err) != ErrUnauthorizedDevice && !isDisconnect(err) {
+			h.countProtocolError()
 		}
 		authorized = false
 	}
 
 	if authorized {
 		h.Log().Info("Connection initialized")
+		h.LoadInstallation()
+		if h.sessions != nil && h.IMEI != "" {
+			h.sessions.Add(h)
+			defer h.sessions.Remove(h)
+		}
 		err = h.Loop()
 		if err != nil {
 			h.Log().WithError(err).Error("Error in connection")
@@ -98,27 +141,33 @@ func (h *Handler) Stop() {
 }
 
 func (h *Handler) Loop() (err error) {
-	msgChan, errChan := h.chanParser(h.Conn)
+	msgChan, errChan, resumeParser, stopParser := h.chanParser(h.Conn, h.connectionTimeout())
+	// The parser goroutine uses the handler, so it has to be gone
+	// before the connection is closed and Conn reset.
+	defer stopParser()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		// lastRawMessage should only be empty when testing
-		if h.lastRawMessage != nil {
-			h.lastRawMessage.Reset()
+		// Only one command can wait for a reply at a time, otherwise
+		// the replies couldn't be told apart.
+		var commands <-chan *command
+		if h.inFlight == nil {
+			commands = h.commands
 		}
 
 		select {
-		case msg := <-msgChan:
+		case p := <-msgChan:
+			h.rawMessage = p.raw
 			h.DebugLog().Debugf("Raw message: %x", h.GetLastRawMessage())
-			err = h.HandleMessage(h, msg)
+			err = h.HandleMessage(h, p.msg)
 			if err != nil {
 				terminate := h.HandleError(h, err)
 				if terminate {
 					return
 				}
-			} else if h.Name == "queclink" {
-				// queclink handle process one time
-				return
 			}
-		case err = <-errChan:
+		case p := <-errChan:
+			err, h.rawMessage = p.err, p.raw
 			h.DebugLog().Debugf("Raw message: %x", h.GetLastRawMessage())
 			if neterr, ok := errors.Cause(err).(net.Error); ok && neterr.Timeout() {
 				h.Log().Debug("Connection timed out")
@@ -130,73 +179,198 @@ func (h *Handler) Loop() (err error) {
 				return
 			} else if err != nil {
 				h.Log().WithError(err).Error("Error when communicating")
+				h.countProtocolError()
 				terminate := h.HandleError(h, err)
 				if terminate {
 					return
 				}
+				err = nil
+				resumeParser()
+			}
+		case cmd := <-commands:
+			err = h.dispatchCommand(cmd)
+			if err != nil {
+				return errors.Wrap(err, "couldn't send command")
 			}
+		case now := <-ticker.C:
+			h.expireCommand(now)
 		case <-h.stop:
 			return
 		}
 	}
-	return
 }
 
-func (h *Handler) chanParser(c net.Conn) (recChan <-chan interface{}, errChan <-chan error) {
-	mc := make(chan interface{}, 1)
-	ec := make(chan error, 1)
+// countProtocolError counts an error in the traffic of the device.
+func (h *Handler) countProtocolError() {
+	count(h.metricName(), metricProtocolErrors)
+}
+
+// countHandshakeFailure counts a device refused after its handshake.
+func (h *Handler) countHandshakeFailure() {
+	count(h.metricName(), metricHandshakeFailures)
+}
+
+// isDisconnect tells whether err means that the device went away.
+func isDisconnect(err error) bool {
+	if neterr, ok := errors.Cause(err).(net.Error); ok && neterr.Timeout() {
+		return true
+	}
+	return errors.Cause(err) == io.EOF || errors.Cause(err) == io.ErrUnexpectedEOF
+}
+
+// parsed is a message read by chanParser together with its raw bytes.
+type parsed struct {
+	msg interface{}
+	err error
+	raw []byte
+}
+
+// chanParser parses messages of c in a goroutine until stop is called.
+// After an error, it waits for resume, which is called when HandleError
+// keeps the connection. The deadline of c is renewed with timeout
+// before each message; timeout is passed in rather than looked up,
+// since the handler mustn't be copied while Loop changes it.
+func (h *Handler) chanParser(c net.Conn, timeout time.Duration) (recChan <-chan parsed, errChan <-chan parsed, resume func(), stop func()) {
+	mc := make(chan parsed, 1)
+	ec := make(chan parsed, 1)
+	resumed := make(chan struct{})
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	// mu orders the deadline set by the goroutine and the one set by
+	// stop, so that a stopped goroutine doesn't wait for a full timeout.
+	var mu sync.Mutex
 	go func() {
+		defer close(done)
 		for {
-			err := c.SetDeadline(makeTimeout(h.GetConnectionTimeout(*h)))
+			mu.Lock()
+			select {
+			case <-quit:
+				mu.Unlock()
+				return
+			default:
+			}
+			err := c.SetDeadline(makeTimeout(timeout))
+			mu.Unlock()
 			// The OpError checking's here because we use net.Pipe
 			// in tests and it doesn't support setting timeouts.
 			if opErr, ok := err.(*net.OpError); err != nil && !(ok && opErr.Net == "pipe") {
 				h.Log().WithError(err).Debug("net.OpError in ChanParser")
-				ec <- err
+				ec <- parsed{err: err}
 				return
 			}
 			msg, err := h.ParseMessage(h)
+			raw := h.takeRawMessage()
+			h.archiveRaw(raw, err)
 			if err != nil {
 				// This is a debug-only log, because if it's a true error, it will be logged.
 				h.DebugLog().WithError(err).Debug("There was an error in connection")
-				ec <- err
+				ec <- parsed{err: err, raw: raw}
+				select {
+				case <-resumed:
+					continue
+				case <-quit:
+					return
+				}
+			}
+			select {
+			case mc <- parsed{msg: msg, raw: raw}:
+			case <-quit:
 				return
-			} else {
-				mc <- msg
 			}
 		}
 	}()
-	return mc, ec
+	resume = func() {
+		select {
+		case resumed <- struct{}{}:
+		case <-done:
+		}
+	}
+	stop = func() {
+		mu.Lock()
+		close(quit)
+		// Unblocks a pending read; a parser error is dropped.
+		c.SetReadDeadline(time.Now())
+		mu.Unlock()
+		<-done
+	}
+	return mc, ec, resume, stop
+}
+
+// Peek returns the next n bytes received from the device without
+// consuming them. Connections that can't peek are buffered first,
+// which replaces Conn, so Peek is meant for InitializeConnection
+// and mustn't be called once Loop has started.
+func (h *Handler) Peek(n int) ([]byte, error) {
+	if p, ok := h.Conn.(Peeker); ok {
+		b, err := p.Peek(n)
+		if err != ErrCantPeek {
+			return b, err
+		}
+	}
+	bc := NewBufferedConn(h.Conn)
+	h.Conn = bc
+	return bc.Peek(n)
 }
 
-func (h Handler) DebugLog() *log.Entry {
+func (h *Handler) DebugLog() *log.Entry {
 	if h.Debug {
 		return h.Log()
 	}
 	return log.NewEntry(discardLogger)
 }
 
-func (h Handler) Log() *log.Entry {
+func (h *Handler) Log() *log.Entry {
 	return h.Logger.WithFields(log.Fields{
 		"id":   h.ID,
-		"addr": h.Conn.RemoteAddr(),
+		"addr": h.RemoteAddr(),
 		"src":  h.Name,
 	})
 }
 
-func (h Handler) GetLastRawMessage() []byte {
+// RemoteAddr returns the address of the device. It's the one captured
+// when the handler was created or served, or the one of Conn for
+// handlers that aren't served.
+func (h *Handler) RemoteAddr() net.Addr {
+	if h.remoteAddr != nil {
+		return h.remoteAddr
+	}
+	if h.Conn != nil {
+		return h.Conn.RemoteAddr()
+	}
+	return nil
+}
+
+// GetLastRawMessage returns the bytes of the message being handled.
+func (h *Handler) GetLastRawMessage() []byte {
+	return h.rawMessage
+}
+
+// takeRawMessage returns a copy of the bytes read since the last call.
+func (h *Handler) takeRawMessage() []byte {
 	// This condition is necessary because server tests can't initialize
 	// lastRawMessage buffer
-	if h.lastRawMessage == nil {
+	if h.lastRawMessage == nil || h.lastRawMessage.Len() == 0 {
 		return nil
 	}
-	return h.lastRawMessage.Bytes()
+	raw := make([]byte, h.lastRawMessage.Len())
+	copy(raw, h.lastRawMessage.Bytes())
+	h.lastRawMessage.Reset()
+	return raw
 }
 
-func (h Handler) metricName() string {
+func (h *Handler) metricName() string {
 	return "listener." + h.Name + "."
 }
 
+// connectionTimeout returns Timeout, or the timeout
+// of the interactor when it's not set.
+func (h *Handler) connectionTimeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return h.GetConnectionTimeout(*h)
+}
+
 func makeTimeout(timeout time.Duration) time.Time {
 	return time.Now().Add(timeout)
 }
@@ -0,0 +1,167 @@
+package common
+
+import (
+	goerr "errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// byteInteractor reads one byte messages and ignores them.
+type byteInteractor struct{}
+
+func (byteInteractor) InitializeConnection(h *Handler) error { return nil }
+
+func (byteInteractor) ParseMessage(h *Handler) (interface{}, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(h.Conn, b)
+	return b, err
+}
+
+func (byteInteractor) HandleMessage(h *Handler, msg interface{}) error { return nil }
+
+func (byteInteractor) HandleError(h *Handler, err error) bool { return true }
+
+func (byteInteractor) GetConnectionTimeout(h Handler) time.Duration { return time.Second }
+
+func (byteInteractor) CloseConnection(h Handler) error { return nil }
+
+// frameArchive collects the archived frames.
+type frameArchive chan *RawFrame
+
+func (a frameArchive) Archive(f *RawFrame) { a <- f }
+
+func TestRemoteAddrAfterServe(t *testing.T) {
+	device, conn := net.Pipe()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	archived := make(frameArchive, 4)
+	h := &Handler{
+		Name:       "test",
+		Conn:       conn,
+		Logger:     logger,
+		Archiver:   archived,
+		Interactor: byteInteractor{},
+		Unregister: func() {},
+	}
+	done := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(done)
+	}()
+	device.Close()
+	<-done
+
+	if h.Conn != nil {
+		t.Fatal("Conn is still set")
+	}
+	if addr := h.RemoteAddr(); addr == nil || addr.String() != conn.RemoteAddr().String() {
+		t.Errorf("remote address %v, want %v", addr, conn.RemoteAddr())
+	}
+	// Logging and archiving once the connection is gone must not panic.
+	h.Log().Info("closed")
+	h.archive(DirectionIn, []byte{1}, goerr.New("late"))
+	f := <-archived
+	if f.Network != "pipe" || f.RemoteAddr != "pipe" {
+		t.Errorf("archived %s/%s", f.Network, f.RemoteAddr)
+	}
+}
+
+// counted returns the count of a failure counter, zero when it isn't registered.
+func counted(name string) int64 {
+	if c, ok := metrics.Get(name).(metrics.Counter); ok {
+		return c.Count()
+	}
+	return 0
+}
+
+func TestCountVerifyIMEIRefusal(t *testing.T) {
+	device, conn := net.Pipe()
+	defer device.Close()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	h := &Handler{
+		Name:       "refusal",
+		Conn:       conn,
+		IMEI:       "356307042441013",
+		Logger:     logger,
+		Interactor: byteInteractor{},
+		Unregister: func() {},
+		// No client certificate was presented.
+		verifyIMEI: true,
+	}
+	want := map[string]int64{
+		"listener.refusal.handshake_failures": counted("listener.refusal.handshake_failures") + 1,
+		"listener.refusal.protocol_errors":    counted("listener.refusal.protocol_errors"),
+	}
+	h.Serve()
+
+	for name, want := range want {
+		if got := counted(name); got != want {
+			t.Errorf("%s: %d, want %d", name, got, want)
+		}
+	}
+}
+
+var errSkipped = goerr.New("skipped")
+
+// skippingInteractor fails to parse the byte 'x' and keeps the
+// connection, other bytes are handed to handled.
+type skippingInteractor struct {
+	byteInteractor
+	handled chan byte
+}
+
+func (i skippingInteractor) ParseMessage(h *Handler) (interface{}, error) {
+	b, err := i.byteInteractor.ParseMessage(h)
+	if err == nil && b.([]byte)[0] == 'x' {
+		return nil, errSkipped
+	}
+	return b, err
+}
+
+func (i skippingInteractor) HandleMessage(h *Handler, msg interface{}) error {
+	i.handled <- msg.([]byte)[0]
+	return nil
+}
+
+func (skippingInteractor) HandleError(h *Handler, err error) bool { return err != errSkipped }
+
+func TestResumeAfterParseError(t *testing.T) {
+	device, conn := net.Pipe()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	handled := make(chan byte, 4)
+	h := &Handler{
+		Name:       "skipping",
+		Conn:       conn,
+		Logger:     logger,
+		Interactor: skippingInteractor{handled: handled},
+		Unregister: func() {},
+	}
+	done := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(done)
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := device.Write([]byte("axb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Close()
+	<-done
+	close(handled)
+	var got []byte
+	for b := range handled {
+		got = append(got, b)
+	}
+	if string(got) != "ab" {
+		t.Errorf("handled %q, want \"ab\"", got)
+	}
+}
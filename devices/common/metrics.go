@@ -0,0 +1,27 @@
+package common
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Failure counters, registered in the default go-metrics registry
+// under listener.<name>. of the server or the handler.
+const (
+	// metricHandshakeFailures counts failed TLS handshakes
+	// and devices refused by VerifyIMEI.
+	metricHandshakeFailures = "handshake_failures"
+	// metricProtocolErrors counts connections closed because
+	// of an error in the traffic of a device.
+	metricProtocolErrors = "protocol_errors"
+)
+
+// count increments a failure counter and returns its count.
+func count(prefix, name string) int64 {
+	c := metrics.GetOrRegisterCounter(prefix+name, metrics.DefaultRegistry)
+	c.Inc(1)
+	return c.Count()
+}
+
+func (s *Server) metricName() string {
+	return "listener." + s.Name + "."
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"sort"
+	"time"
+)
+
+// Position is a single fix reported by a device. Every protocol converts
+// its records to Positions, so that validating, storing and forwarding
+// them doesn't depend on the protocol.
+type Position struct {
+	Timestamp time.Time
+	// Latitude and Longitude are in degrees.
+	Latitude  float64
+	Longitude float64
+	// Altitude is in meters above sea level.
+	Altitude float64
+	// Heading is in degrees clockwise from north.
+	Heading float64
+	// Speed is in km/h.
+	Speed float64
+	// Satellites is UnknownSatellites for protocols that don't report it.
+	Satellites int
+	Priority   int
+	EventID    int
+	// IO holds the raw value of every IO element by its protocol specific ID.
+	IO map[uint16][]byte
+	// Attributes holds values decoded by the protocol, e.g. beacons.
+	Attributes map[string]interface{}
+}
+
+// UnknownSatellites is the satellite count of a fix whose protocol
+// doesn't report one.
+const UnknownSatellites = -1
+
+// IOIDs returns the IDs in p.IO in ascending order.
+func (p *Position) IOIDs() []uint16 {
+	ids := make([]uint16, 0, len(p.IO))
+	for id := range p.IO {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// SetAttribute stores a decoded value, creating the map when needed.
+func (p *Position) SetAttribute(name string, value interface{}) {
+	if p.Attributes == nil {
+		p.Attributes = make(map[string]interface{})
+	}
+	p.Attributes[name] = value
+}
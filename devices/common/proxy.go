@@ -0,0 +1,149 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	goerr "errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errProxyHeader   = goerr.New("malformed PROXY protocol header")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// maxProxyV1Length is the longest v1 header, CRLF included.
+	maxProxyV1Length = 107
+	proxyV2Local     = 0x20
+	proxyV2Proxy     = 0x21
+	proxyV2TCP4      = 0x11
+	proxyV2TCP6      = 0x21
+)
+
+// proxyConn is a connection accepted from a load balancer, whose
+// RemoteAddr is the address of the client the balancer forwards.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// trustedProxy tells whether conn comes from one of TrustedProxies.
+func (s *Server) trustedProxy(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.TrustedProxies {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and
+// returns the address of the client, or nil when the header doesn't
+// carry one, e.g. for the health checks of the balancer. It reads no
+// further than the header.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	first := make([]byte, 1)
+	_, err := io.ReadFull(r, first)
+	if err != nil {
+		return nil, errors.Wrap(err, "PROXY header read failed")
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	}
+	return nil, errors.Wrapf(errProxyHeader, "starts with %x", first)
+}
+
+// readProxyV1 reads the rest of "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Length {
+			return nil, errors.Wrap(errProxyHeader, "v1 header too long")
+		}
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, errors.Wrap(err, "PROXY header read failed")
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.Wrapf(errProxyHeader, "%q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.Wrapf(errProxyHeader, "%q", line)
+	}
+	if len(fields) != 6 {
+		return nil, errors.Wrapf(errProxyHeader, "%q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Wrapf(errProxyHeader, "%q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header. TLVs are skipped.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	head := make([]byte, len(proxyV2Signature)+3)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return nil, errors.Wrap(err, "PROXY header read failed")
+	}
+	if !bytes.Equal(head[:len(proxyV2Signature)-1], proxyV2Signature[1:]) {
+		return nil, errors.Wrap(errProxyHeader, "v2 signature mismatch")
+	}
+	command, family := head[len(head)-4], head[len(head)-3]
+	body := make([]byte, binary.BigEndian.Uint16(head[len(head)-2:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "PROXY header read failed")
+	}
+
+	switch command {
+	case proxyV2Local:
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, errors.Wrapf(errProxyHeader, "v2 command %x", command)
+	}
+	var ipLength int
+	switch family {
+	case proxyV2TCP4:
+		ipLength = net.IPv4len
+	case proxyV2TCP6:
+		ipLength = net.IPv6len
+	default:
+		// Other families don't have an address the listener can use.
+		return nil, nil
+	}
+	if len(body) < 2*ipLength+4 {
+		return nil, errors.Wrap(errProxyHeader, "v2 addresses truncated")
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLength]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLength:])),
+	}, nil
+}
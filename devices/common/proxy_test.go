@@ -0,0 +1,188 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	goerr "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/thejerf/suture"
+)
+
+// proxyV2 returns a v2 header of command for addresses of family.
+func proxyV2(command, family byte, body []byte) string {
+	head := append(append([]byte(nil), proxyV2Signature...), command, family, 0, 0)
+	binary.BigEndian.PutUint16(head[len(head)-2:], uint16(len(body)))
+	return string(append(head, body...))
+}
+
+// addressesV2 returns the body of a v2 header from src:sport to dst:dport.
+func addressesV2(src, dst string, sport, dport uint16) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if v4 := srcIP.To4(); v4 != nil {
+		srcIP, dstIP = v4, dstIP.To4()
+	}
+	body := append(append([]byte(nil), srcIP...), dstIP...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, sport)
+	binary.BigEndian.PutUint16(ports[2:], dport)
+	return append(body, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := addressesV2("203.0.113.7", "10.0.0.1", 56324, 1207)
+	tcp6 := addressesV2("2001:db8::7", "2001:db8::1", 56324, 1207)
+	// A TLV of the unique ID of the connection, which is skipped.
+	tlv := append(append([]byte(nil), tcp4...), 0x05, 0x00, 0x04, 'a', 'b', 'c', 'd')
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		err    error
+	}{
+		{"v1 TCP4", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 1207\r\n", "203.0.113.7:56324", nil},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::7 2001:db8::1 56324 1207\r\n", "[2001:db8::7]:56324", nil},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", nil},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN 203.0.113.7 10.0.0.1 56324 1207\r\n", "", nil},
+		{"v1 longest", "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+			"[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", nil},
+		{"v2 PROXY TCP4", proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4), "203.0.113.7:56324", nil},
+		{"v2 PROXY TCP6", proxyV2(proxyV2Proxy, proxyV2TCP6, tcp6), "[2001:db8::7]:56324", nil},
+		{"v2 TLVs", proxyV2(proxyV2Proxy, proxyV2TCP4, tlv), "203.0.113.7:56324", nil},
+		{"v2 LOCAL IPv4", proxyV2(proxyV2Local, proxyV2TCP4, tcp4), "", nil},
+		{"v2 LOCAL IPv6", proxyV2(proxyV2Local, proxyV2TCP6, tcp6), "", nil},
+		{"v2 LOCAL without addresses", proxyV2(proxyV2Local, 0, nil), "", nil},
+		{"v2 UNIX socket", proxyV2(proxyV2Proxy, 0x31, make([]byte, 216)), "", nil},
+
+		{"no header", "\x00\x0f356307042441013", "", errProxyHeader},
+		{"v1 signature", "PROXI TCP4 203.0.113.7 10.0.0.1 56324 1207\r\n", "", errProxyHeader},
+		{"v1 protocol", "PROXY UDP4 203.0.113.7 10.0.0.1 56324 1207\r\n", "", errProxyHeader},
+		{"v1 fields", "PROXY TCP4 203.0.113.7 10.0.0.1 56324\r\n", "", errProxyHeader},
+		{"v1 address", "PROXY TCP4 203.0.113 10.0.0.1 56324 1207\r\n", "", errProxyHeader},
+		{"v1 port", "PROXY TCP4 203.0.113.7 10.0.0.1 65536 1207\r\n", "", errProxyHeader},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", errProxyHeader},
+		{"v1 without CRLF", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 1207\n", "", io.EOF},
+		{"v2 signature", "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00", "", errProxyHeader},
+		{"v2 command", proxyV2(0x22, proxyV2TCP4, tcp4), "", errProxyHeader},
+		{"v2 truncated signature", string(proxyV2Signature[:8]), "", io.ErrUnexpectedEOF},
+		{"v2 truncated body", proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4)[:20], "", io.ErrUnexpectedEOF},
+		{"v2 truncated addresses", proxyV2(proxyV2Proxy, proxyV2TCP6, tcp4), "", errProxyHeader},
+	}
+	for _, tt := range tests {
+		// The data the device sent follows the header.
+		r := strings.NewReader(tt.header + "\x00\x0f")
+		addr, err := readProxyHeader(r)
+		if errors.Cause(err) != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := fmt.Sprint(addr); (addr == nil && tt.addr != "") || (addr != nil && got != tt.addr) {
+			t.Errorf("%s: address %v, want %q", tt.name, addr, tt.addr)
+		}
+		if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, []byte("\x00\x0f")) {
+			t.Errorf("%s: %q left after the header", tt.name, rest)
+		}
+	}
+}
+
+var errServed = goerr.New("served")
+
+// firstByteInteractor reports the first byte a connection is served
+// with and where it comes from, and ends the connection.
+type firstByteInteractor struct {
+	byteInteractor
+	served chan string
+}
+
+func (i firstByteInteractor) InitializeConnection(h *Handler) error {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(h.Conn, b)
+	if err != nil {
+		return err
+	}
+	i.served <- fmt.Sprintf("%q from %s", b, h.Conn.RemoteAddr().(*net.TCPAddr).IP)
+	return errServed
+}
+
+// TestProxyProtocolPeers checks that only connections from trusted
+// proxies are read a PROXY protocol header from.
+func TestProxyProtocolPeers(t *testing.T) {
+	logger := log.StandardLogger()
+	out := logger.Out
+	defer func() { logger.Out = out }()
+	logger.Out = ioutil.Discard
+
+	supervisor := suture.NewSimple("proxy")
+	supervisor.ServeBackground()
+	defer supervisor.Stop()
+	served := make(chan string, 1)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name    string
+		trusted *net.IPNet
+		want    string
+	}{
+		{"trusted", loopback, `"P" from 203.0.113.7`},
+		{"untrusted", private, `"P" from 127.0.0.1`},
+	}
+	for _, tt := range tests {
+		s := &Server{
+			Name:                 "proxy",
+			Timeout:              5 * time.Second,
+			ProxyProtocol:        true,
+			TrustedProxies:       []*net.IPNet{tt.trusted},
+			ConnectionSupervisor: supervisor,
+			InteractorGenerator: func(*Server) Interactor {
+				return firstByteInteractor{served: served}
+			},
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			peer, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer peer.Close()
+			// The device sends a packet starting with P too.
+			peer.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 1207\r\nP"))
+			peer.Read(make([]byte, 1))
+		}()
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.acquireConnection()
+		s.prepare(conn)
+		select {
+		case got := <-served:
+			if got != tt.want {
+				t.Errorf("%s: served %s, want %s", tt.name, got, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: connection not served", tt.name)
+		}
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&s.connections) > 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: connection still served", tt.name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/thejerf/suture"
+)
+
+// Protocol is what a device package registers to be served. Servers are
+// configured by the [devices.<name>] section of the config.
+type Protocol struct {
+	Name string
+	// Network is either "tcp" (the default) or "udp".
+	Network string
+	// NewInteractor creates the Interactor of a new connection.
+	NewInteractor func(s *Server) Interactor
+	// DatagramIMEI extracts the device IMEI from a datagram. It's
+	// required when Network is "udp".
+	DatagramIMEI func(datagram []byte) (imei string, err error)
+	// Detect tells whether a connection speaks the protocol from its
+	// first DetectLength bytes. Protocols without it can't share a port,
+	// and heads recognized by more than one protocol are refused.
+	Detect func(head []byte) bool
+}
+
+// DetectLength is the number of bytes protocols are detected from.
+const DetectLength = 6
+
+var (
+	protocolsMu sync.RWMutex
+	protocols   = make(map[string]Protocol)
+)
+
+// RegisterProtocol makes a protocol available to the config. It's meant to
+// be called from the init function of the device package and panics
+// when the name is taken.
+func RegisterProtocol(p Protocol) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+	if _, ok := protocols[p.Name]; ok {
+		panic("common: protocol " + p.Name + " registered twice")
+	}
+	protocols[p.Name] = p
+}
+
+// LookupProtocol returns the protocol registered under name.
+func LookupProtocol(name string) (p Protocol, ok bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+	p, ok = protocols[name]
+	return
+}
+
+// Protocols returns the names of the registered protocols.
+func Protocols() []string {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewServer creates a server for the protocol. The caller
+// sets Addr and the rest of the configuration.
+func NewServer(p Protocol, connSupervisor *suture.Supervisor) *Server {
+	return &Server{
+		Name:                 p.Name,
+		Network:              p.Network,
+		ConnectionSupervisor: connSupervisor,
+		InteractorGenerator:  p.NewInteractor,
+		DatagramIMEI:         p.DatagramIMEI,
+		Sessions:             NewSessions(),
+	}
+}
+
+// ConfiguredServers creates a server for every [devices.<name>] section of
+// the config, skipping those with enabled = false. A section sets
+//
+//	address         listen address, required
+//	protocols       protocols sharing the address, detected for every
+//	                connection, in which case name is free
+//	timeout         idle connection timeout, e.g. "30s"
+//	debug           log the traffic of every device
+//	max_connections limit on simultaneous connections, 0 for none
+//	ack_policy      "stored" or "received", see AckPolicy
+//	proxy_protocol  read PROXY protocol headers, see Server.ProxyProtocol
+//	trusted_proxies CIDRs of the load balancers, required with it
+//
+// and whatever settings the protocol itself reads. A [devices.<name>.tls]
+// section turns on TLS, with
+//
+//	cert, key       paths of the PEM certificate chain and key
+//	client_ca       path of the PEM CAs of client certificates, which
+//	                are required when it's set
+//	verify_imei     require client certificates issued to the IMEI
+func ConfiguredServers(connSupervisor *suture.Supervisor) (servers []*Server, err error) {
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("devices") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := "devices." + name + "."
+		if viper.IsSet(key+"enabled") && !viper.GetBool(key+"enabled") {
+			continue
+		}
+		var s *Server
+		if viper.IsSet(key + "protocols") {
+			s, err = newMultiplexServer(name, viper.GetStringSlice(key+"protocols"), connSupervisor)
+			if err != nil {
+				return nil, fmt.Errorf("%sprotocols: %v", key, err)
+			}
+		} else {
+			p, ok := LookupProtocol(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown protocol %q, registered protocols are %v", name, Protocols())
+			}
+			s = NewServer(p, connSupervisor)
+		}
+		s.Addr = viper.GetString(key + "address")
+		if s.Addr == "" {
+			return nil, fmt.Errorf("%saddress not set", key)
+		}
+		s.Timeout = durationSetting(key + "timeout")
+		s.Debug = viper.GetBool(key + "debug")
+		s.MaxConnections = viper.GetInt(key + "max_connections")
+		s.AckPolicy, err = ParseAckPolicy(viper.GetString(key + "ack_policy"))
+		if err != nil {
+			return nil, fmt.Errorf("%sack_policy: %v", key, err)
+		}
+		if viper.GetBool(key + "proxy_protocol") {
+			s.ProxyProtocol = true
+			s.TrustedProxies, err = cidrsSetting(key + "trusted_proxies")
+			if err != nil {
+				return nil, err
+			}
+			if s.Network == "udp" {
+				return nil, fmt.Errorf("%sproxy_protocol: not supported over UDP", key)
+			}
+		}
+		if viper.IsSet(key + "tls") {
+			s.TLS, err = tlsSetting(key + "tls.")
+			if err != nil {
+				return nil, err
+			}
+			if s.Network == "udp" {
+				return nil, fmt.Errorf("%stls: not supported over UDP", key)
+			}
+		}
+		servers = append(servers, s)
+	}
+	return
+}
+
+// newMultiplexServer creates a server named name for the given TCP protocols,
+// see Server.Protocols.
+func newMultiplexServer(name string, names []string, connSupervisor *suture.Supervisor) (*Server, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no protocol")
+	}
+	s := &Server{
+		Name:                 name,
+		ConnectionSupervisor: connSupervisor,
+		Sessions:             NewSessions(),
+	}
+	for _, n := range names {
+		p, ok := LookupProtocol(n)
+		if !ok {
+			return nil, fmt.Errorf("unknown protocol %q, registered protocols are %v", n, Protocols())
+		}
+		if p.Network == "udp" || p.Detect == nil {
+			return nil, fmt.Errorf("protocol %q can't be detected", n)
+		}
+		s.Protocols = append(s.Protocols, p)
+	}
+	return s, nil
+}
+
+// tlsSetting reads the TLS section starting with key and checks
+// that the files can be loaded.
+func tlsSetting(key string) (*TLS, error) {
+	t := &TLS{
+		CertFile:     viper.GetString(key + "cert"),
+		KeyFile:      viper.GetString(key + "key"),
+		ClientCAFile: viper.GetString(key + "client_ca"),
+		VerifyIMEI:   viper.GetBool(key + "verify_imei"),
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, fmt.Errorf("%scert and %skey are required", key, key)
+	}
+	if _, err := t.Config(); err != nil {
+		return nil, fmt.Errorf("%s: %v", strings.TrimSuffix(key, "."), err)
+	}
+	return t, nil
+}
+
+// cidrsSetting reads a non-empty list of CIDRs.
+func cidrsSetting(key string) (nets []*net.IPNet, err error) {
+	cidrs := viper.GetStringSlice(key)
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("%s not set", key)
+	}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// durationSetting reads a duration, taking plain numbers as seconds,
+// including the strings environment variables are read as.
+func durationSetting(key string) time.Duration {
+	switch v := viper.Get(key).(type) {
+	case int:
+		return time.Duration(v) * time.Second
+	case int64:
+		return time.Duration(v) * time.Second
+	case float64:
+		return time.Duration(v * float64(time.Second))
+	case string:
+		if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return time.Duration(n * float64(time.Second))
+		}
+	}
+	return viper.GetDuration(key)
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestDurationSetting(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  time.Duration
+	}{
+		{int64(30), 30 * time.Second},
+		{30, 30 * time.Second},
+		{1.5, 1500 * time.Millisecond},
+		// Environment variables are read as strings.
+		{"30", 30 * time.Second},
+		{" 45 ", 45 * time.Second},
+		{"2m", 2 * time.Minute},
+		{"500ms", 500 * time.Millisecond},
+		{nil, 0},
+	}
+	const key = "devices.test.timeout"
+	defer viper.Set(key, nil)
+	for _, tt := range tests {
+		viper.Set(key, tt.value)
+		if got := durationSetting(key); got != tt.want {
+			t.Errorf("%#v: %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -1,5 +1,5 @@
 // Package common provides a common infrastructure for devices communicating
-// using a TCP based protocol.
+// using a TCP or UDP based protocol.
 //
 // It is based on three primitives. Server and Handler are implemented by this
 // package while Interactor is an interface that implements the protocol-specific
@@ -8,12 +8,19 @@ package common
 
 import (
 	"bytes"
+	"crypto/tls"
 	"net"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/thejerf/suture"
 )
 
+// prepareTimeout bounds PROXY protocol headers, TLS handshakes and the wait
+// for the first bytes of a connection when the server has no Timeout.
+const prepareTimeout = 30 * time.Second
+
 // Server accepts connections on Addr and creates Handlers which
 // use Interactors returned by InteractorGenerator.
 type Server struct {
@@ -23,12 +30,71 @@ type Server struct {
 	stop                 chan struct{}
 	Handler              suture.Service
 	InteractorGenerator  func(*Server) Interactor
+	// Sessions, when set, tracks the authorized connections
+	// of this server by device IMEI.
+	Sessions *Sessions
+	// Network is either "tcp" (the default) or "udp".
+	Network string
+	// DatagramIMEI extracts the device IMEI from a datagram. It's
+	// required when Network is "udp".
+	DatagramIMEI func(datagram []byte) (imei string, err error)
+	// Protocols, when set, are accepted on Addr instead of the protocol
+	// of InteractorGenerator. The protocol of every connection is detected
+	// from its first bytes, which are left for the Interactor to read.
+	Protocols []Protocol
+	// Store persists the positions received by the handlers.
+	Store Store
+	// AckPolicy decides whether positions are acknowledged before
+	// or after they are stored. The zero value means AckStored.
+	AckPolicy AckPolicy
+	// Validator, when set, filters the positions before they are stored.
+	// Rejected positions are handed to Quarantine.
+	Validator  *Validator
+	Quarantine Quarantine
+	// Installations, when set, gives the installation date of every
+	// device for the before_install rule.
+	Installations Installations
+	// Archiver, when set, gets the raw frames exchanged with devices.
+	Archiver Archiver
+	// Timeout, when set, overrides the connection timeout
+	// of the interactors.
+	Timeout time.Duration
+	// Debug turns on the debug log of every connection.
+	Debug bool
+	// MaxConnections limits the simultaneous connections, or UDP
+	// sessions, when it's positive. New ones are closed at the limit.
+	MaxConnections int
+	// TLS, when set, makes the server accept TLS connections only.
+	TLS *TLS
+	// ProxyProtocol makes connections from TrustedProxies start with
+	// a PROXY protocol header, which gives the address of the client
+	// the connection is forwarded for. Other connections are served
+	// as they are.
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+	tlsConfig      *tls.Config
+	connections    int64
 }
 
 // Serve starts the server and makes it accept connections
 // on Addr.
 func (s *Server) Serve() {
 	s.stop = make(chan struct{})
+	if s.Network == "udp" {
+		s.serveDatagrams()
+		return
+	}
+	if s.TLS != nil {
+		var err error
+		s.tlsConfig, err = s.TLS.Config()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"src":   s.Name,
+			}).Error("Invalid TLS config")
+			return
+		}
+	}
 	listener, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -45,21 +111,27 @@ func (s *Server) Serve() {
 	for {
 		select {
 		case conn := <-connChan:
-			log.WithFields(log.Fields{
-				"addr": conn.RemoteAddr(),
-				"src":  s.Name,
-			}).Info("New connection")
-			msgBuf := new(bytes.Buffer)
-			handler := &Handler{
-				Name:           s.Name,
-				Conn:           TeeConn(conn, msgBuf),
-				Logger:         log.StandardLogger(),
-				Interactor:     s.InteractorGenerator(s),
-				lastRawMessage: msgBuf,
+			if !s.acquireConnection() {
+				log.WithFields(log.Fields{
+					"addr": conn.RemoteAddr(),
+					"src":  s.Name,
+				}).Warn("Too many connections, closing new one")
+				conn.Close()
+				continue
+			}
+			// Proxied connections are logged once the PROXY protocol
+			// header gave the address of the client.
+			if !s.ProxyProtocol || !s.trustedProxy(conn) {
+				log.WithFields(log.Fields{
+					"addr": conn.RemoteAddr(),
+					"src":  s.Name,
+				}).Info("New connection")
+			}
+			if s.ProxyProtocol || s.tlsConfig != nil || len(s.Protocols) > 0 {
+				go s.prepare(conn)
+				continue
 			}
-			token := s.ConnectionSupervisor.Add(handler)
-			unregister := func() { s.ConnectionSupervisor.Remove(token) }
-			handler.Unregister = unregister
+			s.supervise(s.newHandler(NewBufferedConn(conn), s.Name, s.InteractorGenerator))
 		case acceptErr := <-errChan:
 			log.WithFields(log.Fields{
 				"error": acceptErr,
@@ -78,6 +150,168 @@ func (s *Server) Serve() {
 	}
 }
 
+// supervise starts serving a connection. Unregister is set before the
+// handler is added, since a running supervisor serves it right away.
+func (s *Server) supervise(h *Handler) {
+	token := make(chan suture.ServiceToken, 1)
+	h.Unregister = func() {
+		s.ConnectionSupervisor.Remove(<-token)
+		s.releaseConnection()
+	}
+	token <- s.ConnectionSupervisor.Add(h)
+}
+
+// prepare reads the PROXY protocol header of a new connection, runs its
+// TLS handshake and detects its protocol when needed, before serving it.
+// Connections that fail any of them are closed.
+func (s *Server) prepare(conn net.Conn) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = prepareTimeout
+	}
+	if s.ProxyProtocol && s.trustedProxy(conn) {
+		conn.SetReadDeadline(makeTimeout(timeout))
+		addr, err := readProxyHeader(conn)
+		if err != nil {
+			count(s.metricName(), metricProtocolErrors)
+			log.WithFields(log.Fields{
+				"addr":  conn.RemoteAddr(),
+				"src":   s.Name,
+				"error": err,
+			}).Warn("Invalid PROXY protocol header, closing connection")
+			conn.Close()
+			s.releaseConnection()
+			return
+		}
+		// Headers without an address come from the balancer itself,
+		// e.g. for health checks.
+		entry := log.WithFields(log.Fields{
+			"addr": conn.RemoteAddr(),
+			"src":  s.Name,
+		})
+		if addr != nil {
+			entry = log.WithFields(log.Fields{
+				"addr":  addr,
+				"proxy": conn.RemoteAddr(),
+				"src":   s.Name,
+			})
+			conn = proxyConn{conn, addr}
+		}
+		entry.Info("New connection")
+	}
+	var state *tls.ConnectionState
+	if s.tlsConfig != nil {
+		tc := tls.Server(conn, s.tlsConfig)
+		tc.SetDeadline(makeTimeout(timeout))
+		err := tc.Handshake()
+		if err != nil {
+			n := count(s.metricName(), metricHandshakeFailures)
+			log.WithFields(log.Fields{
+				"addr":     conn.RemoteAddr(),
+				"src":      s.Name,
+				"error":    err,
+				"failures": n,
+			}).Warn("TLS handshake failed")
+			tc.Close()
+			s.releaseConnection()
+			return
+		}
+		cs := tc.ConnectionState()
+		state = &cs
+		conn = tc
+	}
+
+	bc := NewBufferedConn(conn)
+	name, newInteractor := s.Name, s.InteractorGenerator
+	if len(s.Protocols) > 0 {
+		bc.SetReadDeadline(makeTimeout(timeout))
+		p, ok := s.detect(bc)
+		if !ok {
+			count(s.metricName(), metricProtocolErrors)
+			bc.Close()
+			s.releaseConnection()
+			return
+		}
+		name, newInteractor = p.Name, p.NewInteractor
+	}
+	h := s.newHandler(bc, name, newInteractor)
+	h.tlsState = state
+	h.verifyIMEI = s.TLS != nil && s.TLS.VerifyIMEI
+	s.supervise(h)
+}
+
+// detect peeks at the first bytes of conn and returns the one of Protocols
+// that recognizes them. Heads recognized by several protocols are refused
+// rather than handed to the wrong one.
+func (s *Server) detect(conn *BufferedConn) (p Protocol, ok bool) {
+	entry := log.WithFields(log.Fields{
+		"addr": conn.RemoteAddr(),
+		"src":  s.Name,
+	})
+	head, err := conn.Peek(DetectLength)
+	if err != nil {
+		entry.WithError(err).Warnf("Unknown protocol, closing connection: %x", head)
+		return Protocol{}, false
+	}
+	var matches []string
+	for _, candidate := range s.Protocols {
+		if candidate.Detect(head) {
+			p = candidate
+			matches = append(matches, candidate.Name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		entry.Warnf("Unknown protocol, closing connection: %x", head)
+		return Protocol{}, false
+	case 1:
+		entry.WithField("protocol", p.Name).Debug("Protocol detected")
+		return p, true
+	}
+	entry.WithField("protocols", matches).Warnf("Ambiguous protocol, closing connection: %x", head)
+	return Protocol{}, false
+}
+
+func (s *Server) newHandler(conn net.Conn, name string, newInteractor func(*Server) Interactor) *Handler {
+	msgBuf := new(bytes.Buffer)
+	h := &Handler{
+		Name:           name,
+		Conn:           TeeConn(conn, msgBuf),
+		Logger:         log.StandardLogger(),
+		Interactor:     newInteractor(s),
+		lastRawMessage: msgBuf,
+		sessions:       s.Sessions,
+		Store:          s.Store,
+		AckPolicy:      s.AckPolicy,
+		Validator:      s.Validator,
+		Quarantine:     s.Quarantine,
+		Installations:  s.Installations,
+		Archiver:       s.Archiver,
+		Debug:          s.Debug,
+		Timeout:        s.Timeout,
+		remoteAddr:     conn.RemoteAddr(),
+	}
+	if s.Archiver != nil {
+		h.Conn = archivingConn{h.Conn, h}
+	}
+	return h
+}
+
+// acquireConnection counts a new connection, unless
+// MaxConnections has been reached.
+func (s *Server) acquireConnection() bool {
+	n := atomic.AddInt64(&s.connections, 1)
+	if s.MaxConnections > 0 && n > int64(s.MaxConnections) {
+		atomic.AddInt64(&s.connections, -1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) releaseConnection() {
+	atomic.AddInt64(&s.connections, -1)
+}
+
 // Stop gracefully terminates all the connections to the Server
 // and all the goroutines it spun up.
 func (s *Server) Stop() {
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thejerf/suture"
+)
+
+func TestDetect(t *testing.T) {
+	protocols := []Protocol{
+		{Name: "zero", Detect: func(head []byte) bool { return head[0] == 0 }},
+		{Name: "ascii", Detect: func(head []byte) bool { return head[0] == '+' }},
+		{Name: "zero too", Detect: func(head []byte) bool { return head[0] == 0 && head[5] == 0 }},
+	}
+	tests := []struct {
+		name string
+		head []byte
+		ok   bool
+		want string
+	}{
+		{"single match", []byte("+RESP:"), true, "ascii"},
+		{"ambiguous", []byte{0, 1, 2, 3, 4, 0}, false, ""},
+		{"one of two", []byte{0, 1, 2, 3, 4, 5}, true, "zero"},
+		{"unknown", []byte{1, 2, 3, 4, 5, 6}, false, ""},
+	}
+	for _, tt := range tests {
+		s := &Server{Name: "multiplex", Protocols: protocols}
+		device, conn := net.Pipe()
+		bc := NewBufferedConn(conn)
+		bc.SetDeadline(time.Now().Add(5 * time.Second))
+		go device.Write(tt.head)
+		p, ok := s.detect(bc)
+		if ok != tt.ok || p.Name != tt.want {
+			t.Errorf("%s: detected %q, %t", tt.name, p.Name, ok)
+		}
+		device.Close()
+		conn.Close()
+	}
+}
+
+// entries collects the entries logged at every level.
+type entries []*log.Entry
+
+func (e *entries) Levels() []log.Level { return log.AllLevels }
+
+func (e *entries) Fire(entry *log.Entry) error {
+	*e = append(*e, entry)
+	return nil
+}
+
+func TestProxiedConnectionLog(t *testing.T) {
+	logger := log.StandardLogger()
+	hooks, out := logger.Hooks, logger.Out
+	defer func() {
+		logger.Hooks, logger.Out = hooks, out
+	}()
+	logged := new(entries)
+	logger.Hooks = make(log.LevelHooks)
+	logger.AddHook(logged)
+	logger.Out = ioutil.Discard
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		balancer, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer balancer.Close()
+		balancer.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 1207\r\n"))
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s := &Server{
+		Name:                 "proxied",
+		ProxyProtocol:        true,
+		TrustedProxies:       []*net.IPNet{loopback},
+		ConnectionSupervisor: suture.NewSimple("test"),
+		InteractorGenerator:  func(*Server) Interactor { return byteInteractor{} },
+	}
+	s.prepare(conn)
+
+	var connections []*log.Entry
+	for _, e := range *logged {
+		if e.Message == "New connection" {
+			connections = append(connections, e)
+		}
+	}
+	if len(connections) != 1 {
+		t.Fatalf("%d connections logged", len(connections))
+	}
+	if addr := fmt.Sprint(connections[0].Data["addr"]); addr != "203.0.113.7:56324" {
+		t.Errorf("connection logged from %s", addr)
+	}
+	if proxy := fmt.Sprint(connections[0].Data["proxy"]); proxy != conn.RemoteAddr().String() {
+		t.Errorf("connection logged through %s", proxy)
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Sessions keeps track of authorized connections by device IMEI, so that
+// other parts of the listener can reach a connected device.
+type Sessions struct {
+	mu       sync.RWMutex
+	handlers map[string]*Handler
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{handlers: make(map[string]*Handler)}
+}
+
+// Add registers h under its IMEI, replacing any older connection
+// of the same device.
+func (s *Sessions) Add(h *Handler) {
+	s.mu.Lock()
+	s.handlers[h.IMEI] = h
+	s.mu.Unlock()
+}
+
+// Remove unregisters h unless the device has reconnected in the meantime.
+func (s *Sessions) Remove(h *Handler) {
+	s.mu.Lock()
+	if s.handlers[h.IMEI] == h {
+		delete(s.handlers, h.IMEI)
+	}
+	s.mu.Unlock()
+}
+
+// Get returns the connection of the device with the given IMEI or nil.
+func (s *Sessions) Get(imei string) *Handler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.handlers[imei]
+}
+
+// SendCommand sends payload to the connected device with the given IMEI
+// and returns its reply.
+func (s *Sessions) SendCommand(imei string, payload []byte, timeout time.Duration) (reply []byte, err error) {
+	h := s.Get(imei)
+	if h == nil {
+		return nil, ErrNotConnected
+	}
+	return h.SendCommand(payload, timeout)
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	goerr "errors"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrNoStore = goerr.New("no store configured")
+
+// Store persists the positions sent by devices. SavePositions must only
+// return nil once every position has been durably written, because
+// devices delete whatever gets acknowledged.
+type Store interface {
+	SavePositions(h *Handler, positions []*Position) (err error)
+}
+
+// AckPolicy decides when devices get acknowledgements.
+type AckPolicy string
+
+const (
+	// AckStored acknowledges positions once they have been stored and
+	// sends a failure response when storing them fails.
+	AckStored AckPolicy = "stored"
+	// AckReceived acknowledges positions as soon as they have been
+	// parsed, storing failures are only logged.
+	AckReceived AckPolicy = "received"
+)
+
+// ParseAckPolicy parses an ack policy from config. An empty value
+// means AckStored.
+func ParseAckPolicy(s string) (AckPolicy, error) {
+	switch p := AckPolicy(s); p {
+	case "":
+		return AckStored, nil
+	case AckStored, AckReceived:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown ack policy %q", s)
+}
+
+// SavePositions runs positions through the validator of the handler,
+// hands the accepted ones to its store and the rejected ones to its
+// quarantine.
+func (h *Handler) SavePositions(positions []*Position) (err error) {
+	if len(positions) == 0 {
+		return nil
+	}
+	accepted, rejected := positions, []*Rejection(nil)
+	if h.Validator != nil {
+		accepted, rejected = h.Validator.Validate(h, positions)
+	}
+
+	if len(rejected) > 0 {
+		err = h.quarantine(rejected)
+		if err != nil {
+			return
+		}
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	if h.Store == nil {
+		return ErrNoStore
+	}
+	err = h.Store.SavePositions(h, accepted)
+	if err != nil {
+		return errors.Wrap(err, "saving positions failed")
+	}
+	if h.Validator != nil {
+		h.Validator.Accept(h, accepted)
+	}
+	return nil
+}
+
+func (h *Handler) quarantine(rejected []*Rejection) (err error) {
+	for _, r := range rejected {
+		h.DebugLog().WithField("rule", r.Rule).Debugf("Position at %s rejected: %s",
+			r.Position.Timestamp.Format(time.RFC3339), r.Reason)
+	}
+	if h.Quarantine == nil {
+		h.Log().Warnf("Dropped %d rejected positions, no quarantine configured", len(rejected))
+		return nil
+	}
+	err = h.Quarantine.QuarantinePositions(h, rejected)
+	if err != nil {
+		return errors.Wrap(err, "quarantining positions failed")
+	}
+	return nil
+}
+
+// SaveAndAcknowledge stores positions and calls ack in the order required
+// by the ack policy of the handler. Under AckStored, ack isn't called when
+// storing fails and the storing error is returned, so that the Interactor
+// can send a failure response instead.
+func (h *Handler) SaveAndAcknowledge(positions []*Position, ack func() error) (err error) {
+	if h.AckPolicy == AckReceived {
+		err = ack()
+		if err != nil {
+			return errors.Wrap(err, "couldn't confirm receipt")
+		}
+		err = h.SavePositions(positions)
+		if err != nil {
+			h.Log().WithError(err).Errorf("Lost %d acknowledged positions", len(positions))
+		}
+		return nil
+	}
+
+	err = h.SavePositions(positions)
+	if err != nil {
+		return
+	}
+	err = ack()
+	if err != nil {
+		return errors.Wrap(err, "couldn't confirm receipt")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package common
+
+import (
+	goerr "errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var errStore = goerr.New("database down")
+
+// testStore records the calls made by the handler. Positions and
+// rejections fail to be written when err and quarantineErr are set.
+type testStore struct {
+	err           error
+	quarantineErr error
+	calls         []string
+	positions     []*Position
+	rejections    []*Rejection
+}
+
+func (s *testStore) SavePositions(h *Handler, positions []*Position) error {
+	s.calls = append(s.calls, "store")
+	if s.err != nil {
+		return s.err
+	}
+	s.positions = append(s.positions, positions...)
+	return nil
+}
+
+func (s *testStore) QuarantinePositions(h *Handler, rejections []*Rejection) error {
+	s.calls = append(s.calls, "quarantine")
+	if s.quarantineErr != nil {
+		return s.quarantineErr
+	}
+	s.rejections = append(s.rejections, rejections...)
+	return nil
+}
+
+func testHandler(t *testing.T, policy AckPolicy, store *testStore) *Handler {
+	conn, _ := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	h := &Handler{Name: "test", Conn: conn, IMEI: "356307042441013", Logger: logger, AckPolicy: policy}
+	if store != nil {
+		h.Store = store
+		h.Quarantine = store
+	}
+	return h
+}
+
+func testPositions() []*Position {
+	return []*Position{
+		{Timestamp: time.Now().Add(-time.Minute), Latitude: 54.68, Longitude: 25.27, Satellites: 9},
+		{Timestamp: time.Now(), Latitude: 54.69, Longitude: 25.28, Satellites: 9},
+	}
+}
+
+func TestSaveAndAcknowledge(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy AckPolicy
+		store  *testStore
+		ackErr error
+		// calls are made to the store and to ack, in this order.
+		calls  []string
+		err    error
+		stored int
+	}{
+		{"stored", AckStored, &testStore{}, nil, []string{"store", "ack"}, nil, 2},
+		{"store failure", AckStored, &testStore{err: errStore}, nil, []string{"store"}, errStore, 0},
+		{"ack failure", AckStored, &testStore{}, goerr.New("broken pipe"), []string{"store", "ack"}, nil, 2},
+		{"no store", AckStored, nil, nil, nil, ErrNoStore, 0},
+		{"received", AckReceived, &testStore{}, nil, []string{"ack", "store"}, nil, 2},
+		// Storing failures are only logged once the device got its ack.
+		{"received, store failure", AckReceived, &testStore{err: errStore}, nil, []string{"ack", "store"}, nil, 0},
+		{"received, ack failure", AckReceived, &testStore{}, goerr.New("broken pipe"), []string{"ack"}, nil, 0},
+	}
+	for _, tt := range tests {
+		h := testHandler(t, tt.policy, tt.store)
+		store := tt.store
+		if store == nil {
+			store = &testStore{}
+		}
+		err := h.SaveAndAcknowledge(testPositions(), func() error {
+			store.calls = append(store.calls, "ack")
+			return tt.ackErr
+		})
+
+		switch {
+		case tt.ackErr != nil:
+			if errors.Cause(err) != tt.ackErr {
+				t.Errorf("%s: error %v, want %v", tt.name, err, tt.ackErr)
+			}
+		case errors.Cause(err) != tt.err:
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+		if len(store.calls) != len(tt.calls) {
+			t.Errorf("%s: calls %v, want %v", tt.name, store.calls, tt.calls)
+		} else {
+			for i := range tt.calls {
+				if store.calls[i] != tt.calls[i] {
+					t.Errorf("%s: calls %v, want %v", tt.name, store.calls, tt.calls)
+					break
+				}
+			}
+		}
+		if len(store.positions) != tt.stored {
+			t.Errorf("%s: stored %d positions, want %d", tt.name, len(store.positions), tt.stored)
+		}
+	}
+}
+
+func TestSaveAndAcknowledgeQuarantine(t *testing.T) {
+	v := NewValidator()
+	v.AddRule("null_island", NullIsland())
+	positions := append(testPositions(), &Position{Timestamp: time.Now()})
+
+	store := &testStore{quarantineErr: errStore}
+	h := testHandler(t, AckStored, store)
+	h.Validator = v
+	acked := false
+	err := h.SaveAndAcknowledge(positions, func() error {
+		acked = true
+		return nil
+	})
+	if errors.Cause(err) != errStore || acked || len(store.positions) != 0 {
+		t.Errorf("quarantine failure: error %v, acked %t, stored %d", err, acked, len(store.positions))
+	}
+
+	store.quarantineErr = nil
+	err = h.SaveAndAcknowledge(positions, func() error {
+		acked = true
+		return nil
+	})
+	if err != nil || !acked || len(store.positions) != 2 || len(store.rejections) != 1 {
+		t.Errorf("error %v, acked %t, stored %d, quarantined %d", err, acked, len(store.positions), len(store.rejections))
+	}
+	if len(store.rejections) == 1 && store.rejections[0].Rule != "null_island" {
+		t.Errorf("rejected by %s", store.rejections[0].Rule)
+	}
+}
+
+// installations maps IMEIs to installation dates, or fails with err.
+type installations struct {
+	dates map[string]time.Time
+	err   error
+}
+
+func (i installations) InstalledAt(imei string) (time.Time, error) {
+	return i.dates[imei], i.err
+}
+
+func TestSaveAndAcknowledgeBeforeInstall(t *testing.T) {
+	v := NewValidator()
+	v.AddRule("before_install", BeforeInstall())
+	installed := time.Now().Add(-30 * time.Second)
+
+	tests := []struct {
+		name          string
+		installations Installations
+		stored        int
+	}{
+		{"installed", installations{dates: map[string]time.Time{"356307042441013": installed}}, 1},
+		{"unknown device", installations{}, 2},
+		{"lookup failure", installations{err: errStore}, 2},
+		{"no installations", nil, 2},
+	}
+	for _, tt := range tests {
+		store := &testStore{}
+		h := testHandler(t, AckStored, store)
+		h.Validator = v
+		h.Installations = tt.installations
+		h.LoadInstallation()
+		err := h.SaveAndAcknowledge(testPositions(), func() error { return nil })
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if len(store.positions) != tt.stored || len(store.rejections) != 2-tt.stored {
+			t.Errorf("%s: stored %d, quarantined %d", tt.name, len(store.positions), len(store.rejections))
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	goerr "errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var errNoClientCAs = goerr.New("no certificate found in client CA file")
+
+// TLS configures the TLS listener of a server. The files are read again
+// when they change, so that certificates can be renewed without a restart.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, when set, makes devices present a certificate
+	// signed by one of the CAs it holds.
+	ClientCAFile string
+	// VerifyIMEI requires the CN or a DNS SAN of the client certificate
+	// to be the IMEI the device identifies with.
+	VerifyIMEI bool
+
+	mu        sync.Mutex
+	modTimes  [3]time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// Config loads the files and returns the config of the listener.
+func (t *TLS) Config() (*tls.Config, error) {
+	if t.VerifyIMEI && t.ClientCAFile == "" {
+		return nil, goerr.New("verifying IMEIs requires a client CA file")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.reload()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current(), nil
+		},
+	}, nil
+}
+
+// current returns the config of a new connection, reloading changed files.
+// Files that fail to load are logged and the previous ones kept.
+func (t *TLS) current() *tls.Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.reload()
+	if err != nil {
+		log.WithError(err).WithField("cert", t.CertFile).Error("Couldn't reload TLS files")
+	}
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*t.cert},
+	}
+	if t.clientCAs != nil {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = t.clientCAs
+	}
+	return c
+}
+
+// reload reads the files again when one of them has been modified.
+func (t *TLS) reload() error {
+	var modTimes [3]time.Time
+	for i, name := range []string{t.CertFile, t.KeyFile, t.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return errors.Wrap(err, "TLS file unavailable")
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if t.cert != nil && modTimes == t.modTimes {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "couldn't load certificate")
+	}
+	var clientCAs *x509.CertPool
+	if t.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "couldn't read client CA file")
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errNoClientCAs
+		}
+	}
+	if t.cert != nil {
+		log.WithField("cert", t.CertFile).Info("TLS files reloaded")
+	}
+	t.cert, t.clientCAs, t.modTimes = &cert, clientCAs, modTimes
+	return nil
+}
+
+// VerifyIMEI checks that the client certificate was issued to the device
+// with imei, when the server requires it. Interactors call it before they
+// accept a device, it's checked once the connection is initialized anyway.
+// Refusals are counted as handshake failures.
+func (h *Handler) VerifyIMEI(imei string) error {
+	err := h.verifyCertificate(imei)
+	if err != nil {
+		h.countHandshakeFailure()
+	}
+	return err
+}
+
+// verifyCertificate is VerifyIMEI without the count.
+func (h *Handler) verifyCertificate(imei string) error {
+	if !h.verifyIMEI {
+		return nil
+	}
+	if h.tlsState == nil || len(h.tlsState.PeerCertificates) == 0 {
+		return errors.Wrap(ErrUnauthorizedDevice, "no client certificate")
+	}
+	cert := h.tlsState.PeerCertificates[0]
+	if cert.Subject.CommonName == imei {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == imei {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrUnauthorizedDevice, "client certificate of %q", cert.Subject.CommonName)
+}
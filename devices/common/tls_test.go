@@ -0,0 +1,370 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/thejerf/suture"
+)
+
+// testCA issues the certificates of the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate with the common name and DNS names,
+// PEM encoded with its key.
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, dnsNames ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// keyPair is issue for the client side of a handshake.
+func (ca *testCA) keyPair(t *testing.T, serial int64, commonName string, dnsNames ...string) tls.Certificate {
+	cert, err := tls.X509KeyPair(ca.issue(t, serial, commonName, dnsNames...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, name string, b []byte) {
+	err := ioutil.WriteFile(name, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serverTLS writes the files of a server certificate of ca, devices
+// presenting certificates of ca too, and returns the config of them.
+func serverTLS(t *testing.T, ca *testCA) *TLS {
+	dir := t.TempDir()
+	c := &TLS{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		VerifyIMEI:   true,
+	}
+	certPEM, keyPEM := ca.issue(t, 2, "listener.test", "listener.test")
+	writeFile(t, c.CertFile, certPEM)
+	writeFile(t, c.KeyFile, keyPEM)
+	writeFile(t, c.ClientCAFile, ca.pem)
+	return c
+}
+
+// servedCommonName returns the common name of the certificate
+// a new connection of config is served with.
+func servedCommonName(t *testing.T, config *tls.Config) string {
+	c, err := config.GetConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(c.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	c := serverTLS(t, ca)
+	_, err := (&TLS{CertFile: c.CertFile, KeyFile: c.KeyFile, VerifyIMEI: true}).Config()
+	if err == nil {
+		t.Error("IMEIs verified without a client CA file")
+	}
+	_, err = (&TLS{CertFile: c.CertFile, KeyFile: c.KeyFile, ClientCAFile: c.CertFile + ".missing"}).Config()
+	if err == nil {
+		t.Error("missing client CA file accepted")
+	}
+	writeFile(t, c.ClientCAFile+".empty", nil)
+	_, err = (&TLS{CertFile: c.CertFile, KeyFile: c.KeyFile, ClientCAFile: c.ClientCAFile + ".empty"}).Config()
+	if err != errNoClientCAs {
+		t.Errorf("empty client CA file: %v, want %v", err, errNoClientCAs)
+	}
+
+	config, err := c.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := config.GetConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ClientAuth != tls.RequireAndVerifyClientCert || client.ClientCAs == nil {
+		t.Errorf("client certificates not required: %v", client.ClientAuth)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	logger := log.StandardLogger()
+	out := logger.Out
+	defer func() { logger.Out = out }()
+	logger.Out = ioutil.Discard
+
+	ca := newTestCA(t)
+	c := serverTLS(t, ca)
+	config, err := c.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedCommonName(t, config); name != "listener.test" {
+		t.Fatalf("served %q", name)
+	}
+
+	// A renewed certificate is served to the next connections.
+	certPEM, keyPEM := ca.issue(t, 3, "renewed.test")
+	writeFile(t, c.CertFile, certPEM)
+	writeFile(t, c.KeyFile, keyPEM)
+	renewed := time.Now().Add(time.Minute)
+	for _, name := range []string{c.CertFile, c.KeyFile} {
+		err = os.Chtimes(name, renewed, renewed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name := servedCommonName(t, config); name != "renewed.test" {
+		t.Errorf("served %q after renewal", name)
+	}
+
+	// A broken certificate is logged and the previous one kept.
+	writeFile(t, c.CertFile, []byte("not a certificate"))
+	broken := renewed.Add(time.Minute)
+	err = os.Chtimes(c.CertFile, broken, broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedCommonName(t, config); name != "renewed.test" {
+		t.Errorf("served %q after a broken renewal", name)
+	}
+}
+
+func TestVerifyIMEI(t *testing.T) {
+	const imei = "356307042441013"
+	ca := newTestCA(t)
+	tests := []struct {
+		name       string
+		commonName string
+		dnsNames   []string
+		verify     bool
+		ok         bool
+	}{
+		{"common name", imei, nil, true, true},
+		{"DNS name", "Tracker", []string{"device.test", imei}, true, true},
+		{"other device", "356307042441014", []string{"356307042441014"}, true, false},
+		{"not verified", "356307042441014", nil, false, true},
+	}
+	for i, tt := range tests {
+		certPEM, _ := ca.issue(t, int64(10+i), tt.commonName, tt.dnsNames...)
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &Handler{
+			Name:       "verify",
+			tlsState:   &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			verifyIMEI: tt.verify,
+		}
+		if err := h.VerifyIMEI(imei); (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+
+	h := &Handler{Name: "verify", verifyIMEI: true}
+	if err := h.VerifyIMEI(imei); err == nil {
+		t.Error("accepted without a client certificate")
+	}
+}
+
+// imeiInteractor verifies imei when the connection is initialized.
+type imeiInteractor struct {
+	byteInteractor
+	imei     string
+	verified chan error
+}
+
+func (i imeiInteractor) InitializeConnection(h *Handler) error {
+	err := h.VerifyIMEI(i.imei)
+	if err == nil {
+		h.IMEI = i.imei
+	}
+	i.verified <- err
+	return err
+}
+
+// handshake connects a device with certs to a TLS server of s and
+// waits until the connection has been served.
+func handshake(t *testing.T, s *Server, ca *testCA, certs ...tls.Certificate) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		device := tls.Client(conn, &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "listener.test",
+			Certificates: certs,
+		})
+		device.SetDeadline(time.Now().Add(5 * time.Second))
+		// The certificate is sent whether the server accepts it or not.
+		device.Handshake()
+		device.Close()
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.acquireConnection()
+	s.prepare(conn)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&s.connections) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	logger := log.StandardLogger()
+	out := logger.Out
+	defer func() { logger.Out = out }()
+	logger.Out = ioutil.Discard
+
+	const imei = "356307042441013"
+	ca := newTestCA(t)
+	config, err := serverTLS(t, ca).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := make(chan error, 1)
+	supervisor := suture.NewSimple("tls")
+	supervisor.ServeBackground()
+	defer supervisor.Stop()
+	s := &Server{
+		Name:                 "tls",
+		TLS:                  &TLS{VerifyIMEI: true},
+		Timeout:              5 * time.Second,
+		ConnectionSupervisor: supervisor,
+		InteractorGenerator: func(*Server) Interactor {
+			return imeiInteractor{imei: imei, verified: verified}
+		},
+		tlsConfig: config,
+	}
+	failures := s.metricName() + metricHandshakeFailures
+
+	// The certificate of the device is checked once it identifies.
+	tests := []struct {
+		name       string
+		commonName string
+		ok         bool
+	}{
+		{"own certificate", imei, true},
+		{"certificate of another device", "356307042441014", false},
+	}
+	for i, tt := range tests {
+		want := counted(failures)
+		if !tt.ok {
+			want++
+		}
+		handshake(t, s, ca, ca.keyPair(t, int64(20+i), tt.commonName))
+		select {
+		case err := <-verified:
+			if (err == nil) != tt.ok {
+				t.Errorf("%s: verified with error %v", tt.name, err)
+			}
+		default:
+			t.Fatalf("%s: connection not served", tt.name)
+		}
+		if got := counted(failures); got != want {
+			t.Errorf("%s: %s %d, want %d", tt.name, failures, got, want)
+		}
+	}
+
+	// Devices without a certificate of the CA fail the handshake.
+	other := newTestCA(t)
+	for name, certs := range map[string][]tls.Certificate{
+		"no certificate":    nil,
+		"unknown authority": {other.keyPair(t, 30, imei)},
+	} {
+		want := counted(failures) + 1
+		handshake(t, s, ca, certs...)
+		if got := counted(failures); got != want {
+			t.Errorf("%s: %s %d, want %d", name, failures, got, want)
+		}
+		select {
+		case err := <-verified:
+			t.Errorf("%s: connection served, verified with error %v", name, err)
+		default:
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Rule rejects a position by returning the reason. prev is the last
+// accepted position of the device, or nil when there's none.
+type Rule func(h *Handler, prev, p *Position) (reason string)
+
+// Rejection is a position rejected by a validation rule.
+type Rejection struct {
+	Position *Position
+	Rule     string
+	Reason   string
+}
+
+// Quarantine keeps rejected positions for auditing. Like Store, it must
+// only return nil once the rejections have been durably written.
+type Quarantine interface {
+	QuarantinePositions(h *Handler, rejections []*Rejection) (err error)
+}
+
+// Installations looks up when devices were installed, for BeforeInstall.
+// InstalledAt returns the zero time when the date isn't known.
+type Installations interface {
+	InstalledAt(imei string) (t time.Time, err error)
+}
+
+// LoadInstallation sets InstalledAt from Installations once the IMEI of
+// the device is known. A failed lookup leaves it unset.
+func (h *Handler) LoadInstallation() {
+	if h.Installations == nil || h.IMEI == "" {
+		return
+	}
+	t, err := h.Installations.InstalledAt(h.IMEI)
+	if err != nil {
+		h.Log().WithError(err).Warn("Couldn't load installation date")
+		return
+	}
+	h.InstalledAt = t
+}
+
+type namedRule struct {
+	name  string
+	check Rule
+}
+
+// Validator runs positions through a pipeline of rules. A position
+// is rejected by the first rule it fails. It remembers the last accepted
+// position of every device, so that rules can compare against it.
+type Validator struct {
+	// MaxRejections, when positive, is the number of positions of a device
+	// rejected in a row after which its last accepted position is
+	// forgotten. A device that was moved while it was off, or whose last
+	// accepted position was wrong, isn't locked out of its new location.
+	MaxRejections int
+
+	rules []namedRule
+	mu    sync.Mutex
+	last  map[string]*Position
+	runs  map[string]*rejectionRun
+}
+
+// rejectionRun counts the positions of a device rejected in a row.
+// Only positions newer than the ones counted are, so that batches
+// sent again after a failure aren't counted twice.
+type rejectionRun struct {
+	count  int
+	newest time.Time
+}
+
+// NewValidator returns a Validator without any rules.
+func NewValidator() *Validator {
+	return &Validator{last: make(map[string]*Position), runs: make(map[string]*rejectionRun)}
+}
+
+// AddRule appends a rule to the pipeline.
+func (v *Validator) AddRule(name string, rule Rule) {
+	v.rules = append(v.rules, namedRule{name, rule})
+}
+
+// Validate splits positions into accepted and rejected ones. Positions
+// are checked in chronological order, each against the last one accepted
+// before it. Accepted positions aren't remembered until Accept is called,
+// rejected ones are counted right away for MaxRejections.
+func (v *Validator) Validate(h *Handler, positions []*Position) (accepted []*Position, rejected []*Rejection) {
+	sorted := make([]*Position, len(positions))
+	copy(sorted, positions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	prev := v.lastPosition(h.IMEI)
+	for _, p := range sorted {
+		rejection := v.check(h, prev, p)
+		if rejection != nil && prev != nil && v.rejectedInRow(h.IMEI, p) {
+			h.Log().WithField("rule", rejection.Rule).Warnf("%d positions rejected in a row, forgetting the last accepted one", v.MaxRejections)
+			prev = nil
+			rejection = v.check(h, prev, p)
+		}
+		if rejection != nil {
+			rejected = append(rejected, rejection)
+			continue
+		}
+		v.endRun(h.IMEI)
+		accepted = append(accepted, p)
+		prev = p
+	}
+	return
+}
+
+// rejectedInRow counts the rejection of p and tells whether MaxRejections
+// positions of the device have been rejected in a row. The last accepted
+// position is forgotten then.
+func (v *Validator) rejectedInRow(imei string, p *Position) bool {
+	if imei == "" || v.MaxRejections <= 0 {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	run := v.runs[imei]
+	if run == nil {
+		run = &rejectionRun{}
+		v.runs[imei] = run
+	}
+	if !p.Timestamp.After(run.newest) {
+		return false
+	}
+	run.count++
+	run.newest = p.Timestamp
+	if run.count < v.MaxRejections {
+		return false
+	}
+	delete(v.runs, imei)
+	delete(v.last, imei)
+	return true
+}
+
+// endRun forgets the rejections in a row of a device.
+func (v *Validator) endRun(imei string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.runs, imei)
+}
+
+func (v *Validator) check(h *Handler, prev, p *Position) *Rejection {
+	for _, r := range v.rules {
+		reason := r.check(h, prev, p)
+		if reason != "" {
+			return &Rejection{Position: p, Rule: r.name, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// Accept remembers the newest of the positions as the last accepted
+// position of the device. It's called once they have been stored.
+func (v *Validator) Accept(h *Handler, accepted []*Position) {
+	if h.IMEI == "" || len(accepted) == 0 {
+		return
+	}
+	newest := accepted[len(accepted)-1]
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if last := v.last[h.IMEI]; last == nil || newest.Timestamp.After(last.Timestamp) {
+		v.last[h.IMEI] = newest
+	}
+}
+
+func (v *Validator) lastPosition(imei string) *Position {
+	if imei == "" {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.last[imei]
+}
+
+// LoadValidator builds a Validator from the [validation] section
+// of the config. The rules run in the order they are listed in.
+func LoadValidator() (v *Validator, err error) {
+	v = NewValidator()
+	v.MaxRejections = viper.GetInt("validation.max_rejections")
+	for _, name := range viper.GetStringSlice("validation.rules") {
+		var rule Rule
+		switch name {
+		case "null_island":
+			rule = NullIsland()
+		case "future_timestamp":
+			rule = FutureTimestamp(viper.GetDuration("validation.max_future"))
+		case "before_install":
+			rule = BeforeInstall()
+		case "min_satellites":
+			rule = MinSatellites(viper.GetInt("validation.min_satellites"))
+		case "max_speed":
+			rule = MaxSpeed(viper.GetFloat64("validation.max_speed"))
+		case "altitude":
+			rule = AltitudeBounds(viper.GetFloat64("validation.min_altitude"), viper.GetFloat64("validation.max_altitude"))
+		case "jump":
+			rule = Jump(viper.GetFloat64("validation.max_jump_speed"))
+		default:
+			return nil, fmt.Errorf("unknown validation rule %q", name)
+		}
+		v.AddRule(name, rule)
+	}
+	return
+}
+
+// NullIsland rejects positions at 0,0, which devices report without a fix.
+func NullIsland() Rule {
+	return func(_ *Handler, _, p *Position) string {
+		if p.Latitude == 0 && p.Longitude == 0 {
+			return "no fix"
+		}
+		return ""
+	}
+}
+
+// FutureTimestamp rejects positions more than max ahead of our clock.
+func FutureTimestamp(max time.Duration) Rule {
+	return func(_ *Handler, _, p *Position) string {
+		if ahead := time.Until(p.Timestamp); ahead > max {
+			return fmt.Sprintf("%s in the future", ahead.Round(time.Second))
+		}
+		return ""
+	}
+}
+
+// BeforeInstall rejects positions older than the installation of the
+// device, when it's known.
+func BeforeInstall() Rule {
+	return func(h *Handler, _, p *Position) string {
+		if !h.InstalledAt.IsZero() && p.Timestamp.Before(h.InstalledAt) {
+			return fmt.Sprintf("before installation at %s", h.InstalledAt.Format(time.RFC3339))
+		}
+		return ""
+	}
+}
+
+// MinSatellites rejects positions fixed with less than min satellites.
+// Positions with an unknown satellite count pass.
+func MinSatellites(min int) Rule {
+	return func(_ *Handler, _, p *Position) string {
+		if p.Satellites != UnknownSatellites && p.Satellites < min {
+			return fmt.Sprintf("%d satellites", p.Satellites)
+		}
+		return ""
+	}
+}
+
+// MaxSpeed rejects positions reporting a speed above max km/h.
+func MaxSpeed(max float64) Rule {
+	return func(_ *Handler, _, p *Position) string {
+		if p.Speed > max {
+			return fmt.Sprintf("speed %.0f km/h", p.Speed)
+		}
+		return ""
+	}
+}
+
+// AltitudeBounds rejects positions outside of [min, max] meters.
+func AltitudeBounds(min, max float64) Rule {
+	return func(_ *Handler, _, p *Position) string {
+		if p.Altitude < min || p.Altitude > max {
+			return fmt.Sprintf("altitude %.0f m", p.Altitude)
+		}
+		return ""
+	}
+}
+
+// Jump rejects positions reached from the previous one at an implied
+// speed above maxSpeed km/h. There's no limit on the distance itself,
+// since devices that were off for a while may have gone far.
+func Jump(maxSpeed float64) Rule {
+	return func(_ *Handler, prev, p *Position) string {
+		if prev == nil || maxSpeed <= 0 {
+			return ""
+		}
+		d := Distance(prev, p)
+		elapsed := math.Abs(p.Timestamp.Sub(prev.Timestamp).Hours())
+		if elapsed > 0 && d/1000/elapsed > maxSpeed {
+			return fmt.Sprintf("jumped %.0f m at %.0f km/h", d, d/1000/elapsed)
+		}
+		return ""
+	}
+}
+
+// Distance returns the great circle distance between a and b in meters.
+func Distance(a, b *Position) float64 {
+	const earthRadius = 6371000
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
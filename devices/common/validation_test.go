@@ -0,0 +1,105 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRules(t *testing.T) {
+	now := time.Now()
+	installed := now.Add(-time.Hour)
+	// 0.9 degrees of latitude are 100 km.
+	prev := &Position{Timestamp: now.Add(-time.Hour), Latitude: 54, Longitude: 25}
+	tests := []struct {
+		name   string
+		rule   Rule
+		prev   *Position
+		p      Position
+		reject bool
+	}{
+		{"null island", NullIsland(), nil, Position{}, true},
+		{"off null island", NullIsland(), nil, Position{Longitude: 0.0001}, false},
+		{"future", FutureTimestamp(time.Hour), nil, Position{Timestamp: now.Add(time.Hour + time.Minute)}, true},
+		{"future within limit", FutureTimestamp(time.Hour), nil, Position{Timestamp: now.Add(time.Hour - time.Minute)}, false},
+		{"before install", BeforeInstall(), nil, Position{Timestamp: installed.Add(-time.Second)}, true},
+		{"at install", BeforeInstall(), nil, Position{Timestamp: installed}, false},
+		{"satellites below min", MinSatellites(3), nil, Position{Satellites: 2}, true},
+		{"satellites at min", MinSatellites(3), nil, Position{Satellites: 3}, false},
+		{"unknown satellites", MinSatellites(3), nil, Position{Satellites: UnknownSatellites}, false},
+		{"speed above max", MaxSpeed(250), nil, Position{Speed: 250.1}, true},
+		{"speed at max", MaxSpeed(250), nil, Position{Speed: 250}, false},
+		{"altitude below min", AltitudeBounds(-500, 9000), nil, Position{Altitude: -500.1}, true},
+		{"altitude at min", AltitudeBounds(-500, 9000), nil, Position{Altitude: -500}, false},
+		{"altitude above max", AltitudeBounds(-500, 9000), nil, Position{Altitude: 9000.1}, true},
+		{"altitude at max", AltitudeBounds(-500, 9000), nil, Position{Altitude: 9000}, false},
+		{"jump without previous", Jump(100), nil, Position{Timestamp: now, Latitude: 10}, false},
+		{"jump above max speed", Jump(100), prev, Position{Timestamp: now, Latitude: 54.91, Longitude: 25}, true},
+		{"jump below max speed", Jump(100), prev, Position{Timestamp: now, Latitude: 54.89, Longitude: 25}, false},
+		// Devices that were off for long may be anywhere nearby.
+		{"jump after a day off", Jump(100), prev, Position{Timestamp: now.Add(23 * time.Hour), Latitude: 63, Longitude: 25}, false},
+		{"jump disabled", Jump(0), prev, Position{Timestamp: now, Latitude: 10}, false},
+	}
+	h := &Handler{InstalledAt: installed}
+	for _, tt := range tests {
+		p := tt.p
+		if reason := tt.rule(h, tt.prev, &p); (reason != "") != tt.reject {
+			t.Errorf("%s: reason %q", tt.name, reason)
+		}
+	}
+}
+
+// TestJumpLockout checks that a device whose positions are all rejected
+// as jumps from its last accepted position gets accepted again.
+func TestJumpLockout(t *testing.T) {
+	v := NewValidator()
+	v.MaxRejections = 3
+	v.AddRule("jump", Jump(400))
+	h := testHandler(t, AckStored, nil)
+	start := time.Now().Add(-time.Hour)
+	// The first position is wrong, 1000 km away from where the
+	// device really is.
+	v.Accept(h, []*Position{{Timestamp: start, Latitude: 45, Longitude: 25}})
+
+	var positions []*Position
+	for i := 0; i < 5; i++ {
+		positions = append(positions, &Position{
+			Timestamp: start.Add(time.Duration(i+1) * time.Minute),
+			Latitude:  54,
+			Longitude: 25 + float64(i)/1000,
+		})
+	}
+	accepted, rejected := v.Validate(h, positions[:2])
+	if len(accepted) != 0 || len(rejected) != 2 {
+		t.Fatalf("accepted %d, rejected %d", len(accepted), len(rejected))
+	}
+	// A batch sent again isn't counted twice.
+	v.Validate(h, positions[:2])
+	accepted, rejected = v.Validate(h, positions[2:])
+	if len(accepted) != 3 || len(rejected) != 0 {
+		t.Fatalf("after %d rejections: accepted %d, rejected %d", v.MaxRejections, len(accepted), len(rejected))
+	}
+	if accepted[0] != positions[2] {
+		t.Errorf("accepted from %s", accepted[0].Timestamp)
+	}
+}
+
+func TestJumpRejectionsInterrupted(t *testing.T) {
+	v := NewValidator()
+	v.MaxRejections = 2
+	v.AddRule("jump", Jump(400))
+	h := testHandler(t, AckStored, nil)
+	start := time.Now().Add(-time.Hour)
+	v.Accept(h, []*Position{{Timestamp: start, Latitude: 54, Longitude: 25}})
+
+	// Glitches between good positions never add up to a run.
+	positions := []*Position{
+		{Timestamp: start.Add(1 * time.Minute), Latitude: 45, Longitude: 25},
+		{Timestamp: start.Add(2 * time.Minute), Latitude: 54.001, Longitude: 25},
+		{Timestamp: start.Add(3 * time.Minute), Latitude: 45, Longitude: 25},
+		{Timestamp: start.Add(4 * time.Minute), Latitude: 54.002, Longitude: 25},
+	}
+	accepted, rejected := v.Validate(h, positions)
+	if len(accepted) != 2 || len(rejected) != 2 {
+		t.Errorf("accepted %d, rejected %d", len(accepted), len(rejected))
+	}
+}
@@ -0,0 +1,56 @@
+package common_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/devices/teltonika"
+)
+
+// TestCountInteractorRefusal checks that a device refused by the
+// interactor itself, before Serve verifies its IMEI, is counted once.
+func TestCountInteractorRefusal(t *testing.T) {
+	device, conn := net.Pipe()
+	defer device.Close()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	h := &common.Handler{
+		Name:       "teltonika-refusal",
+		Conn:       conn,
+		Logger:     logger,
+		Interactor: &teltonika.Interactor{},
+		Unregister: func() {},
+	}
+	// No client certificate was presented.
+	common.RequireClientCertificate(h)
+	failures := "listener.teltonika-refusal.handshake_failures"
+	want := common.Counted(failures) + 1
+	done := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(done)
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err := device.Write([]byte("\x00\x0f356307042441013"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(device, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 0 {
+		t.Errorf("handshake reply %d, want 0", reply[0])
+	}
+	<-done
+	if got := common.Counted(failures); got != want {
+		t.Errorf("%s: %d, want %d", failures, got, want)
+	}
+}
@@ -0,0 +1,311 @@
+package gt06
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+// Protocol numbers. GT06N and newer devices use the 0x2x variants.
+const (
+	ProtocolLogin      = 0x01
+	ProtocolLocation   = 0x12
+	ProtocolStatus     = 0x13
+	ProtocolAlarm      = 0x16
+	ProtocolLocationN  = 0x22
+	ProtocolHeartbeatN = 0x23
+	ProtocolAlarmN     = 0x26
+)
+
+const (
+	startShort = 0x7878
+	startLong  = 0x7979
+	stopBits   = 0x0D0A
+	// minPacketLength covers the protocol number, serial number and CRC.
+	minPacketLength   = 5
+	coordinateDivisor = 30000 * 60
+	gpsInfoLength     = 12
+	lbsInfoLength     = 8
+	statusInfoLength  = 5
+	statusInfoLengthN = 6
+)
+
+// Bits of the course and status field of GPS information.
+const (
+	courseMask         = 0x03FF
+	courseNorth        = 0x0400
+	courseWest         = 0x0800
+	coursePositioned   = 0x1000
+	courseDifferential = 0x2000
+)
+
+// Bits of terminal information.
+const (
+	TerminalACC         = 0x02
+	TerminalCharging    = 0x04
+	TerminalGPSTracking = 0x40
+	// TerminalAlarm masks the alarm bits.
+	TerminalAlarm = 0x38
+)
+
+var (
+	errStartBits = errors.New("unknown start bits")
+	errStopBits  = errors.New("missing stop bits")
+	errCRC       = errors.New("CRC mismatch")
+	errLength    = errors.New("invalid packet length")
+	errLogin     = errors.New("first packet isn't a login")
+	errIMEI      = errors.New("invalid IMEI")
+)
+
+// Packet is a single frame, 78 78 or 79 79 followed by the length, the
+// protocol number, the content, the serial number, the CRC and 0D 0A.
+type Packet struct {
+	Protocol byte
+	Content  []byte
+	Serial   uint16
+}
+
+// Login is the first packet sent on every connection.
+type Login struct {
+	Serial uint16
+	IMEI   string
+	// TypeID and Timezone are only sent by newer devices.
+	TypeID   uint16
+	Timezone []byte
+}
+
+// Location is a GPS fix, together with the cell the device was
+// registered to.
+type Location struct {
+	Time       time.Time
+	Satellites int
+	// Latitude and Longitude are in degrees.
+	Latitude  float64
+	Longitude float64
+	// Speed is in km/h.
+	Speed      int
+	Course     int
+	Positioned bool
+	// Differential is set for differential fixes, otherwise it's real time.
+	Differential bool
+	Cell         Cell
+	// ACC is the ignition state, only sent by GT06N location packets.
+	ACC *bool
+}
+
+// Cell identifies a GSM cell.
+type Cell struct {
+	MCC    uint16
+	MNC    uint8
+	LAC    uint16
+	CellID uint32
+}
+
+// Status is sent as a heartbeat, and as a part of alarms.
+type Status struct {
+	Serial   uint16
+	Protocol byte
+	// TerminalInfo holds flags, e.g. ACC, charging or the alarm bits.
+	TerminalInfo byte
+	// Voltage is a level from 0 to 6, or hundredths of a volt for GT06N
+	// heartbeats.
+	Voltage   int
+	GSMSignal byte
+	Alarm     byte
+	Language  byte
+}
+
+// Alarm is a location reported together with the alarm that caused it.
+type Alarm struct {
+	Serial   uint16
+	Protocol byte
+	Location *Location
+	Status   *Status
+}
+
+// detect tells whether head starts a packet.
+func detect(head []byte) bool {
+	if len(head) < 2 {
+		return false
+	}
+	start := binary.BigEndian.Uint16(head)
+	return start == startShort || start == startLong
+}
+
+// ReadPacket reads a single packet from r and checks its CRC.
+func ReadPacket(r io.Reader) (p *Packet, err error) {
+	start := make([]byte, 2)
+	_, err = io.ReadFull(r, start)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet start read failed")
+	}
+	var lengthField []byte
+	switch binary.BigEndian.Uint16(start) {
+	case startShort:
+		lengthField = make([]byte, 1)
+	case startLong:
+		lengthField = make([]byte, 2)
+	default:
+		return nil, errors.Wrapf(errStartBits, "%x", start)
+	}
+	_, err = io.ReadFull(r, lengthField)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet length read failed")
+	}
+	length := 0
+	for _, b := range lengthField {
+		length = length<<8 | int(b)
+	}
+	if length < minPacketLength {
+		return nil, errors.Wrapf(errLength, "%d", length)
+	}
+
+	// The body is followed by the stop bits.
+	body := make([]byte, length+2)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet body read failed")
+	}
+	if binary.BigEndian.Uint16(body[length:]) != stopBits {
+		return nil, errStopBits
+	}
+	crc := binary.BigEndian.Uint16(body[length-2:])
+	if expected := util.CrcX25(append(lengthField, body[:length-2]...)); crc != expected {
+		return nil, errors.Wrapf(errCRC, "got %04x, expected %04x", crc, expected)
+	}
+	return &Packet{
+		Protocol: body[0],
+		Content:  body[1 : length-4],
+		Serial:   binary.BigEndian.Uint16(body[length-4:]),
+	}, nil
+}
+
+// Decode returns the message carried by the packet: *Login, *Location,
+// *Status or *Alarm. Packets of other protocols are returned as they are.
+func (p *Packet) Decode() (msg interface{}, err error) {
+	c := p.Content
+	switch p.Protocol {
+	case ProtocolLogin:
+		return decodeLogin(p)
+	case ProtocolLocation, ProtocolLocationN:
+		if len(c) < 6+gpsInfoLength+lbsInfoLength {
+			return nil, errors.Wrapf(errLength, "location of %d bytes", len(c))
+		}
+		l := decodeLocation(c)
+		l.Cell = decodeCell(c[6+gpsInfoLength:])
+		if rest := c[6+gpsInfoLength+lbsInfoLength:]; p.Protocol == ProtocolLocationN && len(rest) > 0 {
+			acc := rest[0] != 0
+			l.ACC = &acc
+		}
+		return l, nil
+	case ProtocolStatus, ProtocolHeartbeatN:
+		return decodeStatus(p.Serial, p.Protocol, c)
+	case ProtocolAlarm, ProtocolAlarmN:
+		// The cell is preceded by its length, which includes itself.
+		if len(c) < 6+gpsInfoLength+1 {
+			return nil, errors.Wrapf(errLength, "alarm of %d bytes", len(c))
+		}
+		lbsLength := int(c[6+gpsInfoLength])
+		if lbsLength < 1 || len(c) < 6+gpsInfoLength+lbsLength {
+			return nil, errors.Wrapf(errLength, "alarm of %d bytes", len(c))
+		}
+		a := &Alarm{Serial: p.Serial, Protocol: p.Protocol, Location: decodeLocation(c)}
+		if lbsLength > lbsInfoLength {
+			a.Location.Cell = decodeCell(c[6+gpsInfoLength+1:])
+		}
+		a.Status, err = decodeStatus(p.Serial, ProtocolStatus, c[6+gpsInfoLength+lbsLength:])
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	return p, nil
+}
+
+func decodeLogin(p *Packet) (*Login, error) {
+	if len(p.Content) < 8 {
+		return nil, errors.Wrapf(errLength, "login of %d bytes", len(p.Content))
+	}
+	// The terminal ID is the IMEI in BCD, padded to 16 digits.
+	imei := fmt.Sprintf("%x", p.Content[:8])
+	if imei[0] == '0' {
+		imei = imei[1:]
+	}
+	if !util.ValidIMEI(imei) {
+		return nil, errors.Wrapf(errIMEI, "%q", imei)
+	}
+	l := &Login{Serial: p.Serial, IMEI: imei}
+	if len(p.Content) >= 12 {
+		l.TypeID = binary.BigEndian.Uint16(p.Content[8:])
+		l.Timezone = p.Content[10:12]
+	}
+	return l, nil
+}
+
+// decodeLocation decodes the time and the GPS information at
+// the start of c, which must be long enough.
+func decodeLocation(c []byte) *Location {
+	course := binary.BigEndian.Uint16(c[16:])
+	l := &Location{
+		Time:         time.Date(2000+int(c[0]), time.Month(c[1]), int(c[2]), int(c[3]), int(c[4]), int(c[5]), 0, time.UTC),
+		Satellites:   int(c[6] & 0x0F),
+		Latitude:     float64(binary.BigEndian.Uint32(c[7:])) / coordinateDivisor,
+		Longitude:    float64(binary.BigEndian.Uint32(c[11:])) / coordinateDivisor,
+		Speed:        int(c[15]),
+		Course:       int(course & courseMask),
+		Positioned:   course&coursePositioned != 0,
+		Differential: course&courseDifferential != 0,
+	}
+	if course&courseNorth == 0 {
+		l.Latitude = -l.Latitude
+	}
+	if course&courseWest != 0 {
+		l.Longitude = -l.Longitude
+	}
+	return l
+}
+
+func decodeCell(c []byte) Cell {
+	return Cell{
+		MCC:    binary.BigEndian.Uint16(c),
+		MNC:    c[2],
+		LAC:    binary.BigEndian.Uint16(c[3:]),
+		CellID: uint32(c[5])<<16 | uint32(c[6])<<8 | uint32(c[7]),
+	}
+}
+
+// decodeStatus decodes the status information of heartbeats and alarms.
+// GT06N heartbeats have a two byte voltage.
+func decodeStatus(serial uint16, protocol byte, c []byte) (*Status, error) {
+	length := statusInfoLength
+	if protocol == ProtocolHeartbeatN {
+		length = statusInfoLengthN
+	}
+	if len(c) < length {
+		return nil, errors.Wrapf(errLength, "status of %d bytes", len(c))
+	}
+	s := &Status{Serial: serial, Protocol: protocol, TerminalInfo: c[0]}
+	if protocol == ProtocolHeartbeatN {
+		s.Voltage = int(binary.BigEndian.Uint16(c[1:]))
+		c = c[1:]
+	} else {
+		s.Voltage = int(c[1])
+	}
+	s.GSMSignal, s.Alarm, s.Language = c[2], c[3], c[4]
+	return s, nil
+}
+
+// EncodeResponse builds the packet acknowledging the one with
+// the given protocol number and serial number.
+func EncodeResponse(protocol byte, serial uint16, content []byte) []byte {
+	b := make([]byte, 0, 10+len(content))
+	b = append(b, 0x78, 0x78, byte(minPacketLength+len(content)), protocol)
+	b = append(b, content...)
+	b = append(b, byte(serial>>8), byte(serial))
+	crc := util.CrcX25(b[2:])
+	return append(b, byte(crc>>8), byte(crc), 0x0D, 0x0A)
+}
@@ -0,0 +1,118 @@
+package gt06
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Packets of a GT06 device with IMEI 353288040073284.
+const (
+	packetLogin  = "78780d010353288040073284000120c50d0a"
+	packetLoc    = "78781f12110a020a0f00c90586b1100003824c281c5a00ea0f1f4a00b3c100026f770d0a"
+	packetStatus = "78780a1346040400020003a12b0d0a"
+	packetAlarm  = "78782516110a020a0f00c90586b1100003824c281c5a0900ea0f1f4a00b3c146040401020004aed50d0a"
+	// packetBadLogin is the login example of the protocol, whose
+	// IMEI 123456789012345 fails the check digit.
+	packetBadLogin = "78780d01012345678901234500018cdd0d0a"
+)
+
+func mustDecodeHex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decode(t *testing.T, packet string) interface{} {
+	p, err := ReadPacket(bytes.NewReader(mustDecodeHex(t, packet)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func checkLocation(t *testing.T, l *Location) {
+	want := time.Date(2017, 10, 2, 10, 15, 0, 0, time.UTC)
+	if !l.Time.Equal(want) || l.Satellites != 9 || l.Speed != 40 || l.Course != 90 || !l.Positioned {
+		t.Errorf("location %+v", l)
+	}
+	if math.Abs(l.Latitude-51.507351) > 1e-6 || math.Abs(l.Longitude+0.127758) > 1e-6 {
+		t.Errorf("location at %f,%f", l.Latitude, l.Longitude)
+	}
+	if l.Cell != (Cell{MCC: 234, MNC: 15, LAC: 0x1f4a, CellID: 0xb3c1}) {
+		t.Errorf("cell %+v", l.Cell)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	login, ok := decode(t, packetLogin).(*Login)
+	if !ok || login.IMEI != "353288040073284" || login.Serial != 1 {
+		t.Errorf("login %+v", login)
+	}
+
+	l, ok := decode(t, packetLoc).(*Location)
+	if !ok {
+		t.Fatal("not a location")
+	}
+	checkLocation(t, l)
+
+	s, ok := decode(t, packetStatus).(*Status)
+	if !ok {
+		t.Fatal("not a status")
+	}
+	if s.Serial != 3 || s.TerminalInfo != 0x46 || s.Voltage != 4 || s.GSMSignal != 4 || s.Language != 2 {
+		t.Errorf("status %+v", s)
+	}
+
+	a, ok := decode(t, packetAlarm).(*Alarm)
+	if !ok {
+		t.Fatal("not an alarm")
+	}
+	checkLocation(t, a.Location)
+	if a.Serial != 4 || a.Status.Alarm != 1 {
+		t.Errorf("alarm %+v, status %+v", a, a.Status)
+	}
+}
+
+func TestReadPacketMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		err    error
+	}{
+		{"start bits", "7978" + packetLogin[4:], errStartBits},
+		{"CRC", packetLogin[:len(packetLogin)-8] + "20c60d0a", errCRC},
+		{"stop bits", packetLogin[:len(packetLogin)-4] + "0d0d", errStopBits},
+		{"length", "7878040100010d0a", errLength},
+	}
+	for _, tt := range tests {
+		_, err := ReadPacket(bytes.NewReader(mustDecodeHex(t, tt.packet)))
+		if errors.Cause(err) != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	p, err := ReadPacket(bytes.NewReader(mustDecodeHex(t, packetBadLogin)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Decode(); errors.Cause(err) != errIMEI {
+		t.Errorf("login error %v, want %v", err, errIMEI)
+	}
+}
+
+func TestEncodeResponse(t *testing.T) {
+	if got := hex.EncodeToString(EncodeResponse(ProtocolLogin, 1, nil)); got != "787805010001d9dc0d0a" {
+		t.Errorf("login ack %s", got)
+	}
+}
@@ -0,0 +1,63 @@
+package gt06
+
+import (
+	"github.com/khiemm/listener/devices/common"
+)
+
+// alarmNames are the names of the alarm codes sent in status information.
+var alarmNames = map[byte]string{
+	0x01: "sos",
+	0x02: "power_cut",
+	0x03: "vibration",
+	0x04: "fence_in",
+	0x05: "fence_out",
+	0x06: "overspeed",
+	0x09: "moving",
+	0x0A: "gps_dead_zone_in",
+	0x0B: "gps_dead_zone_out",
+	0x0C: "power_on",
+	0x0D: "gps_first_fix",
+	0x0E: "low_battery",
+}
+
+// Position converts the location to the protocol neutral representation.
+// Locations without a fix are given zero satellites.
+func (l *Location) Position() *common.Position {
+	p := &common.Position{
+		Timestamp:  l.Time,
+		Latitude:   l.Latitude,
+		Longitude:  l.Longitude,
+		Heading:    float64(l.Course),
+		Speed:      float64(l.Speed),
+		Satellites: l.Satellites,
+	}
+	if !l.Positioned {
+		p.Satellites = 0
+	}
+	if l.Cell.CellID != 0 {
+		p.SetAttribute("cell", map[string]uint32{
+			"mcc": uint32(l.Cell.MCC),
+			"mnc": uint32(l.Cell.MNC),
+			"lac": uint32(l.Cell.LAC),
+			"id":  l.Cell.CellID,
+		})
+	}
+	if l.ACC != nil {
+		p.SetAttribute("ignition", *l.ACC)
+	}
+	return p
+}
+
+// Position converts the location of the alarm, with the alarm code as
+// the event ID.
+func (a *Alarm) Position() *common.Position {
+	p := a.Location.Position()
+	p.EventID = int(a.Status.Alarm)
+	if name, ok := alarmNames[a.Status.Alarm]; ok {
+		p.SetAttribute("alarm", name)
+	}
+	p.SetAttribute("ignition", a.Status.TerminalInfo&TerminalACC != 0)
+	p.SetAttribute("charging", a.Status.TerminalInfo&TerminalCharging != 0)
+	p.SetAttribute("gsm_signal", a.Status.GSMSignal)
+	return p
+}
@@ -0,0 +1,98 @@
+package gt06
+
+import (
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+	"github.com/pkg/errors"
+)
+
+// defaultTimeout applies when [devices.gt06] doesn't set a timeout.
+// Devices send a heartbeat every few minutes.
+const defaultTimeout = 5 * time.Minute
+
+func init() {
+	common.RegisterProtocol(common.Protocol{
+		Name:          "gt06",
+		NewInteractor: func(s *common.Server) common.Interactor { return Interactor{} },
+		Detect:        detect,
+	})
+}
+
+// Interactor handles Concox GT06 family devices over TCP.
+type Interactor struct{}
+
+// InitializeConnection reads the login packet every connection starts
+// with and acknowledges it. Devices with a malformed IMEI aren't answered
+// and get the connection closed.
+func (_ Interactor) InitializeConnection(h *common.Handler) (err error) {
+	msg, err := readMessage(h)
+	if errors.Cause(err) == errIMEI {
+		return errors.Wrap(common.ErrUnauthorizedDevice, err.Error())
+	}
+	if err != nil {
+		return
+	}
+	login, ok := msg.(*Login)
+	if !ok {
+		return errLogin
+	}
+	err = h.VerifyIMEI(login.IMEI)
+	if err != nil {
+		return
+	}
+	h.IMEI = login.IMEI
+	h.Log().Debug(h.IMEI)
+	return respond(h, ProtocolLogin, login.Serial)
+}
+
+// ParseMessage returns the next message sent by the device,
+// see Packet.Decode.
+func (_ Interactor) ParseMessage(h *common.Handler) (result interface{}, err error) {
+	return readMessage(h)
+}
+
+func readMessage(h *common.Handler) (interface{}, error) {
+	p, err := ReadPacket(h.Conn)
+	if err != nil {
+		return nil, err
+	}
+	return p.Decode()
+}
+
+// HandleMessage stores locations and alarms, and acknowledges
+// the packets that need it with their serial number.
+func (_ Interactor) HandleMessage(h *common.Handler, msg interface{}) (err error) {
+	switch m := msg.(type) {
+	case *Location:
+		// Locations aren't acknowledged.
+		return h.SavePositions([]*common.Position{m.Position()})
+	case *Alarm:
+		return h.SaveAndAcknowledge([]*common.Position{m.Position()}, func() error {
+			return respond(h, m.Protocol, m.Serial)
+		})
+	case *Status:
+		h.DebugLog().Debugf("Status %02x, voltage %d, GSM signal %d", m.TerminalInfo, m.Voltage, m.GSMSignal)
+		return respond(h, m.Protocol, m.Serial)
+	case *Login:
+		return respond(h, ProtocolLogin, m.Serial)
+	case *Packet:
+		h.DebugLog().Debugf("Ignored packet of protocol %02x", m.Protocol)
+	}
+	return nil
+}
+
+func respond(h *common.Handler, protocol byte, serial uint16) error {
+	_, err := h.Conn.Write(EncodeResponse(protocol, serial, nil))
+	return errors.Wrap(err, "couldn't send response")
+}
+
+func (_ Interactor) HandleError(h *common.Handler, _ error) (terminate bool) {
+	return true
+}
+
+func (_ Interactor) GetConnectionTimeout(h common.Handler) time.Duration {
+	return defaultTimeout
+}
+
+func (_ Interactor) CloseConnection(h common.Handler) (err error) { return nil }
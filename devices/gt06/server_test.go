@@ -0,0 +1,97 @@
+package gt06
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+)
+
+// memStore keeps the positions it's given.
+type memStore struct {
+	positions []*common.Position
+}
+
+func (s *memStore) SavePositions(h *common.Handler, positions []*common.Position) error {
+	s.positions = append(s.positions, positions...)
+	return nil
+}
+
+// serve runs a handler of the GT06 interactor on one end of a pipe
+// and returns the other end, the device.
+func serve(t *testing.T, store common.Store) (device net.Conn, done <-chan struct{}) {
+	device, conn := net.Pipe()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	h := &common.Handler{
+		Name:       "gt06",
+		Conn:       conn,
+		Store:      store,
+		Logger:     logger,
+		Interactor: Interactor{},
+		Unregister: func() {},
+	}
+	d := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(d)
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+	return device, d
+}
+
+// exchange sends a packet and returns the response, if one is expected.
+func exchange(t *testing.T, device net.Conn, packet, want string) {
+	_, err := device.Write(mustDecodeHex(t, packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want == "" {
+		return
+	}
+	response := make([]byte, len(want)/2)
+	_, err = io.ReadFull(device, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(response); got != want {
+		t.Errorf("response %s, want %s", got, want)
+	}
+}
+
+func TestAcknowledgePackets(t *testing.T) {
+	store := &memStore{}
+	device, done := serve(t, store)
+	exchange(t, device, packetLogin, "787805010001d9dc0d0a")
+	// Locations aren't acknowledged, the status that follows is.
+	exchange(t, device, packetLoc, "")
+	exchange(t, device, packetStatus, "787805130003cae30d0a")
+	exchange(t, device, packetAlarm, "78780516000487e10d0a")
+	device.Close()
+	<-done
+
+	if len(store.positions) != 2 {
+		t.Fatalf("stored %d positions, want 2", len(store.positions))
+	}
+	if p := store.positions[1]; p.EventID != 1 || p.Attributes["alarm"] != "sos" {
+		t.Errorf("alarm event %d, attributes %v", p.EventID, p.Attributes)
+	}
+}
+
+func TestRefuseInvalidLogin(t *testing.T) {
+	device, done := serve(t, &memStore{})
+	_, err := device.Write(mustDecodeHex(t, packetBadLogin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The login isn't answered and the connection is closed.
+	if _, err = device.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after refusal: %v", err)
+	}
+	<-done
+}
@@ -0,0 +1,269 @@
+package queclink
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+// Message kinds. Reports are sent as +RESP, or as +BUFF when they were
+// buffered while the device was offline. +ACK acknowledges commands and
+// carries heartbeats.
+const (
+	KindResp = "+RESP"
+	KindBuff = "+BUFF"
+	KindAck  = "+ACK"
+)
+
+// Report types.
+const (
+	TypeFixed       = "GTFRI"
+	TypeIgnitionOn  = "GTIGN"
+	TypeIgnitionOff = "GTIGF"
+	TypeHeartbeat   = "GTHBD"
+)
+
+// DefaultMaxFrameSize is the longest message accepted when
+// [devices.queclink] doesn't set max_frame_size.
+const DefaultMaxFrameSize = 4096
+
+const (
+	frameEnd   = '$'
+	timeLayout = "20060102150405"
+	// recordFields is the number of fields describing a single fix.
+	recordFields = 12
+)
+
+var (
+	errFrameTooLong = errors.New("frame exceeds the maximum size")
+	errMalformed    = errors.New("malformed message")
+	errInvalidIMEI  = errors.New("invalid IMEI")
+)
+
+// Message is a single @Track message, e.g.
+// +RESP:GTFRI,060100,135790246811220,,,00,1,1,4.3,...,20090214093254,11F0$
+type Message struct {
+	Kind            string
+	Type            string
+	ProtocolVersion string
+	IMEI            string
+	DeviceName      string
+	// Fields holds the type specific fields between the device name
+	// and the send time.
+	Fields   []string
+	SendTime time.Time
+	// Count is the hex message counter echoed back in acknowledgements.
+	Count   string
+	Records []*Record
+	// Mileage is the total distance in km, when the report has it.
+	Mileage float64
+}
+
+// Record is a fix carried by a report.
+type Record struct {
+	// Accuracy is the HDOP, zero when the device had no fix.
+	Accuracy int
+	// Speed is in km/h.
+	Speed float64
+	// Azimuth is in degrees clockwise from north.
+	Azimuth float64
+	// Altitude is in meters above sea level.
+	Altitude  float64
+	Longitude float64
+	Latitude  float64
+	Time      time.Time
+	MCC       string
+	MNC       string
+	LAC       string
+	CellID    string
+}
+
+// ReadFrame reads a single message terminated by '$', skipping anything
+// sent before its leading '+', such as line breaks. Bytes are read one at
+// a time, so nothing past the end of the message is consumed.
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var frame []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			if err == io.EOF && frame != nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, errors.Wrap(err, "frame read failed")
+		}
+		if frame == nil && b[0] != '+' {
+			continue
+		}
+		frame = append(frame, b[0])
+		if b[0] == frameEnd {
+			return frame, nil
+		}
+		if len(frame) >= maxSize {
+			return nil, errFrameTooLong
+		}
+	}
+}
+
+// detect tells whether head starts a message, e.g. "+RESP:G", or is
+// the start of a message kind when fewer bytes were peeked, e.g. "+RE".
+func detect(head []byte) bool {
+	if len(head) == 0 {
+		return false
+	}
+	for _, kind := range []string{KindResp + ":", KindBuff + ":", KindAck + ":"} {
+		if strings.HasPrefix(string(head), kind) || strings.HasPrefix(kind, string(head)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse decodes a message read by ReadFrame. Reports of other types than
+// the ones listed above are returned without records.
+func Parse(frame []byte) (m *Message, err error) {
+	frame = bytes.TrimSuffix(frame, []byte{frameEnd})
+	colon := bytes.IndexByte(frame, ':')
+	if colon < 0 {
+		return nil, errors.Wrapf(errMalformed, "no message kind in %q", frame)
+	}
+	m = &Message{Kind: string(frame[:colon])}
+	switch m.Kind {
+	case KindResp, KindBuff, KindAck:
+	default:
+		return nil, errors.Wrapf(errMalformed, "unknown message kind %q", m.Kind)
+	}
+
+	fields := strings.Split(string(frame[colon+1:]), ",")
+	if len(fields) < 6 {
+		return nil, errors.Wrapf(errMalformed, "%d fields in %q", len(fields), frame)
+	}
+	m.Type = fields[0]
+	m.ProtocolVersion = fields[1]
+	m.IMEI = fields[2]
+	m.DeviceName = fields[3]
+	m.Fields = fields[4 : len(fields)-2]
+	m.Count = fields[len(fields)-1]
+	if !util.ValidIMEI(m.IMEI) {
+		return nil, errors.Wrapf(errInvalidIMEI, "%q", m.IMEI)
+	}
+	if _, err = strconv.ParseUint(m.Count, 16, 16); err != nil {
+		return nil, errors.Wrapf(errMalformed, "count number %q", m.Count)
+	}
+	m.SendTime, err = parseTime(fields[len(fields)-2])
+	if err != nil {
+		return nil, errors.Wrap(err, "send time")
+	}
+
+	if m.Kind == KindAck {
+		return m, nil
+	}
+	switch m.Type {
+	case TypeFixed:
+		err = m.parseFixed()
+	case TypeIgnitionOn, TypeIgnitionOff:
+		err = m.parseIgnition()
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s report", m.Type)
+	}
+	return m, nil
+}
+
+// parseFixed decodes the fields of a GTFRI report: report ID, report type,
+// the number of fixes and the fixes, followed by the mileage.
+func (m *Message) parseFixed() (err error) {
+	f := m.Fields
+	if len(f) < 3 {
+		return errMalformed
+	}
+	n, err := strconv.Atoi(f[2])
+	if err != nil || n < 0 || len(f) < 3+n*recordFields {
+		return errors.Wrapf(errMalformed, "%q fixes", f[2])
+	}
+	m.Records, err = parseRecords(f[3:3+n*recordFields], n)
+	if err != nil {
+		return
+	}
+	if rest := f[3+n*recordFields:]; len(rest) > 0 {
+		m.Mileage, err = parseFloat(rest[0])
+	}
+	return
+}
+
+// parseIgnition decodes the fields of GTIGN and GTIGF reports: the time
+// spent in the previous ignition state, a fix, the hour meter count and
+// the mileage.
+func (m *Message) parseIgnition() (err error) {
+	f := m.Fields
+	if len(f) < 1+recordFields {
+		return errMalformed
+	}
+	m.Records, err = parseRecords(f[1:1+recordFields], 1)
+	if err != nil {
+		return
+	}
+	if rest := f[1+recordFields:]; len(rest) > 1 {
+		m.Mileage, err = parseFloat(rest[1])
+	}
+	return
+}
+
+func parseRecords(f []string, n int) (records []*Record, err error) {
+	records = make([]*Record, n)
+	for i := range records {
+		records[i], err = parseRecord(f[i*recordFields : (i+1)*recordFields])
+		if err != nil {
+			return nil, errors.Wrapf(err, "fix %d", i)
+		}
+	}
+	return
+}
+
+// parseRecord decodes the fields of a fix. The last one is reserved.
+func parseRecord(f []string) (r *Record, err error) {
+	r = &Record{MCC: f[7], MNC: f[8], LAC: f[9], CellID: f[10]}
+	if f[0] != "" {
+		r.Accuracy, err = strconv.Atoi(f[0])
+		if err != nil {
+			return nil, errors.Wrapf(errMalformed, "GPS accuracy %q", f[0])
+		}
+	}
+	for i, v := range []*float64{&r.Speed, &r.Azimuth, &r.Altitude, &r.Longitude, &r.Latitude} {
+		*v, err = parseFloat(f[1+i])
+		if err != nil {
+			return
+		}
+	}
+	r.Time, err = parseTime(f[6])
+	return
+}
+
+// parseFloat parses a decimal field, empty ones are zero.
+func parseFloat(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.Wrapf(errMalformed, "number %q", s)
+	}
+	return v, nil
+}
+
+// parseTime parses a UTC time field, empty ones are the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(timeLayout, s)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(errMalformed, "time %q", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,171 @@
+package queclink
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Frames as sent by GV-series trackers, after the examples of the
+// @Track protocol with a valid IMEI.
+const (
+	frameFixed     = "+RESP:GTFRI,060100,862581040012342,,,00,1,1,4.3,92,70.0,121.354335,31.222073,20090214013254,0460,0000,18d8,6141,00,2000.0,20090214093254,11F0$"
+	frameBuffered  = "+BUFF:GTFRI,060100,862581040012342,GV300,,10,2,1,0.0,0,29.5,-0.127758,51.507351,20211002101500,0234,0015,1f4a,b3c1,00,2,35.2,204,28.4,-0.128112,51.508079,20211002101530,0234,0015,1f4a,b3c2,00,1532.7,20211002101545,002A$"
+	frameIgnition  = "+RESP:GTIGN,060100,862581040012342,,200,1,4.3,92,70.0,121.354335,31.222073,20090214013254,0460,0000,18d8,6141,00,,2000.0,20090214093254,11F1$"
+	frameNoFix     = "+RESP:GTFRI,060100,862581040012342,,,00,1,1,0,,,,,,,0460,0000,18d8,6141,00,,20090214093254,11F2$"
+	frameSOS       = "+RESP:GTSOS,060100,862581040012342,,,00,1,1,4.3,92,70.0,121.354335,31.222073,20090214013254,0460,0000,18d8,6141,00,2000.0,20090214093254,11F3$"
+	frameHeartbeat = "+ACK:GTHBD,060100,862581040012342,,20090214093254,11F4$"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    string
+		kind     string
+		typ      string
+		count    string
+		records  int
+		mileage  float64
+		sendTime string
+	}{
+		{"fixed", frameFixed, KindResp, TypeFixed, "11F0", 1, 2000, "20090214093254"},
+		{"buffered", frameBuffered, KindBuff, TypeFixed, "002A", 2, 1532.7, "20211002101545"},
+		{"ignition", frameIgnition, KindResp, TypeIgnitionOn, "11F1", 1, 2000, "20090214093254"},
+		{"no fix", frameNoFix, KindResp, TypeFixed, "11F2", 1, 0, "20090214093254"},
+		{"other type", frameSOS, KindResp, "GTSOS", "11F3", 0, 0, "20090214093254"},
+		{"heartbeat", frameHeartbeat, KindAck, TypeHeartbeat, "11F4", 0, 0, "20090214093254"},
+	}
+	for _, tt := range tests {
+		m, err := Parse([]byte(tt.frame))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if m.Kind != tt.kind || m.Type != tt.typ || m.Count != tt.count || m.IMEI != "862581040012342" {
+			t.Errorf("%s: parsed %s %s %s from %s", tt.name, m.Kind, m.Type, m.Count, m.IMEI)
+		}
+		if len(m.Records) != tt.records || m.Mileage != tt.mileage {
+			t.Errorf("%s: %d records, mileage %f", tt.name, len(m.Records), m.Mileage)
+		}
+		if got := m.SendTime.Format(timeLayout); got != tt.sendTime {
+			t.Errorf("%s: send time %s, want %s", tt.name, got, tt.sendTime)
+		}
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	m, err := Parse([]byte(frameBuffered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Record{
+		{Accuracy: 1, Speed: 0, Azimuth: 0, Altitude: 29.5, Longitude: -0.127758, Latitude: 51.507351,
+			Time: time.Date(2021, 10, 2, 10, 15, 0, 0, time.UTC), MCC: "0234", MNC: "0015", LAC: "1f4a", CellID: "b3c1"},
+		{Accuracy: 2, Speed: 35.2, Azimuth: 204, Altitude: 28.4, Longitude: -0.128112, Latitude: 51.508079,
+			Time: time.Date(2021, 10, 2, 10, 15, 30, 0, time.UTC), MCC: "0234", MNC: "0015", LAC: "1f4a", CellID: "b3c2"},
+	}
+	for i, r := range m.Records {
+		if *r != want[i] {
+			t.Errorf("record %d: %+v, want %+v", i, *r, want[i])
+		}
+	}
+
+	positions := m.Positions()
+	if len(positions) != 2 {
+		t.Fatalf("%d positions", len(positions))
+	}
+	p := positions[1]
+	if p.Attributes["buffered"] != true || p.Attributes["report"] != TypeFixed || p.Attributes["mileage"] != 1532.7 {
+		t.Errorf("attributes %v", p.Attributes)
+	}
+}
+
+func TestPositionsWithoutFix(t *testing.T) {
+	m, err := Parse([]byte(frameNoFix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fix has no GPS time, so it can't be placed.
+	if positions := m.Positions(); len(positions) != 0 {
+		t.Errorf("%d positions", len(positions))
+	}
+
+	m, err = Parse([]byte(frameIgnition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := m.Positions()
+	if len(positions) != 1 || positions[0].Attributes["ignition"] != true {
+		t.Errorf("ignition positions %v", positions)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		err   error
+	}{
+		{"no kind", "GTFRI,060100,862581040012342,,20090214093254,11F0$", errMalformed},
+		{"unknown kind", "+SACK:GTFRI,060100,862581040012342,,20090214093254,11F0$", errMalformed},
+		{"few fields", "+RESP:GTFRI,060100,862581040012342$", errMalformed},
+		{"invalid IMEI", strings.Replace(frameFixed, "862581040012342", "862581040012343", 1), errInvalidIMEI},
+		{"count", strings.Replace(frameFixed, "11F0$", "11G0$", 1), errMalformed},
+		{"send time", strings.Replace(frameFixed, "20090214093254,11F0", "2009021409,11F0", 1), errMalformed},
+		{"fix count", strings.Replace(frameFixed, ",00,1,1,", ",00,3,1,", 1), errMalformed},
+		{"latitude", strings.Replace(frameFixed, "31.222073", "31.22x", 1), errMalformed},
+		{"ignition fields", "+RESP:GTIGN,060100,862581040012342,,200,1,4.3,20090214093254,11F1$", errMalformed},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.frame))
+		if errors.Cause(err) != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	r := strings.NewReader("\r\n" + frameHeartbeat + "\r\n" + frameFixed)
+	for _, want := range []string{frameHeartbeat, frameFixed} {
+		frame, err := ReadFrame(r, DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(frame) != want {
+			t.Errorf("frame %q, want %q", frame, want)
+		}
+	}
+
+	_, err := ReadFrame(strings.NewReader(frameFixed), 64)
+	if err != errFrameTooLong {
+		t.Errorf("long frame: %v", err)
+	}
+	_, err = ReadFrame(strings.NewReader(frameFixed[:20]), DefaultMaxFrameSize)
+	if errors.Cause(err) == nil {
+		t.Error("truncated frame read")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		head string
+		want bool
+	}{
+		{"+RESP:", true},
+		{"+BUFF:", true},
+		{"+ACK:G", true},
+		// Shorter peeks are matched against the start of a kind.
+		{"+RE", true},
+		{"+", true},
+		{"+SACK:", false},
+		{"+RESPX", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := detect([]byte(tt.head)); got != tt.want {
+			t.Errorf("%q: detected %t, want %t", tt.head, got, tt.want)
+		}
+	}
+}
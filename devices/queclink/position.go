@@ -0,0 +1,60 @@
+package queclink
+
+import (
+	"github.com/khiemm/listener/devices/common"
+)
+
+// Position converts the record to the protocol neutral representation.
+// Queclink doesn't report satellites, so only fixes without GPS accuracy
+// are given zero satellites.
+func (r *Record) Position() *common.Position {
+	p := &common.Position{
+		Timestamp:  r.Time,
+		Latitude:   r.Latitude,
+		Longitude:  r.Longitude,
+		Altitude:   r.Altitude,
+		Heading:    r.Azimuth,
+		Speed:      r.Speed,
+		Satellites: common.UnknownSatellites,
+	}
+	if r.Accuracy == 0 {
+		p.Satellites = 0
+	}
+	p.SetAttribute("hdop", r.Accuracy)
+	if r.CellID != "" {
+		p.SetAttribute("cell", map[string]string{
+			"mcc": r.MCC,
+			"mnc": r.MNC,
+			"lac": r.LAC,
+			"id":  r.CellID,
+		})
+	}
+	return p
+}
+
+// Positions converts the records of the message. Records without
+// a GPS time can't be placed and are left out.
+func (m *Message) Positions() []*common.Position {
+	positions := make([]*common.Position, 0, len(m.Records))
+	for _, r := range m.Records {
+		if r.Time.IsZero() {
+			continue
+		}
+		p := r.Position()
+		p.SetAttribute("report", m.Type)
+		if m.Kind == KindBuff {
+			p.SetAttribute("buffered", true)
+		}
+		if m.Mileage > 0 {
+			p.SetAttribute("mileage", m.Mileage)
+		}
+		switch m.Type {
+		case TypeIgnitionOn:
+			p.SetAttribute("ignition", true)
+		case TypeIgnitionOff:
+			p.SetAttribute("ignition", false)
+		}
+		positions = append(positions, p)
+	}
+	return positions
+}
@@ -0,0 +1,130 @@
+package queclink
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// defaultTimeout applies when [devices.queclink] doesn't set a timeout.
+// Devices keeping their connection open send a heartbeat well within it.
+const defaultTimeout = 5 * time.Minute
+
+func init() {
+	common.RegisterProtocol(common.Protocol{
+		Name:          "queclink",
+		NewInteractor: func(s *common.Server) common.Interactor { return &Interactor{} },
+		Detect:        detect,
+	})
+}
+
+// Interactor handles Queclink devices speaking the @Track ASCII protocol
+// over TCP. There is no handshake, every message carries the device IMEI.
+type Interactor struct {
+	// first is the message read by InitializeConnection to learn the IMEI.
+	// It's handed to HandleMessage by the first call of ParseMessage.
+	first *Message
+}
+
+// InitializeConnection reads the first message to identify the device.
+// Messages with a malformed IMEI get the connection closed.
+func (i *Interactor) InitializeConnection(h *common.Handler) (err error) {
+	i.first, err = readMessage(h)
+	if errors.Cause(err) == errInvalidIMEI {
+		return errors.Wrap(common.ErrUnauthorizedDevice, err.Error())
+	}
+	if err != nil {
+		return
+	}
+	h.IMEI = i.first.IMEI
+	h.Log().Debug(h.IMEI)
+	return
+}
+
+// ParseMessage returns the next *Message sent by the device.
+func (i *Interactor) ParseMessage(h *common.Handler) (result interface{}, err error) {
+	if i.first != nil {
+		result, i.first = i.first, nil
+		return
+	}
+	return readMessage(h)
+}
+
+func readMessage(h *common.Handler) (*Message, error) {
+	frame, err := ReadFrame(h.Conn, maxFrameSize())
+	if err != nil {
+		return nil, err
+	}
+	return Parse(frame)
+}
+
+// HandleMessage stores the positions of reports and acknowledges them with
+// a SACK once they're handled. Reports of other types are acknowledged
+// without being stored. Heartbeats are answered right away, other +ACK
+// messages are replies to commands.
+func (_ *Interactor) HandleMessage(h *common.Handler, msg interface{}) (err error) {
+	m, ok := msg.(*Message)
+	if !ok {
+		return nil
+	}
+	if m.IMEI != h.IMEI {
+		h.Log().Warnf("Message IMEI %s doesn't match connection", m.IMEI)
+		return nil
+	}
+
+	if m.Kind == KindAck {
+		if m.Type == TypeHeartbeat {
+			return sendSACK(h, fmt.Sprintf("+SACK:%s,%s,%s$", TypeHeartbeat, m.ProtocolVersion, m.Count))
+		}
+		if !h.ResolveCommand(h.GetLastRawMessage()) {
+			h.Log().Warnf("Unsolicited command acknowledgement: %q", h.GetLastRawMessage())
+		}
+		return nil
+	}
+
+	switch m.Type {
+	case TypeFixed, TypeIgnitionOn, TypeIgnitionOff:
+	default:
+		// Reports without positions are only acknowledged,
+		// so that the device doesn't send them again.
+		h.DebugLog().Debugf("Ignored %s report", m.Type)
+		return sendSACK(h, fmt.Sprintf("+SACK:%s$", m.Count))
+	}
+	// Reports that aren't acknowledged are sent again by the device,
+	// which is what happens when storing fails.
+	return h.SaveAndAcknowledge(m.Positions(), func() error {
+		return sendSACK(h, fmt.Sprintf("+SACK:%s$", m.Count))
+	})
+}
+
+func sendSACK(h *common.Handler, sack string) error {
+	_, err := h.Conn.Write([]byte(sack))
+	return errors.Wrap(err, "couldn't send SACK")
+}
+
+// EncodeCommand sends an AT+GT command, e.g. AT+GTRTO=gv300,1,,,,,,FFFF$,
+// as it is. The device replies with a +ACK message of the same type.
+func (_ *Interactor) EncodeCommand(h *common.Handler, payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func (_ *Interactor) HandleError(h *common.Handler, _ error) (terminate bool) {
+	return true
+}
+
+func (_ *Interactor) GetConnectionTimeout(h common.Handler) time.Duration {
+	return defaultTimeout
+}
+
+func (_ *Interactor) CloseConnection(h common.Handler) (err error) { return nil }
+
+// maxFrameSize returns the configured limit on the length of a message.
+func maxFrameSize() int {
+	if size := viper.GetInt("devices.queclink.max_frame_size"); size > 0 {
+		return size
+	}
+	return DefaultMaxFrameSize
+}
@@ -0,0 +1,75 @@
+package queclink
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+)
+
+// memStore keeps the positions it's given.
+type memStore struct {
+	calls     int
+	positions []*common.Position
+}
+
+func (s *memStore) SavePositions(h *common.Handler, positions []*common.Position) error {
+	s.calls++
+	s.positions = append(s.positions, positions...)
+	return nil
+}
+
+func TestAcknowledgeReports(t *testing.T) {
+	device, conn := net.Pipe()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	store := &memStore{}
+	h := &common.Handler{
+		Name:       "queclink",
+		Conn:       conn,
+		Store:      store,
+		Logger:     logger,
+		Interactor: &Interactor{},
+		Unregister: func() {},
+	}
+	done := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(done)
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tests := []struct {
+		frame string
+		sack  string
+	}{
+		{frameFixed, "+SACK:11F0$"},
+		// Reports without positions are acknowledged without being stored.
+		{frameSOS, "+SACK:11F3$"},
+		{frameHeartbeat, "+SACK:GTHBD,060100,11F4$"},
+		{frameBuffered, "+SACK:002A$"},
+	}
+	for _, tt := range tests {
+		_, err := device.Write([]byte(tt.frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sack := make([]byte, len(tt.sack))
+		_, err = io.ReadFull(device, sack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(sack) != tt.sack {
+			t.Errorf("SACK %q, want %q", sack, tt.sack)
+		}
+	}
+	device.Close()
+	<-done
+	if store.calls != 2 || len(store.positions) != 3 {
+		t.Errorf("stored %d positions in %d calls, want 3 in 2", len(store.positions), store.calls)
+	}
+}
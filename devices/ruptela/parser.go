@@ -0,0 +1,241 @@
+package ruptela
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+// Command IDs sent by devices.
+const (
+	CommandRecords         = 1
+	CommandExtendedRecords = 68
+)
+
+// commandAck is the command ID of the acknowledgement of records.
+const commandAck = 100
+
+// DefaultMaxFrameSize is the largest packet accepted when
+// [devices.ruptela] doesn't set max_frame_size.
+const DefaultMaxFrameSize = 2048
+
+const (
+	// headerSize covers the IMEI and the command ID.
+	headerSize = 9
+	crcSize    = 2
+	// crcPoly gives the CRC-CCITT variant known as Kermit.
+	crcPoly = 0x8408
+)
+
+var (
+	errFrameSize = errors.New("invalid packet length")
+	errCRC       = errors.New("CRC mismatch")
+	errIMEI      = errors.New("invalid IMEI")
+)
+
+// Packet is a single packet sent by a device: the length, the IMEI,
+// the command ID, the payload and a CRC of everything but the length.
+type Packet struct {
+	IMEI    string
+	Command uint8
+	Payload []byte
+}
+
+// Records is the payload of the record commands.
+type Records struct {
+	// Left is set when the device has more records to send.
+	Left    bool
+	Records []*Record
+}
+
+// Record is a single AVL record. Standard records have 1 byte event and
+// IO IDs, extended ones 2 bytes.
+type Record struct {
+	Timestamp uint32
+	// Extension is set when the IO elements of a record were split
+	// in several ones, extended records only.
+	Extension uint8
+	Priority  uint8
+	Longitude int32
+	Latitude  int32
+	// Altitude is in tenths of a meter.
+	Altitude int16
+	// Angle is in hundredths of a degree.
+	Angle      uint16
+	Satellites uint8
+	Speed      uint16
+	// HDOP is in tenths.
+	HDOP  uint8
+	Event uint16
+	IO    []IO
+}
+
+// continues tells whether the record only carries more IO elements
+// of the previous one. The high nibble of the extension is the number of
+// records the IO elements were split into, the low one the index.
+func (r *Record) continues() bool {
+	part := r.Extension & 0x0F
+	return part > 0 && part <= r.Extension>>4
+}
+
+// IO is a single IO element.
+type IO struct {
+	ID    uint16
+	Value []byte
+}
+
+// detect tells whether head starts a packet. The length is followed by
+// the IMEI as a 64 bit number, whose top bytes are zero or close to it.
+func detect(head []byte) bool {
+	return len(head) >= 4 && int(binary.BigEndian.Uint16(head)) >= headerSize &&
+		head[2] == 0 && head[3] <= 0x03
+}
+
+// ReadPacket reads a single packet from r and checks its CRC.
+func ReadPacket(r io.Reader, maxSize int) (p *Packet, err error) {
+	var length uint16
+	err = binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet length read failed")
+	}
+	if int(length) < headerSize || int(length) > maxSize {
+		return nil, errors.Wrapf(errFrameSize, "%d", length)
+	}
+	buf := make([]byte, int(length)+crcSize)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet body read failed")
+	}
+	body := buf[:length]
+	crc := binary.BigEndian.Uint16(buf[length:])
+	if expected := util.Crc16(body, crcPoly); crc != expected {
+		return nil, errors.Wrapf(errCRC, "got %04x, expected %04x", crc, expected)
+	}
+
+	imei := strconv.FormatUint(binary.BigEndian.Uint64(body), 10)
+	if !util.ValidIMEI(imei) {
+		return nil, errors.Wrapf(errIMEI, "%q", imei)
+	}
+	return &Packet{
+		IMEI:    imei,
+		Command: body[8],
+		Payload: body[headerSize:],
+	}, nil
+}
+
+// Decode returns the *Records carried by record commands.
+// Other packets are returned as they are.
+func (p *Packet) Decode() (interface{}, error) {
+	switch p.Command {
+	case CommandRecords, CommandExtendedRecords:
+		return decodeRecords(p.Payload, p.Command == CommandExtendedRecords)
+	}
+	return p, nil
+}
+
+func decodeRecords(payload []byte, extended bool) (*Records, error) {
+	d := &decoder{buf: payload}
+	rs := &Records{Left: d.uint8() != 0}
+	count := int(d.uint8())
+	for i := 0; i < count && d.err == nil; i++ {
+		r := &Record{Timestamp: d.uint32()}
+		d.uint8() // timestamp extension
+		if extended {
+			r.Extension = d.uint8()
+		}
+		r.Priority = d.uint8()
+		r.Longitude = int32(d.uint32())
+		r.Latitude = int32(d.uint32())
+		r.Altitude = int16(d.uint16())
+		r.Angle = d.uint16()
+		r.Satellites = d.uint8()
+		r.Speed = d.uint16()
+		r.HDOP = d.uint8()
+		if extended {
+			r.Event = d.uint16()
+		} else {
+			r.Event = uint16(d.uint8())
+		}
+		// IO elements come in groups by value size.
+		for _, size := range []int{1, 2, 4, 8} {
+			n := int(d.uint8())
+			for j := 0; j < n && d.err == nil; j++ {
+				e := IO{}
+				if extended {
+					e.ID = d.uint16()
+				} else {
+					e.ID = uint16(d.uint8())
+				}
+				e.Value = append([]byte(nil), d.take(size)...)
+				r.IO = append(r.IO, e)
+			}
+		}
+		if n := len(rs.Records); n > 0 && r.continues() {
+			rs.Records[n-1].IO = append(rs.Records[n-1].IO, r.IO...)
+			continue
+		}
+		rs.Records = append(rs.Records, r)
+	}
+	if d.err != nil {
+		return nil, errors.Wrapf(d.err, "%d records", count)
+	}
+	return rs, nil
+}
+
+// EncodeAck builds the positive or negative acknowledgement of records.
+func EncodeAck(positive bool) []byte {
+	b := []byte{0, 2, commandAck, 0, 0, 0}
+	if positive {
+		b[3] = 1
+	}
+	binary.BigEndian.PutUint16(b[4:], util.Crc16(b[2:4], crcPoly))
+	return b
+}
+
+// decoder reads big endian values from buf. Once a read runs past
+// the end of buf, err is set and every following read returns zero.
+type decoder struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.buf)-d.off {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
@@ -0,0 +1,187 @@
+package ruptela
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+// Packets of a device with IMEI 356307042441013.
+const (
+	// packetRecords carries two standard records, the first one with
+	// IO elements 1 and 2 of 1 byte and 29 of 2 bytes.
+	packetRecords = "00480001440f32b217350100025f1d8b4000000f11604820989ac004d2232809003208050201010200011d3039" +
+		"00005f1d8b7c00000f116c002098ba00ffec46500000000000000000001623"
+	// packetExtended carries an extended record split in two, with IO
+	// element 409 of 1 byte in the first part and 197 of 8 bytes in
+	// the second one. More records are left.
+	packetExtended = "00520001440f32b217354401025f1d8b400020010f11604820989ac003e8000007001e0c019901019901000000" +
+		"5f1d8b400021010f11604820989ac003e8000007001e0c01990000000100c500000000075bcd15f817"
+	// packetCommand is a packet of another command.
+	packetCommand = "000a0001440f32b217350f01197e"
+	// packetOtherIMEI is an empty records packet of IMEI 353288040073284.
+	packetOtherIMEI = "000b000141504821c8440100000e41"
+	// packetBadIMEI is an empty records packet of IMEI 356307042441014,
+	// which fails the check digit.
+	packetBadIMEI = "000b0001440f32b21736010000b6ee"
+)
+
+func mustDecodeHex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decode(t *testing.T, packet string) interface{} {
+	p, err := ReadPacket(bytes.NewReader(mustDecodeHex(t, packet)), DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestCrcKermit(t *testing.T) {
+	if crc := util.Crc16([]byte("123456789"), crcPoly); crc != 0x2189 {
+		t.Errorf("CRC-16/KERMIT %04x, want 2189", crc)
+	}
+}
+
+func TestEncodeAck(t *testing.T) {
+	// The acknowledgements of the protocol description.
+	if got := hex.EncodeToString(EncodeAck(true)); got != "0002640113bc" {
+		t.Errorf("positive ack %s", got)
+	}
+	if got := hex.EncodeToString(EncodeAck(false)); got != "000264000235" {
+		t.Errorf("negative ack %s", got)
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	// Packets are read one after another from a stream.
+	r := bytes.NewReader(mustDecodeHex(t, packetCommand+packetRecords))
+	p, err := ReadPacket(r, DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.IMEI != "356307042441013" || p.Command != 15 || !bytes.Equal(p.Payload, []byte{1}) {
+		t.Errorf("packet %+v", p)
+	}
+	p, err = ReadPacket(r, DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Command != CommandRecords || len(p.Payload) != 0x48-headerSize {
+		t.Errorf("packet of command %d with %d bytes", p.Command, len(p.Payload))
+	}
+	if _, err = ReadPacket(r, DefaultMaxFrameSize); errors.Cause(err) != io.EOF {
+		t.Errorf("error %v at the end", err)
+	}
+}
+
+func TestReadPacketMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		maxSize int
+		err     error
+	}{
+		{"length below header", "0008" + packetCommand[4:], DefaultMaxFrameSize, errFrameSize},
+		{"length above limit", packetRecords, 0x47, errFrameSize},
+		{"CRC", packetCommand[:len(packetCommand)-2] + "7f", DefaultMaxFrameSize, errCRC},
+		{"truncated", packetRecords[:len(packetRecords)-6], DefaultMaxFrameSize, io.ErrUnexpectedEOF},
+		{"IMEI", packetBadIMEI, DefaultMaxFrameSize, errIMEI},
+	}
+	for _, tt := range tests {
+		_, err := ReadPacket(bytes.NewReader(mustDecodeHex(t, tt.packet)), tt.maxSize)
+		if errors.Cause(err) != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDecodeRecords(t *testing.T) {
+	rs, ok := decode(t, packetRecords).(*Records)
+	if !ok {
+		t.Fatal("not records")
+	}
+	if rs.Left || len(rs.Records) != 2 {
+		t.Fatalf("records %+v", rs)
+	}
+	r := rs.Records[0]
+	want := &Record{
+		Timestamp:  0x5f1d8b40,
+		Longitude:  252797000,
+		Latitude:   546872000,
+		Altitude:   1234,
+		Angle:      9000,
+		Satellites: 9,
+		Speed:      50,
+		HDOP:       8,
+		Event:      5,
+		IO:         []IO{{1, []byte{1}}, {2, []byte{0}}, {29, []byte{0x30, 0x39}}},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("record %+v, want %+v", r, want)
+	}
+
+	p := r.Position()
+	if !p.Timestamp.Equal(time.Unix(0x5f1d8b40, 0)) || p.Speed != 50 || p.Heading != 90 || p.Satellites != 9 || p.EventID != 5 {
+		t.Errorf("position %+v", p)
+	}
+	if math.Abs(p.Latitude-54.6872) > 1e-7 || math.Abs(p.Longitude-25.2797) > 1e-7 || math.Abs(p.Altitude-123.4) > 1e-9 {
+		t.Errorf("position at %f,%f,%f", p.Latitude, p.Longitude, p.Altitude)
+	}
+	if p.Attributes["hdop"] != 0.8 || !bytes.Equal(p.IO[29], []byte{0x30, 0x39}) {
+		t.Errorf("attributes %v, IO %v", p.Attributes, p.IO)
+	}
+	if p := rs.Records[1].Position(); p.Altitude != -2 || p.Heading != 180 || len(p.IO) != 0 {
+		t.Errorf("second position %+v", p)
+	}
+}
+
+func TestDecodeExtendedRecords(t *testing.T) {
+	rs, ok := decode(t, packetExtended).(*Records)
+	if !ok {
+		t.Fatal("not records")
+	}
+	// The second part only carries more IO elements of the first one.
+	if !rs.Left || len(rs.Records) != 1 {
+		t.Fatalf("records %+v", rs)
+	}
+	r := rs.Records[0]
+	if r.Extension != 0x20 || r.Priority != 1 || r.Event != 409 || r.Speed != 30 || r.HDOP != 12 {
+		t.Errorf("record %+v", r)
+	}
+	want := []IO{{409, []byte{1}}, {197, []byte{0, 0, 0, 0, 7, 0x5b, 0xcd, 0x15}}}
+	if !reflect.DeepEqual(r.IO, want) {
+		t.Errorf("IO %v, want %v", r.IO, want)
+	}
+}
+
+func TestDecodeTruncatedRecords(t *testing.T) {
+	for name, packet := range map[string]string{"standard": packetRecords, "extended": packetExtended} {
+		p, err := ReadPacket(bytes.NewReader(mustDecodeHex(t, packet)), DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(p.Payload); n++ {
+			truncated := &Packet{IMEI: p.IMEI, Command: p.Command, Payload: p.Payload[:n]}
+			if _, err = truncated.Decode(); errors.Cause(err) != io.ErrUnexpectedEOF {
+				t.Errorf("%s: %d bytes decoded with error %v", name, n, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package ruptela
+
+import (
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+)
+
+// Position converts the record to the protocol neutral representation.
+func (r *Record) Position() *common.Position {
+	p := &common.Position{
+		Timestamp:  time.Unix(int64(r.Timestamp), 0).UTC(),
+		Latitude:   float64(r.Latitude) / 10000000,
+		Longitude:  float64(r.Longitude) / 10000000,
+		Altitude:   float64(r.Altitude) / 10,
+		Heading:    float64(r.Angle) / 100,
+		Speed:      float64(r.Speed),
+		Satellites: int(r.Satellites),
+		Priority:   int(r.Priority),
+		EventID:    int(r.Event),
+		IO:         make(map[uint16][]byte, len(r.IO)),
+	}
+	for _, io := range r.IO {
+		p.IO[io.ID] = io.Value
+	}
+	p.SetAttribute("hdop", float64(r.HDOP)/10)
+	return p
+}
+
+// Positions converts the records of a packet.
+func (rs *Records) Positions() []*common.Position {
+	positions := make([]*common.Position, len(rs.Records))
+	for i, r := range rs.Records {
+		positions[i] = r.Position()
+	}
+	return positions
+}
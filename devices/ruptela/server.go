@@ -0,0 +1,94 @@
+package ruptela
+
+import (
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// defaultTimeout applies when [devices.ruptela] doesn't set a timeout.
+const defaultTimeout = 2 * time.Minute
+
+func init() {
+	common.RegisterProtocol(common.Protocol{
+		Name:          "ruptela",
+		NewInteractor: func(s *common.Server) common.Interactor { return &Interactor{} },
+		Detect:        detect,
+	})
+}
+
+// Interactor handles Ruptela devices over TCP. There is no handshake,
+// every packet carries the device IMEI.
+type Interactor struct {
+	// first is the packet read by InitializeConnection to learn the IMEI.
+	// It's handed to HandleMessage by the first call of ParseMessage.
+	first *Packet
+}
+
+// InitializeConnection reads the first packet to identify the device.
+// Packets with a malformed IMEI get the connection closed.
+func (i *Interactor) InitializeConnection(h *common.Handler) (err error) {
+	i.first, err = ReadPacket(h.Conn, maxFrameSize())
+	if errors.Cause(err) == errIMEI {
+		return errors.Wrap(common.ErrUnauthorizedDevice, err.Error())
+	}
+	if err != nil {
+		return
+	}
+	h.IMEI = i.first.IMEI
+	h.Log().Debug(h.IMEI)
+	return
+}
+
+// ParseMessage returns the next packet sent by the device,
+// see Packet.Decode.
+func (i *Interactor) ParseMessage(h *common.Handler) (result interface{}, err error) {
+	p := i.first
+	i.first = nil
+	if p == nil {
+		p, err = ReadPacket(h.Conn, maxFrameSize())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.IMEI != h.IMEI {
+		return nil, errors.Errorf("packet IMEI %s doesn't match connection", p.IMEI)
+	}
+	return p.Decode()
+}
+
+// HandleMessage stores records and acknowledges them. A negative
+// acknowledgement is sent by HandleError when they couldn't be stored.
+func (_ *Interactor) HandleMessage(h *common.Handler, msg interface{}) (err error) {
+	switch m := msg.(type) {
+	case *Records:
+		return h.SaveAndAcknowledge(m.Positions(), func() error {
+			_, err := h.Conn.Write(EncodeAck(true))
+			return err
+		})
+	case *Packet:
+		h.DebugLog().Debugf("Ignored command %d", m.Command)
+	}
+	return nil
+}
+
+func (_ *Interactor) HandleError(h *common.Handler, _ error) (terminate bool) {
+	h.Conn.Write(EncodeAck(false))
+	return true
+}
+
+func (_ *Interactor) GetConnectionTimeout(h common.Handler) time.Duration {
+	return defaultTimeout
+}
+
+func (_ *Interactor) CloseConnection(h common.Handler) (err error) { return nil }
+
+// maxFrameSize returns the configured limit on the size of a single packet.
+func maxFrameSize() int {
+	if size := viper.GetInt("devices.ruptela.max_frame_size"); size > 0 {
+		return size
+	}
+	return DefaultMaxFrameSize
+}
@@ -0,0 +1,132 @@
+package ruptela
+
+import (
+	"encoding/hex"
+	goerr "errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+)
+
+const (
+	ackPositive = "0002640113bc"
+	ackNegative = "000264000235"
+)
+
+// memStore keeps the positions it's given, or fails with err.
+type memStore struct {
+	positions []*common.Position
+	err       error
+}
+
+func (s *memStore) SavePositions(h *common.Handler, positions []*common.Position) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.positions = append(s.positions, positions...)
+	return nil
+}
+
+// serve runs a handler of the Ruptela interactor on one end of a pipe
+// and returns the other end, the device.
+func serve(t *testing.T, store common.Store) (device net.Conn, done <-chan struct{}) {
+	device, conn := net.Pipe()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	h := &common.Handler{
+		Name:       "ruptela",
+		Conn:       conn,
+		Store:      store,
+		Logger:     logger,
+		Interactor: &Interactor{},
+		Unregister: func() {},
+	}
+	d := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(d)
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+	return device, d
+}
+
+// exchange sends a packet and checks the response, if one is expected.
+func exchange(t *testing.T, device net.Conn, packet, want string) {
+	_, err := device.Write(mustDecodeHex(t, packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want == "" {
+		return
+	}
+	response := make([]byte, len(want)/2)
+	_, err = io.ReadFull(device, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(response); got != want {
+		t.Errorf("response %s, want %s", got, want)
+	}
+}
+
+// closed checks that the connection of device was closed by the server.
+func closed(t *testing.T, device net.Conn, done <-chan struct{}) {
+	if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after refusal: %v", err)
+	}
+	<-done
+}
+
+func TestAcknowledgeRecords(t *testing.T) {
+	store := &memStore{}
+	device, done := serve(t, store)
+	// The first packet, read to identify the device, is handled too.
+	exchange(t, device, packetRecords, ackPositive)
+	// Other commands aren't answered.
+	exchange(t, device, packetCommand, "")
+	exchange(t, device, packetExtended, ackPositive)
+	device.Close()
+	<-done
+
+	if len(store.positions) != 3 {
+		t.Fatalf("stored %d positions, want 3", len(store.positions))
+	}
+	if p := store.positions[2]; p.EventID != 409 || len(p.IO) != 2 {
+		t.Errorf("extended position event %d, IO %v", p.EventID, p.IO)
+	}
+}
+
+func TestNegativeAcknowledgement(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   *memStore
+		packets []string
+	}{
+		{"store failure", &memStore{err: goerr.New("database down")}, []string{packetRecords}},
+		{"IMEI mismatch", &memStore{}, []string{packetCommand, packetOtherIMEI}},
+		{"CRC", &memStore{}, []string{packetCommand, packetCommand[:len(packetCommand)-2] + "7f"}},
+	}
+	for _, tt := range tests {
+		device, done := serve(t, tt.store)
+		for _, packet := range tt.packets[:len(tt.packets)-1] {
+			exchange(t, device, packet, "")
+		}
+		exchange(t, device, tt.packets[len(tt.packets)-1], ackNegative)
+		closed(t, device, done)
+		if len(tt.store.positions) != 0 {
+			t.Errorf("%s: stored %d positions", tt.name, len(tt.store.positions))
+		}
+	}
+}
+
+func TestRefuseInvalidIMEI(t *testing.T) {
+	device, done := serve(t, &memStore{})
+	// The packet isn't acknowledged and the connection is closed.
+	exchange(t, device, packetBadIMEI, "")
+	closed(t, device, done)
+}
@@ -0,0 +1,132 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+// ioBeacon is the Codec 8E variable length IO element
+// carrying the list of visible BLE beacons.
+const ioBeacon uint16 = 385
+
+// Beacon flag bits, sent before every beacon in the list.
+const (
+	beaconFlagRSSI        uint8 = 0x01
+	beaconFlagBattery     uint8 = 0x02
+	beaconFlagTemperature uint8 = 0x04
+	beaconFlagIBeacon     uint8 = 0x20
+)
+
+var errBeaconTruncated = errors.New("Beacon data truncated")
+
+type BeaconType uint8
+
+const (
+	Eddystone BeaconType = iota
+	IBeacon
+)
+
+func (t BeaconType) String() string {
+	if t == IBeacon {
+		return "iBeacon"
+	}
+	return "Eddystone"
+}
+
+// Beacon is a single BLE beacon observed by the device.
+type Beacon struct {
+	Type BeaconType
+	// UUID, Major and Minor identify an iBeacon.
+	UUID  string
+	Major uint16
+	Minor uint16
+	// Namespace and Instance identify an Eddystone beacon.
+	Namespace string
+	Instance  string
+	// RSSI is valid when HasRSSI is set.
+	RSSI    int8
+	HasRSSI bool
+	// BatteryVoltage in mV, if the beacon reports it.
+	BatteryVoltage *uint16
+	// Temperature in °C, if the beacon reports it.
+	Temperature *float64
+}
+
+// ParseBeacons decodes the value of IO element 385. The value starts with
+// a byte holding the index and the total number of beacon packets in its
+// high and low nibble, followed by the beacons. Each beacon is a flags byte,
+// its identifier (20 bytes for iBeacon, 16 for Eddystone) and the RSSI,
+// battery voltage and temperature fields enabled by the flags.
+func ParseBeacons(data []byte) (beacons []Beacon, err error) {
+	if len(data) < 1 {
+		return nil, errBeaconTruncated
+	}
+	off := 1
+	for off < len(data) {
+		flags := data[off]
+		off++
+
+		b := Beacon{}
+		if flags&beaconFlagIBeacon != 0 {
+			if len(data)-off < 20 {
+				return nil, errBeaconTruncated
+			}
+			b.Type = IBeacon
+			b.UUID = formatUUID(data[off : off+16])
+			b.Major = binary.BigEndian.Uint16(data[off+16:])
+			b.Minor = binary.BigEndian.Uint16(data[off+18:])
+			off += 20
+		} else {
+			if len(data)-off < 16 {
+				return nil, errBeaconTruncated
+			}
+			b.Type = Eddystone
+			b.Namespace = hex.EncodeToString(data[off : off+10])
+			b.Instance = hex.EncodeToString(data[off+10 : off+16])
+			off += 16
+		}
+
+		if flags&beaconFlagRSSI != 0 {
+			if len(data)-off < 1 {
+				return nil, errBeaconTruncated
+			}
+			b.RSSI = int8(data[off])
+			b.HasRSSI = true
+			off++
+		}
+		if flags&beaconFlagBattery != 0 {
+			if len(data)-off < 2 {
+				return nil, errBeaconTruncated
+			}
+			voltage := binary.BigEndian.Uint16(data[off:])
+			b.BatteryVoltage = &voltage
+			off += 2
+		}
+		if flags&beaconFlagTemperature != 0 {
+			if len(data)-off < 2 {
+				return nil, errBeaconTruncated
+			}
+			temperature := float64(int16(binary.BigEndian.Uint16(data[off:]))) / 100
+			b.Temperature = &temperature
+			off += 2
+		}
+		beacons = append(beacons, b)
+	}
+	return beacons, nil
+}
+
+func formatUUID(b []byte) string {
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:36], b[10:16])
+	return string(s[:])
+}
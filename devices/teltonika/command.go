@@ -0,0 +1,53 @@
+package teltonika
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+var errUnexpectedMessageType = errors.New("Unexpected Codec 12 message type")
+
+const (
+	codec12 uint8 = 0x0C
+
+	typeCommand  uint8 = 0x05
+	typeResponse uint8 = 0x06
+)
+
+// Response is a Codec 12 reply sent by the device to a GPRS command.
+type Response struct {
+	Payload []byte
+}
+
+// EncodeCommand builds a Codec 12 frame carrying a single GPRS command,
+// e.g. "getinfo" or "setdigout 1".
+func EncodeCommand(command []byte) []byte {
+	body := new(bytes.Buffer)
+	body.WriteByte(codec12)
+	body.WriteByte(1)
+	body.WriteByte(typeCommand)
+	binary.Write(body, binary.BigEndian, uint32(len(command)))
+	body.Write(command)
+	body.WriteByte(1)
+	return wrapFrame(body.Bytes())
+}
+
+func (d *decoder) response() (resp *Response, err error) {
+	msgType := d.uint8()
+	size := d.uint32()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "read failed")
+	}
+	if msgType != typeResponse {
+		return nil, errUnexpectedMessageType
+	}
+	payload := d.take(int(size))
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "response read failed")
+	}
+	resp = &Response{Payload: make([]byte, len(payload))}
+	copy(resp.Payload, payload)
+	return
+}
@@ -0,0 +1,182 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var errIOCount = errors.New("IO element count exceeds the remaining data")
+
+const (
+	tcpHeaderSize = 8
+	footerSize    = 4
+)
+
+// framePool recycles the buffers frames are read into.
+// Decoded records never point into them.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1280)
+		return &b
+	},
+}
+
+// decoder reads big endian values from buf. Once a read runs past
+// the end of buf, err is set and every following read returns zero.
+type decoder struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf)-d.off {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// remaining returns the number of bytes left to read.
+func (d *decoder) remaining() int {
+	return len(d.buf) - d.off
+}
+
+// gpsElement reads the GPS element shared by all AVL codecs.
+func (d *decoder) gpsElement() (lon, lat int32, alt int16, angle uint16, sats uint8, speed uint16) {
+	lon = int32(d.uint32())
+	lat = int32(d.uint32())
+	alt = int16(d.uint16())
+	angle = d.uint16()
+	sats = d.uint8()
+	speed = d.uint16()
+	return
+}
+
+// ioLayout describes how the IO groups of a codec are encoded. Groups
+// hold 1, 2, 4 and 8 byte values in this order, optionally followed
+// by a group of length prefixed values.
+type ioLayout struct {
+	countSize int
+	idSize    int
+	variable  bool
+}
+
+var (
+	layout8  = ioLayout{countSize: 1, idSize: 1}
+	layout8e = ioLayout{countSize: 2, idSize: 2, variable: true}
+	layout16 = ioLayout{countSize: 1, idSize: 2}
+)
+
+func (l ioLayout) groups() int {
+	if l.variable {
+		return 5
+	}
+	return 4
+}
+
+func (d *decoder) sized(size int) int {
+	if size == 1 {
+		return int(d.uint8())
+	}
+	return int(d.uint16())
+}
+
+// scanIO walks the IO groups at the current offset without consuming
+// them and returns the number of elements and the size of their values.
+// Element counts that can't fit in the remaining data fail the scan
+// before any element is walked.
+func (d *decoder) scanIO(l ioLayout) (count, size int) {
+	scan := *d
+	for g := 0; g < l.groups(); g++ {
+		n := scan.sized(l.countSize)
+		minSize := l.idSize + 1<<uint(g)
+		if g == 4 {
+			minSize = l.idSize + 2
+		}
+		if scan.err == nil && n*minSize > scan.remaining() {
+			scan.err = errIOCount
+		}
+		for j := 0; j < n && scan.err == nil; j++ {
+			scan.take(l.idSize)
+			length := 1 << uint(g)
+			if g == 4 {
+				length = int(scan.uint16())
+			}
+			scan.take(length)
+			count++
+			size += length
+		}
+	}
+	d.err = scan.err
+	return
+}
+
+// readIO consumes the IO groups at the current offset and passes every
+// element to emit, telling whether it came from the variable length group.
+// Values are copied into a single buffer of the given size, as returned
+// by scanIO.
+func (d *decoder) readIO(l ioLayout, size int, emit func(id uint16, value []byte, variable bool)) {
+	if d.err != nil {
+		return
+	}
+	values := make([]byte, size)
+	for g := 0; g < l.groups(); g++ {
+		n := d.sized(l.countSize)
+		for j := 0; j < n && d.err == nil; j++ {
+			id := uint16(d.sized(l.idSize))
+			length := 1 << uint(g)
+			if g == 4 {
+				length = int(d.uint16())
+			}
+			raw := d.take(length)
+			if raw == nil {
+				return
+			}
+			value := values[:length:length]
+			values = values[length:]
+			copy(value, raw)
+			emit(id, value, g == 4)
+		}
+	}
+}
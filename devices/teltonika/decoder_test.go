@@ -0,0 +1,213 @@
+package teltonika
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+// sampleFrames are the frames of pkg/teltonika and the examples of the
+// Teltonika protocol documentation.
+var sampleFrames = []struct {
+	name  string
+	frame string
+}{
+	{"codec 8", "000000000000003608010000016B40D8EA30010000000000000000000000000000000105021503010101425E0F01F10000601A014E0000000000000000010000C7CF"},
+	{"codec 8 two records", "000000000000004308020000016B40D57B480100000000000000000000000000000001010101000000000000016B40D5C198010000000000000000000000000000000101010101000000020000252C"},
+	{"codec 8E", "000000000000004A8E010000016B412CEE000100000000000000000000000000000000010005000100010100010011001D00010010015E2C880002000B000000003544C87A000E000000001DD7E06A00000100002994"},
+	{"codec 8E beacons", "000000000000005A8E010000016B69B0C9510000000000000000000000000000000001810001000000000000000000010181002D11216B817F8A274D4FBDB62D33E1842F8DF8014D022BBF21A579723675064DC396A7C3520129F61900000000BF0100003E5D"},
+	{"codec 16", "000000000000005F10020000016BDBC7833000000000000000000000000000000000000B05040200010000030002000B00270042563A00000000016BDBC7871800000000000000000000000000000000000B05040200010000030002000B00260042563A00000200005FB3"},
+	{"codec 12", "00000000000000900C010600000088494E493A323031392F372F323220373A3232205254433A323031392F372F323220373A3533205253543A32204552523A312053523A302042523A302043463A302046473A3020464C3A302054553A302F302055543A3020534D533A30204E4F4750533A303A3330204750533A31205341543A302052533A332052463A36352053463A31204D443A30010000C78F"},
+}
+
+func TestParseMatchesLegacyParser(t *testing.T) {
+	for _, s := range sampleFrames {
+		frame := mustDecodeHex(t, s.frame)
+		want, err := legacyParse(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("%s: legacy parser: %v", s.name, err)
+		}
+		got, err := Parse(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", s.name, got, want)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	benchmarkParse(b, Parse)
+}
+
+// BenchmarkParseLegacy measures the binary.Read parser Parse replaced.
+func BenchmarkParseLegacy(b *testing.B) {
+	benchmarkParse(b, legacyParse)
+}
+
+func benchmarkParse(b *testing.B, parse func(io.Reader) (interface{}, error)) {
+	frames := make([][]byte, len(sampleFrames))
+	size := 0
+	for i, s := range sampleFrames {
+		frames[i] = mustDecodeHex(b, s.frame)
+		size += len(frames[i])
+	}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, frame := range frames {
+			if _, err := parse(bytes.NewReader(frame)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// legacyParse is the parser Parse replaced, which reads every field with
+// binary.Read. Decoding variable length IO elements is left to decodeIO,
+// which both share.
+func legacyParse(r io.Reader) (records interface{}, err error) {
+	var tcph tcpHeader
+	err = binary.Read(r, binary.BigEndian, &tcph)
+	if err != nil {
+		return nil, errors.Wrap(err, "TCP header read failed")
+	}
+	if tcph.Zeros != 0 {
+		return nil, errTcpHeader
+	}
+	avl := make([]byte, tcph.DataLen)
+	_, err = io.ReadFull(r, avl)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet body read failed")
+	}
+	var crc uint32
+	err = binary.Read(r, binary.BigEndian, &crc)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet footer read failed")
+	}
+	if uint32(util.Crc16(avl, 0xA001)) != crc {
+		return nil, errChecksumMismatch
+	}
+
+	buf := bytes.NewReader(avl[:len(avl)-1])
+	var ph packetHeader
+	err = binary.Read(buf, binary.BigEndian, &ph)
+	if err != nil {
+		return nil, errors.Wrap(err, "packet header parsing failed")
+	}
+	switch ph.Codec {
+	case codec8:
+		rs := make([]*Record, ph.Count)
+		for i := range rs {
+			rs[i] = new(Record)
+			err = binary.Read(buf, binary.BigEndian, &rs[i].dataRecord)
+			if err == nil {
+				rs[i].IO = []ioRecord{}
+				err = legacyIO(buf, 4, new(uint8), new(uint8), func(id uint16, value []byte, _ bool) {
+					rs[i].IO = append(rs[i].IO, ioRecord{ID: uint8(id), Value: value})
+				})
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rs, nil
+	case codec16:
+		rs := make([]*Record16, ph.Count)
+		for i := range rs {
+			rs[i] = new(Record16)
+			err = binary.Read(buf, binary.BigEndian, &rs[i].dataRecord16)
+			if err == nil {
+				rs[i].IO = []ioRecord8e{}
+				err = legacyIO(buf, 4, new(uint8), new(uint16), func(id uint16, value []byte, _ bool) {
+					rs[i].IO = append(rs[i].IO, ioRecord8e{ID: id, Value: value})
+				})
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rs, nil
+	case codec12:
+		rs := make([]*Response, ph.Count)
+		for i := range rs {
+			var header struct {
+				Type uint8
+				Size uint32
+			}
+			err = binary.Read(buf, binary.BigEndian, &header)
+			if err != nil {
+				return nil, err
+			}
+			rs[i] = &Response{Payload: make([]byte, header.Size)}
+			_, err = io.ReadFull(buf, rs[i].Payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rs, nil
+	}
+	rs := make([]*Record8e, ph.Count)
+	for i := range rs {
+		rs[i] = new(Record8e)
+		err = binary.Read(buf, binary.BigEndian, &rs[i].dataRecord8e)
+		if err == nil {
+			rs[i].IO = []ioRecord8e{}
+			err = legacyIO(buf, 5, new(uint16), new(uint16), func(id uint16, value []byte, variable bool) {
+				rs[i].IO = append(rs[i].IO, ioRecord8e{ID: id, Value: value, variable: variable})
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		rs[i].decodeIO()
+	}
+	return rs, nil
+}
+
+// legacyIO reads IO groups the way the legacy parser did, with count and
+// id pointing at a uint8 or a uint16 depending on the codec.
+func legacyIO(r io.Reader, groups int, count, id interface{}, emit func(id uint16, value []byte, variable bool)) error {
+	value := func(v interface{}) int {
+		if n, ok := v.(*uint8); ok {
+			return int(*n)
+		}
+		return int(*v.(*uint16))
+	}
+	for i := 0; i < groups; i++ {
+		err := binary.Read(r, binary.BigEndian, count)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < value(count); j++ {
+			err = binary.Read(r, binary.BigEndian, id)
+			if err != nil {
+				return errors.Wrap(err, "IO id read failed")
+			}
+			length := int(math.Pow(float64(2), float64(i)))
+			if i == 4 {
+				var valueLength uint16
+				err = binary.Read(r, binary.BigEndian, &valueLength)
+				if err != nil {
+					return errors.Wrap(err, "IO value length read failed")
+				}
+				length = int(valueLength)
+			}
+			data := make([]byte, length)
+			err = binary.Read(r, binary.BigEndian, &data)
+			if err != nil {
+				return errors.Wrap(err, "IO value read failed")
+			}
+			emit(uint16(value(id)), data, i == 4)
+		}
+	}
+	return nil
+}
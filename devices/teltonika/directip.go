@@ -0,0 +1,192 @@
+package teltonika
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Iridium SBD DirectIP information element identifiers.
+const (
+	directIPProtocolRevision uint8 = 1
+
+	ieiMOHeader       uint8 = 0x01
+	ieiMOPayload      uint8 = 0x02
+	ieiMOLocation     uint8 = 0x03
+	ieiMOConfirmation uint8 = 0x05
+)
+
+const (
+	// moHeaderLength is the length of the MO header information element.
+	moHeaderLength = 28
+	// directIPHeadLength covers the DirectIP header and the IEI
+	// and length of the MO header that follows it.
+	directIPHeadLength = 6
+)
+
+var errDirectIPHeader = errors.New("Malformed DirectIP header")
+
+type directIPHeader struct {
+	Protocol      uint8
+	MessageLength uint16
+}
+
+type informationElement struct {
+	IEI    uint8
+	Length uint16
+}
+
+type moHeader struct {
+	CDRRef        uint32
+	IMEI          [15]byte
+	SessionStatus uint8
+	MOMSN         uint16
+	MTMSN         uint16
+	SessionTime   uint32
+}
+
+type moLocation struct {
+	Flags       uint8
+	LatDegrees  uint8
+	LatMinutes  uint16
+	LonDegrees  uint8
+	LonMinutes  uint16
+	CEPRadiusKm uint32
+}
+
+// MOHeader is the mobile-originated header of a DirectIP message.
+type MOHeader struct {
+	CDRRef uint32
+	IMEI   string
+	// SessionStatus is 0 when the SBD session completed successfully.
+	SessionStatus uint8
+	MOMSN         uint16
+	MTMSN         uint16
+	SessionTime   time.Time
+}
+
+// MOLocation is the approximate position of the transceiver as
+// estimated by the Iridium network.
+type MOLocation struct {
+	Latitude  float64
+	Longitude float64
+	CEPRadius uint32
+}
+
+// DirectIPMessage is a mobile-originated message delivered by the
+// Iridium gateway. The payload holds TSM232 records.
+type DirectIPMessage struct {
+	Header   MOHeader
+	Location *MOLocation
+	Payload  []byte
+}
+
+// ParseDirectIP reads a complete mobile-originated DirectIP message from r.
+// Unknown information elements are skipped.
+func ParseDirectIP(r io.Reader) (msg *DirectIPMessage, err error) {
+	dh := directIPHeader{}
+	err = binary.Read(r, binary.BigEndian, &dh)
+	if err != nil {
+		return nil, errors.Wrap(err, "DirectIP header read failed")
+	}
+	if dh.Protocol != directIPProtocolRevision {
+		return nil, errDirectIPHeader
+	}
+	body := make([]byte, dh.MessageLength)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "DirectIP message read failed")
+	}
+
+	msg = new(DirectIPMessage)
+	headerFound := false
+	buf := bytes.NewReader(body)
+	for buf.Len() > 0 {
+		ie := informationElement{}
+		err = binary.Read(buf, binary.BigEndian, &ie)
+		if err != nil {
+			return nil, errors.Wrap(err, "information element read failed")
+		}
+		if int(ie.Length) > buf.Len() {
+			return nil, errors.Errorf("information element 0x%02x exceeds the message", ie.IEI)
+		}
+		data := make([]byte, ie.Length)
+		_, err = io.ReadFull(buf, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "information element 0x%02x read failed", ie.IEI)
+		}
+
+		switch ie.IEI {
+		case ieiMOHeader:
+			msg.Header, err = parseMOHeader(data)
+			if err != nil {
+				return nil, errors.Wrap(err, "MO header parsing failed")
+			}
+			headerFound = true
+		case ieiMOLocation:
+			msg.Location, err = parseMOLocation(data)
+			if err != nil {
+				return nil, errors.Wrap(err, "MO location parsing failed")
+			}
+		case ieiMOPayload:
+			msg.Payload = data
+		}
+	}
+	if !headerFound {
+		return nil, errors.Wrap(errDirectIPHeader, "MO header missing")
+	}
+	return msg, nil
+}
+
+func parseMOHeader(data []byte) (h MOHeader, err error) {
+	mh := moHeader{}
+	err = binary.Read(bytes.NewReader(data), binary.BigEndian, &mh)
+	if err != nil {
+		return h, errors.Wrap(err, "read failed")
+	}
+	return MOHeader{
+		CDRRef:        mh.CDRRef,
+		IMEI:          string(mh.IMEI[:]),
+		SessionStatus: mh.SessionStatus,
+		MOMSN:         mh.MOMSN,
+		MTMSN:         mh.MTMSN,
+		SessionTime:   time.Unix(int64(mh.SessionTime), 0).UTC(),
+	}, nil
+}
+
+func parseMOLocation(data []byte) (l *MOLocation, err error) {
+	ml := moLocation{}
+	err = binary.Read(bytes.NewReader(data), binary.BigEndian, &ml)
+	if err != nil {
+		return nil, errors.Wrap(err, "read failed")
+	}
+	l = &MOLocation{
+		Latitude:  float64(ml.LatDegrees) + float64(ml.LatMinutes)/60000,
+		Longitude: float64(ml.LonDegrees) + float64(ml.LonMinutes)/60000,
+		CEPRadius: ml.CEPRadiusKm,
+	}
+	// Bit 1 marks the southern and bit 0 the western hemisphere.
+	if ml.Flags&0x02 != 0 {
+		l.Latitude = -l.Latitude
+	}
+	if ml.Flags&0x01 != 0 {
+		l.Longitude = -l.Longitude
+	}
+	return l, nil
+}
+
+// EncodeDirectIPConfirmation builds the MO confirmation message that
+// tells the gateway whether the message was accepted.
+func EncodeDirectIPConfirmation(success bool) []byte {
+	status := uint8(0)
+	if success {
+		status = 1
+	}
+	return []byte{
+		directIPProtocolRevision, 0x00, 0x04,
+		ieiMOConfirmation, 0x00, 0x01, status,
+	}
+}
@@ -0,0 +1,239 @@
+package teltonika
+
+import (
+	"bytes"
+	"encoding/hex"
+	goerr "errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+)
+
+// moFrame is a mobile-originated DirectIP message of a TSM232 with the MO
+// header, location and payload information elements, the payload holding
+// two records out of chronological order.
+const moFrame = "01004c" +
+	"01001c0b7c3a2533303032333430313037353333373000001700005f1d8b40" +
+	"03000b003475300d3a9800000005" +
+	"02001c" +
+	"5f1d8a0089894ecab0990100002a" +
+	"5f1d8900898355caae2900000000"
+
+func mustDecodeHex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseDirectIP(t *testing.T) {
+	msg, err := ParseDirectIP(bytes.NewReader(mustDecodeHex(t, moFrame)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MOHeader{
+		CDRRef:      0x0b7c3a25,
+		IMEI:        "300234010753370",
+		MOMSN:       23,
+		SessionTime: time.Unix(0x5f1d8b40, 0).UTC(),
+	}
+	if msg.Header != want {
+		t.Errorf("header = %+v, want %+v", msg.Header, want)
+	}
+	if msg.Location == nil {
+		t.Fatal("location missing")
+	}
+	if *msg.Location != (MOLocation{Latitude: 52.5, Longitude: 13.25, CEPRadius: 5}) {
+		t.Errorf("location = %+v", *msg.Location)
+	}
+
+	records, err := ParseForTSM232(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	tests := []struct {
+		timestamp uint64
+		lon, lat  int32
+		speed     uint16
+		din1      byte
+	}{
+		{1595771136000, 133776899, 525096036, 0, 0},
+		{1595771392000, 134104987, 525162984, 42, 1},
+	}
+	for i, tt := range tests {
+		r := records[i]
+		if r.Timestamp != tt.timestamp || r.Longitude != tt.lon || r.Latitude != tt.lat || r.Speed != tt.speed {
+			t.Errorf("record %d = %+v", i, r.dataRecord)
+		}
+		if len(r.IO) != 1 || r.IO[0].ID != 1 || r.IO[0].Value[0] != tt.din1 {
+			t.Errorf("record %d IO = %v", i, r.IO)
+		}
+	}
+}
+
+func TestParseDirectIPMalformed(t *testing.T) {
+	frame := mustDecodeHex(t, moFrame)
+	tests := map[string][]byte{
+		"protocol revision": append([]byte{2}, frame[1:]...),
+		"truncated":         frame[:len(frame)-1],
+		"element overflow":  append(append([]byte{}, frame[:3]...), 0x02, 0x00, 0xff),
+		"no MO header":      {0x01, 0x00, 0x03, 0x02, 0x00, 0x00},
+	}
+	for name, b := range tests {
+		if _, err := ParseDirectIP(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// memStore keeps the positions it's given, or fails with err.
+type memStore struct {
+	positions []*common.Position
+	err       error
+}
+
+func (s *memStore) SavePositions(h *common.Handler, positions []*common.Position) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.positions = append(s.positions, positions...)
+	return nil
+}
+
+// serve runs a handler of a Teltonika interactor on one end of a pipe
+// and returns the other end, the device or the gateway.
+func serve(t *testing.T, store common.Store) (device net.Conn, done <-chan struct{}) {
+	return serveHandler(t, &common.Handler{Store: store})
+}
+
+// serveHandler is serve for a handler with more than a store set.
+func serveHandler(t *testing.T, h *common.Handler) (device net.Conn, done <-chan struct{}) {
+	device, conn := net.Pipe()
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	h.Name = "teltonika"
+	h.Conn = conn
+	h.Logger = logger
+	if h.Interactor == nil {
+		h.Interactor = &Interactor{}
+	}
+	h.Unregister = func() {}
+	d := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(d)
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+	return device, d
+}
+
+func TestDirectIPConfirmation(t *testing.T) {
+	tests := []struct {
+		name     string
+		storeErr error
+		want     string
+		stored   int
+	}{
+		{"stored", nil, "01000405000101", 2},
+		{"store failure", goerr.New("database down"), "01000405000100", 0},
+	}
+	for _, tt := range tests {
+		store := &memStore{err: tt.storeErr}
+		gateway, done := serve(t, store)
+		_, err := gateway.Write(mustDecodeHex(t, moFrame))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		confirmation := make([]byte, 7)
+		_, err = io.ReadFull(gateway, confirmation)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if hex.EncodeToString(confirmation) != tt.want {
+			t.Errorf("%s: confirmation %x, want %s", tt.name, confirmation, tt.want)
+		}
+		gateway.Close()
+		<-done
+
+		if len(store.positions) != tt.stored {
+			t.Fatalf("%s: stored %d positions, want %d", tt.name, len(store.positions), tt.stored)
+		}
+		for _, p := range store.positions {
+			if math.Abs(p.Latitude-52.51) > 0.01 || math.Abs(p.Longitude-13.39) > 0.03 {
+				t.Errorf("%s: position at %f,%f", tt.name, p.Latitude, p.Longitude)
+			}
+			if p.Satellites != common.UnknownSatellites {
+				t.Errorf("%s: %d satellites", tt.name, p.Satellites)
+			}
+		}
+	}
+}
+
+// quarantineStore fails the test when positions are quarantined.
+type quarantineStore struct {
+	t *testing.T
+}
+
+func (s quarantineStore) QuarantinePositions(h *common.Handler, rejections []*common.Rejection) error {
+	for _, r := range rejections {
+		s.t.Errorf("quarantined by %s: %s", r.Rule, r.Reason)
+	}
+	return nil
+}
+
+func TestDirectIPMinSatellites(t *testing.T) {
+	v := common.NewValidator()
+	v.AddRule("min_satellites", common.MinSatellites(3))
+	store := &memStore{}
+	gateway, done := serveHandler(t, &common.Handler{
+		Store:      store,
+		Validator:  v,
+		Quarantine: quarantineStore{t},
+	})
+	_, err := gateway.Write(mustDecodeHex(t, moFrame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmation := make([]byte, 7)
+	_, err = io.ReadFull(gateway, confirmation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway.Close()
+	<-done
+	if len(store.positions) != 2 {
+		t.Errorf("stored %d positions, want 2", len(store.positions))
+	}
+}
+
+func TestDetectDirectIP(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want bool
+	}{
+		{"DirectIP", moFrame[:12], true},
+		{"IMEI handshake", "000f33353633", true},
+		// A Ruptela packet of 336 bytes from IMEI 353288040073284.
+		{"Ruptela", "015000014150", false},
+		{"short message", "01001001001c", false},
+		{"MO header length", "01004c01001d", false},
+		{"short head", moFrame[:8], false},
+	}
+	for _, tt := range tests {
+		head := mustDecodeHex(t, tt.head)
+		if got := detect(head); got != tt.want {
+			t.Errorf("%s: detected %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
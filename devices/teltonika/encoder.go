@@ -0,0 +1,241 @@
+package teltonika
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+var (
+	errTooManyRecords   = errors.New("Too many records for a single frame")
+	errIOValueLength    = errors.New("IO value length not supported by codec")
+	errIOIDRange        = errors.New("IO ID doesn't fit the codec")
+	errUnsupportedInput = errors.New("Unsupported record type")
+)
+
+// Encode serializes records into a single TCP frame. records is
+// []*Record, []*Record8e or []*Record16, as returned by Parse,
+// and picks the codec.
+func Encode(records interface{}) (frame []byte, err error) {
+	body := new(bytes.Buffer)
+	var count int
+	switch rs := records.(type) {
+	case []*Record:
+		count = len(rs)
+		err = writePacketHeader(body, codec8, count)
+		for _, r := range rs {
+			if err == nil {
+				err = encodeRecord(body, r)
+			}
+		}
+	case []*Record8e:
+		count = len(rs)
+		err = writePacketHeader(body, codec8e, count)
+		for _, r := range rs {
+			if err == nil {
+				err = encodeRecord8e(body, r)
+			}
+		}
+	case []*Record16:
+		count = len(rs)
+		err = writePacketHeader(body, codec16, count)
+		for _, r := range rs {
+			if err == nil {
+				err = encodeRecord16(body, r)
+			}
+		}
+	default:
+		return nil, errUnsupportedInput
+	}
+	if err != nil {
+		return nil, err
+	}
+	body.WriteByte(uint8(count))
+	return wrapFrame(body.Bytes()), nil
+}
+
+// EncodeResponse builds the Codec 12 frame a device sends
+// in reply to a GPRS command.
+func EncodeResponse(payload []byte) []byte {
+	body := new(bytes.Buffer)
+	body.WriteByte(codec12)
+	body.WriteByte(1)
+	body.WriteByte(typeResponse)
+	binary.Write(body, binary.BigEndian, uint32(len(payload)))
+	body.Write(payload)
+	body.WriteByte(1)
+	return wrapFrame(body.Bytes())
+}
+
+// wrapFrame adds the preamble, data length and CRC to body.
+func wrapFrame(body []byte) []byte {
+	frame := make([]byte, tcpHeaderSize+len(body)+footerSize)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(body)))
+	copy(frame[tcpHeaderSize:], body)
+	binary.BigEndian.PutUint32(frame[tcpHeaderSize+len(body):], uint32(util.Crc16(body, 0xA001)))
+	return frame
+}
+
+func writePacketHeader(w *bytes.Buffer, codec uint8, count int) error {
+	if count > math.MaxUint8 {
+		return errTooManyRecords
+	}
+	w.WriteByte(codec)
+	w.WriteByte(uint8(count))
+	return nil
+}
+
+func encodeRecord(w *bytes.Buffer, r *Record) error {
+	binary.Write(w, binary.BigEndian, r.dataRecord)
+	elements := make([]ioRecord8e, len(r.IO))
+	for i, io := range r.IO {
+		elements[i] = ioRecord8e{ID: uint16(io.ID), Value: io.Value}
+	}
+	return encodeIO(w, layout8, elements)
+}
+
+func encodeRecord8e(w *bytes.Buffer, r *Record8e) error {
+	binary.Write(w, binary.BigEndian, r.dataRecord8e)
+	return encodeIO(w, layout8e, r.IO)
+}
+
+func encodeRecord16(w *bytes.Buffer, r *Record16) error {
+	binary.Write(w, binary.BigEndian, r.dataRecord16)
+	return encodeIO(w, layout16, r.IO)
+}
+
+// encodeIO writes elements grouped by value length, keeping their order
+// within each group. Elements that don't fit a fixed size group go into
+// the variable length group where the codec has one.
+func encodeIO(w *bytes.Buffer, l ioLayout, elements []ioRecord8e) error {
+	groups := make([][]ioRecord8e, l.groups())
+	for _, io := range elements {
+		if l.idSize == 1 && io.ID > math.MaxUint8 {
+			return errors.Wrapf(errIOIDRange, "ID %d", io.ID)
+		}
+		g := fixedGroup(len(io.Value))
+		if l.variable && (io.variable || g < 0) {
+			if len(io.Value) > math.MaxUint16 {
+				return errors.Wrapf(errIOValueLength, "ID %d", io.ID)
+			}
+			g = 4
+		}
+		if g < 0 {
+			return errors.Wrapf(errIOValueLength, "ID %d", io.ID)
+		}
+		groups[g] = append(groups[g], io)
+	}
+
+	for g, group := range groups {
+		writeSized(w, l.countSize, len(group))
+		for _, io := range group {
+			writeSized(w, l.idSize, int(io.ID))
+			if g == 4 {
+				writeSized(w, 2, len(io.Value))
+			}
+			w.Write(io.Value)
+		}
+	}
+	return nil
+}
+
+// fixedGroup returns the index of the group holding values of the given
+// length or -1 if there's none.
+func fixedGroup(length int) int {
+	switch length {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	case 4:
+		return 2
+	case 8:
+		return 3
+	}
+	return -1
+}
+
+func writeSized(w *bytes.Buffer, size int, v int) {
+	if size == 1 {
+		w.WriteByte(uint8(v))
+		return
+	}
+	binary.Write(w, binary.BigEndian, uint16(v))
+}
+
+// NewRecord builds a Codec 8 record from a position. IO IDs
+// must fit in a byte and values must be 1, 2, 4 or 8 bytes long.
+func NewRecord(p *common.Position) *Record {
+	r := &Record{IO: make([]ioRecord, 0, len(p.IO))}
+	r.Timestamp, r.Longitude, r.Latitude, r.Altitude, r.Angle, r.Satellites, r.Speed = recordFields(p)
+	r.Priority = uint8(p.Priority)
+	r.Event = uint8(p.EventID)
+	for _, id := range p.IOIDs() {
+		r.IO = append(r.IO, ioRecord{ID: uint8(id), Value: p.IO[id]})
+	}
+	sort.SliceStable(r.IO, func(i, j int) bool {
+		return fixedGroup(len(r.IO[i].Value)) < fixedGroup(len(r.IO[j].Value))
+	})
+	r.IOCount = uint8(len(r.IO))
+	return r
+}
+
+// NewRecord8e builds a Codec 8E record from a position.
+func NewRecord8e(p *common.Position) *Record8e {
+	r := &Record8e{IO: make([]ioRecord8e, 0, len(p.IO))}
+	r.Timestamp, r.Longitude, r.Latitude, r.Altitude, r.Angle, r.Satellites, r.Speed = recordFields(p)
+	r.Priority = uint8(p.Priority)
+	r.Event = uint16(p.EventID)
+	for _, id := range p.IOIDs() {
+		value := p.IO[id]
+		r.IO = append(r.IO, ioRecord8e{ID: id, Value: value, variable: fixedGroup(len(value)) < 0})
+	}
+	sortByGroup(r.IO)
+	r.IOCount = uint16(len(r.IO))
+	r.decodeIO()
+	return r
+}
+
+// NewRecord16 builds a Codec 16 record from a position.
+func NewRecord16(p *common.Position, generation uint8) *Record16 {
+	r := &Record16{IO: make([]ioRecord8e, 0, len(p.IO))}
+	r.Timestamp, r.Longitude, r.Latitude, r.Altitude, r.Angle, r.Satellites, r.Speed = recordFields(p)
+	r.Priority = uint8(p.Priority)
+	r.Event = uint16(p.EventID)
+	r.Generation = generation
+	for _, id := range p.IOIDs() {
+		r.IO = append(r.IO, ioRecord8e{ID: id, Value: p.IO[id]})
+	}
+	sortByGroup(r.IO)
+	r.IOCount = uint8(len(r.IO))
+	return r
+}
+
+// sortByGroup orders elements the way they are encoded, so that
+// records built from positions equal the result of parsing them.
+func sortByGroup(elements []ioRecord8e) {
+	group := func(io ioRecord8e) int {
+		if io.variable {
+			return 4
+		}
+		return fixedGroup(len(io.Value))
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		return group(elements[i]) < group(elements[j])
+	})
+}
+
+func recordFields(p *common.Position) (ts uint64, lon, lat int32, alt int16, angle uint16, sats uint8, speed uint16) {
+	return uint64(p.Timestamp.UnixNano() / int64(1000000)),
+		int32(math.Round(p.Longitude * 10000000)),
+		int32(math.Round(p.Latitude * 10000000)),
+		int16(math.Round(p.Altitude)),
+		uint16(math.Round(p.Heading)),
+		uint8(p.Satellites),
+		uint16(math.Round(p.Speed))
+}
@@ -0,0 +1,127 @@
+package teltonika
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+)
+
+// testPosition has IO values of every fixed length, and a variable
+// length beacon list that only Codec 8E can carry.
+func testPosition(variable bool) *common.Position {
+	p := &common.Position{
+		Timestamp:  time.Date(2019, 6, 10, 10, 4, 46, 0, time.UTC),
+		Latitude:   54.6872317,
+		Longitude:  25.2797417,
+		Altitude:   112,
+		Heading:    273,
+		Speed:      56,
+		Satellites: 11,
+		Priority:   1,
+		EventID:    239,
+		IO: map[uint16][]byte{
+			21:  {3},
+			239: {1},
+			66:  {0x30, 0x96},
+			16:  {0x00, 0x01, 0x86, 0xa0},
+			78:  {0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		},
+	}
+	if variable {
+		// A single iBeacon with its RSSI.
+		p.IO[ioBeacon] = append(append([]byte{0x11, 0x21}, bytes.Repeat([]byte{0xab}, 20)...), 0xc5)
+		p.IO[1148] = []byte{0x01, 0x02, 0x03}
+	}
+	return p
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		records interface{}
+	}{
+		{"codec 8", []*Record{NewRecord(testPosition(false)), NewRecord(testPosition(false))}},
+		{"codec 8E", []*Record8e{NewRecord8e(testPosition(true))}},
+		{"codec 16", []*Record16{NewRecord16(testPosition(false), GenerationOnChange)}},
+		{"no records", []*Record{}},
+	}
+	for _, tt := range tests {
+		frame, err := Encode(tt.records)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := Parse(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.records) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.records)
+		}
+	}
+}
+
+func TestEncodeRoundTripBeacons(t *testing.T) {
+	r := NewRecord8e(testPosition(true))
+	if len(r.Beacons) != 1 || r.Beacons[0].Type != IBeacon || !r.Beacons[0].HasRSSI {
+		t.Fatalf("beacons = %+v", r.Beacons)
+	}
+}
+
+func TestEncodeSampleFrames(t *testing.T) {
+	for _, s := range sampleFrames {
+		frame := mustDecodeHex(t, s.frame)
+		records, err := Parse(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		var encoded []byte
+		if responses, ok := records.([]*Response); ok {
+			encoded = EncodeResponse(responses[0].Payload)
+		} else {
+			encoded, err = Encode(records)
+			if err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			}
+		}
+		if !bytes.Equal(encoded, frame) {
+			t.Errorf("%s: encoded %x, want %x", s.name, encoded, frame)
+		}
+	}
+}
+
+func TestEncodeResponseRoundTrip(t *testing.T) {
+	payload := []byte("DOUT1:1 Timeout:INFINITY DOUT2:0 Timeout:INFINITY")
+	got, err := Parse(bytes.NewReader(EncodeResponse(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []*Response{{Payload: payload}}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	// The getinfo example of the Codec 12 documentation.
+	want := "000000000000000f0c010500000007676574696e666f0100004312"
+	if got := hex.EncodeToString(EncodeCommand([]byte("getinfo"))); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := map[string]interface{}{
+		"codec 8 value of 16 bytes": []*Record{{IO: []ioRecord{{ID: 1, Value: make([]byte, 16)}}}},
+		"codec 16 value of 3 bytes": []*Record16{{IO: []ioRecord8e{{ID: 1, Value: []byte{1, 2, 3}}}}},
+		"too many records":          make([]*Record, 256),
+		"unsupported type":          []int{1},
+	}
+	for name, records := range tests {
+		if _, err := Encode(records); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package teltonika
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/khiemm/listener/util"
+)
+
+// fuzzTargets are the parsers fed with the corpus in testdata/corpus,
+// one file per target, and with random mutations of it.
+var fuzzTargets = []struct {
+	name  string
+	parse func(data []byte) error
+	// fixCRC makes a mutated input valid again, so that mutations
+	// reach past the checksum.
+	fixCRC func(data []byte)
+}{
+	{"parse", func(data []byte) error {
+		_, err := Parse(bytes.NewReader(data))
+		return err
+	}, fixFrameCRC},
+	{"udp", func(data []byte) error {
+		_, err := ParseUDP(bytes.NewReader(data))
+		return err
+	}, nil},
+	{"directip", func(data []byte) error {
+		msg, err := ParseDirectIP(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		_, err = ParseForTSM232(msg.Payload)
+		return err
+	}, nil},
+	{"beacons", func(data []byte) error {
+		_, err := ParseBeacons(data)
+		return err
+	}, nil},
+}
+
+// maxAllocated bounds what parsing data may allocate. The lengths on
+// the wire are at most 16 bits wide, except for the TCP data length
+// which is capped by DefaultMaxFrameSize, so nothing should allocate
+// much more than 64 KB whatever it's fed.
+func maxAllocated(data []byte) uint64 {
+	return 80<<10 + 64*uint64(len(data))
+}
+
+type corpusEntry struct {
+	line int
+	ok   bool
+	data []byte
+}
+
+func readCorpus(t *testing.T, name string) (entries []corpusEntry) {
+	f, err := os.Open(filepath.Join("testdata", "corpus", name+".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		e := corpusEntry{line: line, ok: fields[0] == "ok"}
+		if len(fields) > 1 {
+			e.data, err = hex.DecodeString(fields[1])
+			if err != nil {
+				t.Fatalf("%s.txt:%d: %v", name, line, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// parseSafely runs parse, turning panics into test failures,
+// and returns the number of bytes it allocated.
+func parseSafely(t *testing.T, parse func([]byte) error, data []byte) (allocated uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("panic on %x: %v", data, r)
+		}
+	}()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = parse(data)
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc, err
+}
+
+func TestCorpus(t *testing.T) {
+	for _, target := range fuzzTargets {
+		for _, e := range readCorpus(t, target.name) {
+			allocated, err := parseSafely(t, target.parse, e.data)
+			if e.ok && err != nil {
+				t.Errorf("%s.txt:%d: %v", target.name, e.line, err)
+			}
+			if !e.ok && err == nil {
+				t.Errorf("%s.txt:%d: no error", target.name, e.line)
+			}
+			if allocated > maxAllocated(e.data) {
+				t.Errorf("%s.txt:%d: allocated %d bytes", target.name, e.line, allocated)
+			}
+		}
+	}
+}
+
+// TestMutatedCorpus feeds the parsers with random mutations of their
+// corpus, checking that they neither panic nor over-allocate.
+func TestMutatedCorpus(t *testing.T) {
+	iterations := 2000
+	if testing.Short() {
+		iterations = 200
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, target := range fuzzTargets {
+		corpus := readCorpus(t, target.name)
+		for i := 0; i < iterations; i++ {
+			data := mutate(rnd, corpus[rnd.Intn(len(corpus))].data)
+			if target.fixCRC != nil && rnd.Intn(2) == 0 {
+				target.fixCRC(data)
+			}
+			allocated, _ := parseSafely(t, target.parse, data)
+			if allocated > maxAllocated(data) {
+				t.Errorf("%s: allocated %d bytes for %x", target.name, allocated, data)
+			}
+		}
+	}
+}
+
+// mutate returns a copy of data with a few random bytes, lengths
+// and counts changed, or cut short.
+func mutate(rnd *rand.Rand, data []byte) []byte {
+	m := append([]byte(nil), data...)
+	for n := rnd.Intn(4) + 1; n > 0 && len(m) > 0; n-- {
+		i := rnd.Intn(len(m))
+		switch rnd.Intn(5) {
+		case 0:
+			m[i] ^= 1 << uint(rnd.Intn(8))
+		case 1:
+			m[i] = byte(rnd.Intn(256))
+		case 2:
+			// Lengths and counts are mostly 1 or 2 bytes wide.
+			m[i] = 0xff
+			if i+1 < len(m) {
+				m[i+1] = 0xff
+			}
+		case 3:
+			m = m[:i]
+		case 4:
+			m = append(m[:i], append(make([]byte, rnd.Intn(16)), m[i:]...)...)
+		}
+	}
+	return m
+}
+
+// fixFrameCRC rewrites the data length and the CRC of a TCP frame
+// to match the data.
+func fixFrameCRC(frame []byte) {
+	if len(frame) < tcpHeaderSize+footerSize+minFrameDataLen {
+		return
+	}
+	avl := frame[tcpHeaderSize : len(frame)-footerSize]
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(avl)))
+	binary.BigEndian.PutUint32(frame[len(frame)-footerSize:], uint32(util.Crc16(avl, 0xA001)))
+}
@@ -0,0 +1,275 @@
+package teltonika
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/khiemm/listener/devices/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// defaultCatalogData is used when devices.teltonika.io_catalog isn't configured.
+//
+//go:embed avlio.json
+var defaultCatalogData []byte
+
+var (
+	errUnknownFamily = errors.New("Unknown device model family")
+
+	defaultCatalog     *Catalog
+	defaultCatalogErr  error
+	defaultCatalogOnce sync.Once
+)
+
+// IODefinition describes how to interpret the raw value of an AVL IO element.
+type IODefinition struct {
+	ID     uint16 `json:"id"`
+	Name   string `json:"name"`
+	Signed bool   `json:"signed"`
+	// Multiplier scales the raw integer value, 1 when omitted.
+	Multiplier float64 `json:"multiplier"`
+	Unit       string  `json:"unit"`
+	// Values maps raw integer values to labels for enumerated elements.
+	Values map[string]string `json:"values"`
+	// Format is "hex" for elements that aren't numbers, like iButton IDs.
+	Format string `json:"format"`
+}
+
+// IOValue is an AVL IO element decoded using the catalog.
+type IOValue struct {
+	ID   uint16
+	Name string
+	// Value is a float64 for numeric elements and a string
+	// for enumerated and hex formatted ones.
+	Value interface{}
+	Unit  string
+}
+
+func (v IOValue) String() string {
+	switch value := v.Value.(type) {
+	case float64:
+		return v.Name + "=" + strconv.FormatFloat(value, 'f', -1, 64) + v.Unit
+	default:
+		return fmt.Sprintf("%s=%v%s", v.Name, value, v.Unit)
+	}
+}
+
+// Catalog holds the IO element definitions of each device model family.
+// Families share the definitions listed under "base" and can override them.
+type Catalog struct {
+	families map[string]map[uint16]*IODefinition
+}
+
+type catalogFile struct {
+	Base     []*IODefinition            `json:"base"`
+	Families map[string][]*IODefinition `json:"families"`
+}
+
+// LoadCatalog reads an IO catalog from the JSON file at path.
+func LoadCatalog(path string) (c *Catalog, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "IO catalog read failed")
+	}
+	return ParseCatalog(data)
+}
+
+// ParseCatalog builds an IO catalog from its JSON representation.
+func ParseCatalog(data []byte) (c *Catalog, err error) {
+	f := catalogFile{}
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, errors.Wrap(err, "IO catalog parsing failed")
+	}
+	c = &Catalog{families: make(map[string]map[uint16]*IODefinition)}
+	for family, defs := range f.Families {
+		entries := make(map[uint16]*IODefinition, len(f.Base)+len(defs))
+		for _, d := range append(f.Base, defs...) {
+			if d.Multiplier == 0 {
+				d.Multiplier = 1
+			}
+			entries[d.ID] = d
+		}
+		c.families[strings.ToLower(family)] = entries
+	}
+	return c, nil
+}
+
+// DefaultCatalog returns the catalog configured by devices.teltonika.io_catalog,
+// falling back to the built-in one. It's loaded once.
+func DefaultCatalog() (*Catalog, error) {
+	defaultCatalogOnce.Do(func() {
+		if path := viper.GetString("devices.teltonika.io_catalog"); path != "" {
+			defaultCatalog, defaultCatalogErr = LoadCatalog(path)
+			return
+		}
+		defaultCatalog, defaultCatalogErr = ParseCatalog(defaultCatalogData)
+	})
+	return defaultCatalog, defaultCatalogErr
+}
+
+// Families returns the names of the model families in the catalog.
+func (c *Catalog) Families() []string {
+	families := make([]string, 0, len(c.families))
+	for f := range c.families {
+		families = append(families, f)
+	}
+	return families
+}
+
+// Lookup returns the definition of IO element id for the given family.
+func (c *Catalog) Lookup(family string, id uint16) (*IODefinition, bool) {
+	entries, ok := c.families[strings.ToLower(family)]
+	if !ok {
+		return nil, false
+	}
+	d, ok := entries[id]
+	return d, ok
+}
+
+// Decode interprets the raw value of IO element id. Elements missing
+// from the catalog are returned as hex under the name "io<id>".
+func (c *Catalog) Decode(family string, id uint16, raw []byte) (v IOValue, err error) {
+	if _, ok := c.families[strings.ToLower(family)]; !ok {
+		return v, errUnknownFamily
+	}
+	d, ok := c.Lookup(family, id)
+	if !ok {
+		return IOValue{ID: id, Name: "io" + strconv.Itoa(int(id)), Value: hex.EncodeToString(raw)}, nil
+	}
+	return d.Decode(raw), nil
+}
+
+// Decode interprets raw using the definition.
+func (d *IODefinition) Decode(raw []byte) IOValue {
+	v := IOValue{ID: d.ID, Name: d.Name, Unit: d.Unit}
+	if d.Format == "hex" || len(raw) > 8 {
+		v.Value = hex.EncodeToString(raw)
+		return v
+	}
+
+	n := rawInteger(raw, d.Signed)
+	if d.Values != nil {
+		if label, ok := d.Values[strconv.FormatInt(n, 10)]; ok {
+			v.Value = label
+			return v
+		}
+	}
+	v.Value = scale(n, d.Multiplier)
+	return v
+}
+
+// rawInteger converts a big endian value of up to 8 bytes to an integer.
+func rawInteger(raw []byte, signed bool) int64 {
+	buf := make([]byte, 8)
+	copy(buf[8-len(raw):], raw)
+	n := binary.BigEndian.Uint64(buf)
+	if signed && len(raw) > 0 && len(raw) < 8 {
+		shift := uint(64 - 8*len(raw))
+		return int64(n<<shift) >> shift
+	}
+	return int64(n)
+}
+
+// scale multiplies n, rounding away the float noise
+// introduced by multipliers like 0.001.
+func scale(n int64, multiplier float64) float64 {
+	if multiplier == 1 {
+		return float64(n)
+	}
+	decimals := math.Max(0, math.Ceil(-math.Log10(multiplier)))
+	p := math.Pow(10, decimals)
+	return math.Round(float64(n)*multiplier*p) / p
+}
+
+// NamedIO decodes the IO elements of the record using catalog c.
+func (r *Record) NamedIO(c *Catalog, family string) (values []IOValue, err error) {
+	values = make([]IOValue, len(r.IO))
+	for i, io := range r.IO {
+		values[i], err = c.Decode(family, uint16(io.ID), io.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// NamedIO decodes the IO elements of the record using catalog c.
+func (r *Record8e) NamedIO(c *Catalog, family string) (values []IOValue, err error) {
+	return namedIO8e(r.IO, c, family)
+}
+
+// NamedIO decodes the IO elements of the record using catalog c.
+func (r *Record16) NamedIO(c *Catalog, family string) (values []IOValue, err error) {
+	return namedIO8e(r.IO, c, family)
+}
+
+func namedIO8e(elements []ioRecord8e, c *Catalog, family string) (values []IOValue, err error) {
+	values = make([]IOValue, len(elements))
+	for i, io := range elements {
+		values[i], err = c.Decode(family, io.ID, io.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// modelFamily returns the model family whose IO definitions apply to the
+// device with imei. devices.teltonika.model_families maps IMEI prefixes,
+// usually the 8 digit TAC identifying the model, to families and the
+// longest matching prefix wins. Other devices are of model_family.
+func modelFamily(imei string) string {
+	family, matched := "", 0
+	for prefix, f := range viper.GetStringMapString("devices.teltonika.model_families") {
+		if len(prefix) > matched && strings.HasPrefix(imei, prefix) {
+			family, matched = f, len(prefix)
+		}
+	}
+	if family != "" {
+		return family
+	}
+	if family = viper.GetString("devices.teltonika.model_family"); family != "" {
+		return family
+	}
+	return "fmb"
+}
+
+// nameIO decodes the IO elements of positions using the default catalog
+// and the model family of the device, and stores the named values as
+// attributes. Elements missing from the catalog are only kept raw, and
+// attributes already decoded by the codec, like beacons, are kept.
+func nameIO(h *common.Handler, positions []*common.Position) {
+	c, err := DefaultCatalog()
+	if err != nil {
+		h.Log().WithError(err).Warn("Couldn't load IO catalog")
+		return
+	}
+	family := modelFamily(h.IMEI)
+	if _, ok := c.families[strings.ToLower(family)]; !ok {
+		h.Log().WithError(errUnknownFamily).Warnf("Couldn't decode IO elements of %s", family)
+		return
+	}
+	for _, p := range positions {
+		for _, id := range p.IOIDs() {
+			d, ok := c.Lookup(family, id)
+			if !ok {
+				continue
+			}
+			v := d.Decode(p.IO[id])
+			if _, ok := p.Attributes[v.Name]; !ok {
+				p.SetAttribute(v.Name, v.Value)
+			}
+			h.DebugLog().Debugf("IO: %v", v)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package teltonika
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/spf13/viper"
+)
+
+func TestModelFamily(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("devices.teltonika.model_family", "fmc")
+	viper.Set("devices.teltonika.model_families", map[string]interface{}{
+		"35209308":        "fmm",
+		"352093081234564": "fmb",
+	})
+	tests := map[string]string{
+		"352093081234564": "fmb",
+		"352093089999998": "fmm",
+		"356307042441013": "fmc",
+	}
+	for imei, want := range tests {
+		if got := modelFamily(imei); got != want {
+			t.Errorf("modelFamily(%s) = %s, want %s", imei, got, want)
+		}
+	}
+}
+
+func TestNameIO(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("devices.teltonika.model_families", map[string]interface{}{"35209308": "fmm"})
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	tests := []struct {
+		imei string
+		want map[string]interface{}
+	}{
+		{"356307042441013", map[string]interface{}{
+			"external_voltage": 12.438, "ignition": "kept", "sd_status": "present",
+		}},
+		// SD card status isn't defined for FMM devices.
+		{"352093081234564", map[string]interface{}{
+			"external_voltage": 12.438, "ignition": "kept",
+		}},
+	}
+	for _, tt := range tests {
+		p := &common.Position{IO: map[uint16][]byte{
+			66:   {0x30, 0x96},
+			239:  {1},
+			10:   {1},
+			9999: {0xff},
+		}}
+		// Attributes decoded by the codec win over the catalog.
+		p.SetAttribute("ignition", "kept")
+		h := &common.Handler{Conn: conn, IMEI: tt.imei, Logger: logger}
+		nameIO(h, []*common.Position{p})
+		if len(p.Attributes) != len(tt.want) {
+			t.Errorf("%s: attributes %v, want %v", tt.imei, p.Attributes, tt.want)
+			continue
+		}
+		for name, value := range tt.want {
+			if p.Attributes[name] != value {
+				t.Errorf("%s: %s = %v, want %v", tt.imei, name, p.Attributes[name], value)
+			}
+		}
+	}
+}
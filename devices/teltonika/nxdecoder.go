@@ -0,0 +1,304 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// ioVIN is the variable length IO element carrying the vehicle VIN.
+const ioVIN uint16 = 256
+
+var (
+	errNotASCII     = errors.New("Value isn't printable ASCII")
+	errNotICCID     = errors.New("Value isn't an ICCID")
+	errBLEVersion   = errors.New("Unsupported BLE sensor data version")
+	errBLETruncated = errors.New("BLE sensor data truncated")
+	errCANTruncated = errors.New("CAN frame truncated")
+)
+
+// NXDecoder decodes the value of a Codec 8E IO element, typically one
+// of the variable length (NX) group.
+type NXDecoder func(value []byte) (decoded interface{}, err error)
+
+// DecodedIO is the value of an IO element decoded by the NXDecoder
+// registered for its ID. Name is the name it was registered under.
+type DecodedIO struct {
+	Name  string
+	Value interface{}
+}
+
+type registeredDecoder struct {
+	name   string
+	decode NXDecoder
+}
+
+var (
+	nxDecodersMu sync.RWMutex
+	nxDecoders   = map[uint16]registeredDecoder{
+		ioVIN:    {"vin", DecodeASCII},
+		ioBeacon: {"beacons", decodeBeacons},
+	}
+
+	// BuiltinNXDecoders are the decoders that can be registered from config.
+	BuiltinNXDecoders = map[string]NXDecoder{
+		"ascii":      DecodeASCII,
+		"iccid":      DecodeICCID,
+		"ble_sensor": DecodeBLESensor,
+		"lvcan":      DecodeCANFrames,
+		"beacons":    decodeBeacons,
+	}
+)
+
+// RegisterNXDecoder makes records decode the IO element id with decode.
+// The decoded value is stored on the record next to the raw one and added
+// to its position as the attribute name. It replaces the decoder already
+// registered for id, if any.
+func RegisterNXDecoder(id uint16, name string, decode NXDecoder) {
+	nxDecodersMu.Lock()
+	defer nxDecodersMu.Unlock()
+	nxDecoders[id] = registeredDecoder{name, decode}
+}
+
+// UnregisterNXDecoder makes records keep the IO element id as raw bytes only.
+func UnregisterNXDecoder(id uint16) {
+	nxDecodersMu.Lock()
+	defer nxDecodersMu.Unlock()
+	delete(nxDecoders, id)
+}
+
+// decodeIO decodes the IO elements of the record with the registered
+// decoders. Values that can't be decoded are kept as raw IO only.
+func (r *Record8e) decodeIO() {
+	for i := range r.IO {
+		io := &r.IO[i]
+		io.Decoded = decodeValue(io.ID, io.Value)
+		if io.Decoded == nil || io.ID != ioBeacon {
+			continue
+		}
+		if beacons, ok := io.Decoded.Value.([]Beacon); ok {
+			r.Beacons = append(r.Beacons, beacons...)
+		}
+	}
+}
+
+// decodeValue decodes the value with the decoder registered for id. It returns
+// nil when there's no decoder or the value can't be decoded.
+func decodeValue(id uint16, value []byte) *DecodedIO {
+	nxDecodersMu.RLock()
+	d, ok := nxDecoders[id]
+	nxDecodersMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	decoded, err := d.decode(value)
+	if err != nil {
+		return nil
+	}
+	return &DecodedIO{Name: d.name, Value: decoded}
+}
+
+// LoadNXDecoders registers the decoders configured in devices.teltonika.nx_decoders,
+// a table of IO IDs to the name of a built-in decoder and the attribute
+// name of its values, e.g.
+//
+//	[devices.teltonika.nx_decoders]
+//	11 = { decoder = "iccid", name = "iccid" }
+func LoadNXDecoders() (err error) {
+	config := viper.GetStringMap("devices.teltonika.nx_decoders")
+	for key := range config {
+		id, err := strconv.ParseUint(key, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid IO ID %q in devices.teltonika.nx_decoders", key)
+		}
+		sub := viper.Sub("devices.teltonika.nx_decoders." + key)
+		if sub == nil {
+			return fmt.Errorf("IO %d decoder must be a table", id)
+		}
+		decoder := sub.GetString("decoder")
+		decode, ok := BuiltinNXDecoders[decoder]
+		if !ok {
+			return fmt.Errorf("unknown decoder %q for IO %d", decoder, id)
+		}
+		name := sub.GetString("name")
+		if name == "" {
+			name = fmt.Sprintf("io%d", id)
+		}
+		RegisterNXDecoder(uint16(id), name, decode)
+	}
+	return nil
+}
+
+// DecodeASCII decodes printable ASCII text, such as a VIN. Trailing
+// NUL bytes and spaces are dropped.
+func DecodeASCII(value []byte) (interface{}, error) {
+	s := strings.TrimRight(string(value), "\x00 ")
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return nil, errNotASCII
+		}
+	}
+	return s, nil
+}
+
+// DecodeICCID decodes a SIM card ICCID sent as ASCII digits. Some modems
+// pad it with an 'F'.
+func DecodeICCID(value []byte) (interface{}, error) {
+	s := strings.TrimRight(string(value), "\x00 Ff")
+	if len(s) < 18 || len(s) > 22 {
+		return nil, errNotICCID
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return nil, errNotICCID
+		}
+	}
+	return s, nil
+}
+
+func decodeBeacons(value []byte) (interface{}, error) {
+	return ParseBeacons(value)
+}
+
+// Flags of the Teltonika EYE sensor advertising data.
+const (
+	bleFlagTemperature uint8 = 1 << iota
+	bleFlagHumidity
+	bleFlagMagnetPresent
+	bleFlagMagnet
+	bleFlagMovement
+	bleFlagAngles
+	bleFlagLowBattery
+	bleFlagBattery
+)
+
+// BLESensor holds the readings of a temperature and humidity sensor.
+// Readings the sensor doesn't report are nil.
+type BLESensor struct {
+	// Temperature in °C.
+	Temperature *float64 `json:"temperature,omitempty"`
+	// Humidity in %.
+	Humidity *uint8 `json:"humidity,omitempty"`
+	// Magnet is set when a magnetic field is detected.
+	Magnet *bool `json:"magnet,omitempty"`
+	// Moving and MovementCount come from the movement sensor.
+	Moving        *bool   `json:"moving,omitempty"`
+	MovementCount *uint16 `json:"movement_count,omitempty"`
+	// Pitch and Roll are in degrees.
+	Pitch      *int8  `json:"pitch,omitempty"`
+	Roll       *int16 `json:"roll,omitempty"`
+	LowBattery bool   `json:"low_battery"`
+	// BatteryVoltage in mV.
+	BatteryVoltage *uint16 `json:"battery_voltage,omitempty"`
+}
+
+// DecodeBLESensor decodes the advertising data of a Teltonika EYE sensor,
+// optionally preceded by the manufacturer ID 0x089A. After the version byte
+// comes a flags byte, which tells which of the readings follow.
+func DecodeBLESensor(value []byte) (interface{}, error) {
+	if len(value) >= 2 && value[0] == 0x9a && value[1] == 0x08 {
+		value = value[2:]
+	}
+	if len(value) < 2 {
+		return nil, errBLETruncated
+	}
+	if value[0] != 1 {
+		return nil, errBLEVersion
+	}
+	flags := value[1]
+	off := 2
+	take := func(n int) []byte {
+		if off+n > len(value) {
+			return nil
+		}
+		off += n
+		return value[off-n : off]
+	}
+
+	s := &BLESensor{LowBattery: flags&bleFlagLowBattery != 0}
+	if flags&bleFlagTemperature != 0 {
+		b := take(2)
+		if b == nil {
+			return nil, errBLETruncated
+		}
+		t := float64(int16(binary.BigEndian.Uint16(b))) / 100
+		s.Temperature = &t
+	}
+	if flags&bleFlagHumidity != 0 {
+		b := take(1)
+		if b == nil {
+			return nil, errBLETruncated
+		}
+		humidity := b[0]
+		s.Humidity = &humidity
+	}
+	if flags&bleFlagMagnetPresent != 0 {
+		magnet := flags&bleFlagMagnet != 0
+		s.Magnet = &magnet
+	}
+	if flags&bleFlagMovement != 0 {
+		b := take(2)
+		if b == nil {
+			return nil, errBLETruncated
+		}
+		v := binary.BigEndian.Uint16(b)
+		moving := v&0x8000 != 0
+		count := v & 0x7fff
+		s.Moving, s.MovementCount = &moving, &count
+	}
+	if flags&bleFlagAngles != 0 {
+		b := take(3)
+		if b == nil {
+			return nil, errBLETruncated
+		}
+		pitch := int8(b[0])
+		roll := int16(binary.BigEndian.Uint16(b[1:]))
+		s.Pitch, s.Roll = &pitch, &roll
+	}
+	if flags&bleFlagBattery != 0 {
+		b := take(1)
+		if b == nil {
+			return nil, errBLETruncated
+		}
+		mV := 2000 + uint16(b[0])*10
+		s.BatteryVoltage = &mV
+	}
+	return s, nil
+}
+
+// CANFrame is a frame read from the vehicle bus by an LVCAN adapter.
+type CANFrame struct {
+	ID       uint32 `json:"id"`
+	Extended bool   `json:"extended"`
+	Data     []byte `json:"data"`
+}
+
+// DecodeCANFrames decodes a list of CAN frames forwarded by an LVCAN
+// adapter. Each frame is a 4 byte identifier, whose highest bit marks
+// extended (29 bit) identifiers, the data length and the data.
+func DecodeCANFrames(value []byte) (interface{}, error) {
+	var frames []CANFrame
+	for off := 0; off < len(value); {
+		if off+5 > len(value) {
+			return nil, errCANTruncated
+		}
+		id := binary.BigEndian.Uint32(value[off:])
+		size := int(value[off+4])
+		off += 5
+		if size > 8 || off+size > len(value) {
+			return nil, errCANTruncated
+		}
+		frames = append(frames, CANFrame{
+			ID:       id &^ (1 << 31),
+			Extended: id&(1<<31) != 0,
+			Data:     value[off : off+size],
+		})
+		off += size
+	}
+	return frames, nil
+}
@@ -0,0 +1,152 @@
+package teltonika
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestDecodeICCID(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		iccid string
+		err   error
+	}{
+		{"20 digits", "89370030190612345678", "89370030190612345678", nil},
+		{"padded", "8937003019061234567F", "8937003019061234567", nil},
+		{"NUL padded", "89370030190612345678\x00\x00", "89370030190612345678", nil},
+		{"truncated", "893700301906123", "", errNotICCID},
+		{"not digits", "8937003019061234567A", "", errNotICCID},
+		{"empty", "", "", errNotICCID},
+	}
+	for _, tt := range tests {
+		iccid, err := DecodeICCID([]byte(tt.value))
+		if err != tt.err || (err == nil && iccid != tt.iccid) {
+			t.Errorf("%s: %v with error %v, want %q with %v", tt.name, iccid, err, tt.iccid, tt.err)
+		}
+	}
+}
+
+func TestDecodeBLESensor(t *testing.T) {
+	// Advertising data of an EYE sensor, at 22.28 °C and 18 % humidity,
+	// still after 3275 movements, at a pitch of 11° and a roll of -57°,
+	// with a 3030 mV battery.
+	const eye = "01b708b4120ccb0bffc767"
+	tests := []struct {
+		name   string
+		value  string
+		sensor string
+		err    error
+	}{
+		{"EYE sensor", eye,
+			`{"temperature":22.28,"humidity":18,"magnet":false,"moving":false,"movement_count":3275,"pitch":11,"roll":-57,"low_battery":false,"battery_voltage":3030}`, nil},
+		{"manufacturer ID", "9a08" + eye,
+			`{"temperature":22.28,"humidity":18,"magnet":false,"moving":false,"movement_count":3275,"pitch":11,"roll":-57,"low_battery":false,"battery_voltage":3030}`, nil},
+		{"below zero, moving", "0111ff38" + "8005",
+			`{"temperature":-2,"moving":true,"movement_count":5,"low_battery":false}`, nil},
+		{"magnet, low battery", "014c",
+			`{"magnet":true,"low_battery":true}`, nil},
+		{"version", "02b708b4120ccb0bffc767", "", errBLEVersion},
+		{"no flags", "01", "", errBLETruncated},
+		{"manufacturer ID only", "9a08", "", errBLETruncated},
+		{"truncated", eye[:len(eye)-2], "", errBLETruncated},
+		{"truncated angles", "012008ff", "", errBLETruncated},
+	}
+	for _, tt := range tests {
+		sensor, err := DecodeBLESensor(mustDecodeHex(t, tt.value))
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		b, _ := json.Marshal(sensor)
+		if string(b) != tt.sensor {
+			t.Errorf("%s: %s, want %s", tt.name, b, tt.sensor)
+		}
+	}
+}
+
+func TestDecodeCANFrames(t *testing.T) {
+	// An extended frame of engine data (PGN 65265, vehicle speed)
+	// followed by a standard OBD-II reply.
+	const frames = "98fef100" + "08" + "f0e80f00c0000000" + "000007e8" + "03" + "410d32"
+	tests := []struct {
+		name   string
+		value  string
+		frames string
+		err    error
+	}{
+		{"frames", frames,
+			`[{"id":419361024,"extended":true,"data":"8OgPAMAAAAA="},{"id":2024,"extended":false,"data":"QQ0y"}]`, nil},
+		{"no data", "000007df00", `[{"id":2015,"extended":false,"data":""}]`, nil},
+		{"empty", "", `null`, nil},
+		{"truncated data", frames[:len(frames)-2], "", errCANTruncated},
+		{"truncated identifier", frames + "0000", "", errCANTruncated},
+		{"length above 8", "000007e809000000000000000000", "", errCANTruncated},
+	}
+	for _, tt := range tests {
+		decoded, err := DecodeCANFrames(mustDecodeHex(t, tt.value))
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		b, _ := json.Marshal(decoded)
+		if string(b) != tt.frames {
+			t.Errorf("%s: %s, want %s", tt.name, b, tt.frames)
+		}
+	}
+}
+
+func TestLoadNXDecoders(t *testing.T) {
+	defer viper.Reset()
+	defer UnregisterNXDecoder(11)
+	defer UnregisterNXDecoder(10800)
+	viper.SetConfigType("toml")
+	err := viper.ReadConfig(strings.NewReader(`
+[devices.teltonika.nx_decoders]
+11 = { decoder = "iccid", name = "iccid" }
+10800 = { decoder = "ble_sensor" }
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = LoadNXDecoders(); err != nil {
+		t.Fatal(err)
+	}
+	d := decodeValue(11, []byte("89370030190612345678"))
+	if d == nil || d.Name != "iccid" || d.Value != "89370030190612345678" {
+		t.Errorf("IO 11 decoded as %+v", d)
+	}
+	// Decoders are named after their IO by default.
+	if d = decodeValue(10800, mustDecodeHex(t, "014c")); d == nil || d.Name != "io10800" {
+		t.Errorf("IO 10800 decoded as %+v", d)
+	}
+	// Values that can't be decoded are kept raw only.
+	if d = decodeValue(11, []byte("F")); d != nil {
+		t.Errorf("invalid ICCID decoded as %+v", d)
+	}
+
+	for name, config := range map[string]string{
+		"IO ID":   `abc = { decoder = "iccid" }`,
+		"decoder": `11 = { decoder = "morse" }`,
+		"table":   `11 = "iccid"`,
+	} {
+		viper.Reset()
+		viper.SetConfigType("toml")
+		err = viper.ReadConfig(strings.NewReader("[devices.teltonika.nx_decoders]\n" + config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = LoadNXDecoders(); err == nil {
+			t.Errorf("invalid %s loaded", name)
+		}
+	}
+}
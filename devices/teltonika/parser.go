@@ -4,17 +4,38 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
-	"math"
 	"sort"
 
-	"github.com/pkg/errors"
 	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
 )
 
 var (
 	errTcpHeader         = errors.New("Malformed transmission header")
 	errUnrecognizedCodec = errors.New("Unrecognized data codec")
 	errChecksumMismatch  = errors.New("Checksumming failed")
+	errFrameTooShort     = errors.New("Frame too short")
+	errFrameTooLarge     = errors.New("Frame exceeds maximum size")
+	errCountMismatch     = errors.New("Header and footer record counts differ")
+	errTrailingData      = errors.New("Unexpected data after last record")
+	errInvalidIMEI       = errors.New("Invalid IMEI")
+)
+
+// DefaultMaxFrameSize bounds the data length Parse accepts. Teltonika
+// devices split their data into frames of at most a few kilobytes.
+const DefaultMaxFrameSize = 16 << 10
+
+// minFrameDataLen is the data length of a frame without records:
+// codec, header record count and footer record count.
+const minFrameDataLen = 3
+
+// Smallest possible encoding of a single record of each codec, used to
+// reject record counts that can't fit in the data before decoding them.
+const (
+	minRecordSize   = 8 + 1 + 15 + 1 + 1 + 4
+	minRecord8eSize = 8 + 1 + 15 + 2 + 2 + 10
+	minRecord16Size = 8 + 1 + 15 + 2 + 1 + 1 + 4
+	minResponseSize = 1 + 4
 )
 
 type tcpHeader struct {
@@ -22,14 +43,6 @@ type tcpHeader struct {
 	DataLen uint32
 }
 
-type tsm232Header struct {
-	Protocol       uint8
-	MessageLength  uint16
-	MOHeaderIEI    uint8
-	MOHeaderLength uint16
-	CDRRef         uint32
-}
-
 type packetHeader struct {
 	Codec uint8
 	Count uint8
@@ -41,9 +54,12 @@ type dataRS232Record struct {
 	Latitude  [3]byte
 	Din1      uint8
 	Unused    [2]byte
-	Speed     float64
+	Speed     uint8
 }
 
+// tsm232RecordSize is the encoded size of dataRS232Record.
+const tsm232RecordSize = 14
+
 type dataRecord struct {
 	Timestamp  uint64
 	Priority   uint8
@@ -83,19 +99,63 @@ type dataRecord8e struct {
 type ioRecord8e struct {
 	ID    uint16
 	Value []byte
+	// Decoded is set when a decoder is registered for ID
+	// and the value could be decoded.
+	Decoded *DecodedIO
+	// variable is set for elements of the variable length group,
+	// whose values may still be 1, 2, 4 or 8 bytes long.
+	variable bool
 }
 
 type Record8e struct {
 	dataRecord8e
 	IO []ioRecord8e
+	// Beacons are decoded from IO element 385, when present.
+	Beacons []Beacon
 }
 
-type footer struct {
-	Count uint8
-	_     uint16
-	CRC   uint16
+// dataRecord16 is the fixed part of a Codec 16 AVL record. It carries
+// a 2 byte event IO ID like Codec 8E, but IO counts stay 1 byte wide and
+// the event ID is followed by the generation type.
+type dataRecord16 struct {
+	Timestamp  uint64
+	Priority   uint8
+	Longitude  int32
+	Latitude   int32
+	Altitude   int16
+	Angle      uint16
+	Satellites uint8
+	Speed      uint16
+	Event      uint16
+	Generation uint8
+	IOCount    uint8
+}
+
+// Record16 is a Codec 16 AVL record. Its IO IDs are 2 bytes wide,
+// so it reuses the Codec 8E IO element type.
+type Record16 struct {
+	dataRecord16
+	IO []ioRecord8e
 }
 
+// Generation types sent in Codec 16 records.
+const (
+	GenerationOnExit     uint8 = 0
+	GenerationOnEntrance uint8 = 1
+	GenerationOnBoth     uint8 = 2
+	GenerationReserved   uint8 = 3
+	GenerationHysteresis uint8 = 4
+	GenerationOnChange   uint8 = 5
+	GenerationEventual   uint8 = 6
+	GenerationPeriodical uint8 = 7
+)
+
+const (
+	codec8  uint8 = 0x08
+	codec8e uint8 = 0x8E
+	codec16 uint8 = 0x10
+)
+
 type recordSlice []*Record
 
 func (s recordSlice) Len() int {
@@ -110,57 +170,131 @@ func (s recordSlice) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
+// Parse reads a single frame from r. AVL data is returned as []*Record,
+// []*Record8e or []*Record16 depending on the codec, while Codec 12
+// command replies are returned as []*Response.
 func Parse(r io.Reader) (records interface{}, err error) {
-	tcph, err := parseTCPHeader(r)
+	return ParseFrame(r, DefaultMaxFrameSize)
+}
 
+// ParseFrame is Parse with a custom limit on the data length. Frames
+// announcing more data are refused before anything is allocated for them.
+func ParseFrame(r io.Reader, maxFrameSize int) (records interface{}, err error) {
+	bufp := framePool.Get().(*[]byte)
+	defer framePool.Put(bufp)
+
+	header := (*bufp)[:tcpHeaderSize]
+	_, err = io.ReadFull(r, header)
 	if err != nil {
 		return nil, errors.Wrap(err, "TCP header read failed")
 	}
-	// The single subtracted byte is the final record count.
-	// We still leave space for it in cap, because it's needed
-	// when calculating the checksum.
-	avl := make([]byte, tcph.DataLen-1, tcph.DataLen)
-	_, err = io.ReadFull(r, avl)
-
+	tcph, err := parseTCPHeader(header)
 	if err != nil {
-		return nil, errors.Wrap(err, "packet body read failed")
+		return nil, errors.Wrap(err, "TCP header read failed")
+	}
+	if tcph.DataLen < minFrameDataLen {
+		return nil, errFrameTooShort
+	}
+	if uint64(tcph.DataLen) > uint64(maxFrameSize) {
+		return nil, errors.Wrapf(errFrameTooLarge, "%d bytes", tcph.DataLen)
 	}
 
-	f, err := parseFooter(r)
-
+	// The data is followed by the 4 byte footer holding the CRC.
+	size := int(tcph.DataLen) + footerSize
+	if cap(*bufp) < size {
+		*bufp = make([]byte, size)
+	}
+	frame := (*bufp)[:size]
+	_, err = io.ReadFull(r, frame)
 	if err != nil {
-		return nil, errors.Wrap(err, "packet footer read failed")
+		return nil, errors.Wrap(err, "packet body read failed")
 	}
 
-	avl = append(avl, f.Count)
+	// The checksum covers the trailing record count, which isn't parsed.
+	avl := frame[:tcph.DataLen]
 	checksum := util.Crc16(avl, 0xA001)
-	if checksum != f.CRC {
+	if checksum != binary.BigEndian.Uint16(frame[size-2:]) {
 		return nil, errChecksumMismatch
 	}
 
-	buf := new(bytes.Buffer)
-	buf.Write(avl[0 : len(avl)-1])
-
-	ph, err := parsePacketHeader(buf)
+	d := &decoder{buf: avl[:len(avl)-1]}
+	ph, err := d.packetHeader()
 	if err != nil {
 		return nil, errors.Wrap(err, "packet header parsing failed")
 	}
-	if ph.Codec == 8 {
+	records, err = d.records(ph)
+	if err != nil {
+		return nil, err
+	}
+	if d.remaining() != 0 {
+		return nil, errTrailingData
+	}
+	if avl[len(avl)-1] != ph.Count {
+		return nil, errCountMismatch
+	}
+
+	// Teltonika sometimes sends records inside a packet
+	// out of order. It doesn't really matter but historically
+	// we sorted them so that it would look better in the database.
+	// sort.Stable(recordSlice(records8))
+	return records, nil
+}
+
+// records decodes the ph.Count records or responses following
+// the packet header.
+func (d *decoder) records(ph packetHeader) (records interface{}, err error) {
+	minSize := minRecord8eSize
+	switch ph.Codec {
+	case codec8:
+		minSize = minRecordSize
+	case codec16:
+		minSize = minRecord16Size
+	case codec12:
+		minSize = minResponseSize
+	}
+	if int(ph.Count)*minSize > d.remaining() {
+		return nil, errors.Wrapf(errCountMismatch, "%d records can't fit in %d bytes", ph.Count, d.remaining())
+	}
+
+	switch ph.Codec {
+	case codec8:
 		records8 := make([]*Record, ph.Count, ph.Count)
 		for i := 0; i < int(ph.Count); i++ {
 			var record *Record
-			record, err = parseRecord(buf)
+			record, err = d.record()
 			if err != nil {
 				return nil, errors.Wrap(err, "location record parsing failed")
 			}
 			records8[i] = record
 		}
 		records = records8
-	} else {
+	case codec16:
+		records16 := make([]*Record16, ph.Count, ph.Count)
+		for i := 0; i < int(ph.Count); i++ {
+			var record *Record16
+			record, err = d.record16()
+			if err != nil {
+				return nil, errors.Wrap(err, "location record parsing failed")
+			}
+			records16[i] = record
+		}
+		records = records16
+	case codec12:
+		responses := make([]*Response, ph.Count, ph.Count)
+		for i := 0; i < int(ph.Count); i++ {
+			var resp *Response
+			resp, err = d.response()
+			if err != nil {
+				return nil, errors.Wrap(err, "command response parsing failed")
+			}
+			responses[i] = resp
+		}
+		records = responses
+	default:
 		records8e := make([]*Record8e, ph.Count, ph.Count)
 		for i := 0; i < int(ph.Count); i++ {
 			var record *Record8e
-			record, err = parseRecord8e(buf)
+			record, err = d.record8e()
 			if err != nil {
 				return nil, errors.Wrap(err, "location record parsing failed")
 			}
@@ -168,127 +302,98 @@ func Parse(r io.Reader) (records interface{}, err error) {
 		}
 		records = records8e
 	}
-
-	// Teltonika sometimes sends records inside a packet
-	// out of order. It doesn't really matter but historically
-	// we sorted them so that it would look better in the database.
-	// sort.Stable(recordSlice(records8))
 	return records, nil
 }
 
-func parseTCPHeader(r io.Reader) (tcph *tcpHeader, err error) {
-	tcph = new(tcpHeader)
-	err = binary.Read(r, binary.BigEndian, tcph)
-	if err != nil {
-		return nil, errors.Wrap(err, "read failed")
-	}
+func parseTCPHeader(b []byte) (tcph tcpHeader, err error) {
+	tcph.Zeros = binary.BigEndian.Uint32(b)
+	tcph.DataLen = binary.BigEndian.Uint32(b[4:])
 	if tcph.Zeros != 0 {
-		return nil, errTcpHeader
+		return tcph, errTcpHeader
 	}
 	return
 }
 
-func parsePacketHeader(r io.Reader) (ph *packetHeader, err error) {
-	ph = new(packetHeader)
-	err = binary.Read(r, binary.BigEndian, ph)
-	if err != nil {
-		return nil, errors.Wrap(err, "read failed")
+func (d *decoder) packetHeader() (ph packetHeader, err error) {
+	ph.Codec = d.uint8()
+	ph.Count = d.uint8()
+	if d.err != nil {
+		return ph, errors.Wrap(d.err, "read failed")
 	}
-	if ph.Codec != 8 && ph.Codec != 142 {
-		return nil, errUnrecognizedCodec
+	if ph.Codec != codec8 && ph.Codec != codec8e && ph.Codec != codec16 && ph.Codec != codec12 {
+		return ph, errUnrecognizedCodec
 	}
 	return
 }
 
-func parseRecord(r io.Reader) (rec *Record, err error) {
+func (d *decoder) record() (rec *Record, err error) {
 	rec = new(Record)
-	dr := dataRecord{}
-	err = binary.Read(r, binary.BigEndian, &dr)
-	if err != nil {
-		return nil, errors.Wrap(err, "read failed")
+	dr := &rec.dataRecord
+	dr.Timestamp = d.uint64()
+	dr.Priority = d.uint8()
+	dr.Longitude, dr.Latitude, dr.Altitude, dr.Angle, dr.Satellites, dr.Speed = d.gpsElement()
+	dr.Event = d.uint8()
+	dr.IOCount = d.uint8()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "read failed")
 	}
-	rec.dataRecord = dr
-	rec.IO = make([]ioRecord, 0, rec.IOCount)
-
-	for i := 0; i < 4; i++ {
-		var count uint8
-		err = binary.Read(r, binary.BigEndian, &count)
-		if err != nil {
-			return
-		}
-
-		length := int(math.Pow(float64(2), float64(i)))
 
-		for j := 0; j < int(count); j++ {
-			var id uint8
-			data := make([]byte, length)
-			err = binary.Read(r, binary.BigEndian, &id)
-			if err != nil {
-				return nil, errors.Wrap(err, "IO id read failed")
-			}
-			err = binary.Read(r, binary.BigEndian, &data)
-			if err != nil {
-				return nil, errors.Wrap(err, "IO value read failed")
-			}
-			rec.IO = append(rec.IO, ioRecord{ID: id, Value: data})
-		}
+	count, size := d.scanIO(layout8)
+	rec.IO = make([]ioRecord, 0, count)
+	d.readIO(layout8, size, func(id uint16, value []byte, _ bool) {
+		rec.IO = append(rec.IO, ioRecord{ID: uint8(id), Value: value})
+	})
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "IO read failed")
 	}
 	return
 }
 
-func parseRecord8e(r io.Reader) (rec *Record8e, err error) {
+func (d *decoder) record8e() (rec *Record8e, err error) {
 	rec = new(Record8e)
-	dr := dataRecord8e{}
-	err = binary.Read(r, binary.BigEndian, &dr)
-	if err != nil {
-		return nil, errors.Wrap(err, "read failed")
+	dr := &rec.dataRecord8e
+	dr.Timestamp = d.uint64()
+	dr.Priority = d.uint8()
+	dr.Longitude, dr.Latitude, dr.Altitude, dr.Angle, dr.Satellites, dr.Speed = d.gpsElement()
+	dr.Event = d.uint16()
+	dr.IOCount = d.uint16()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "read failed")
 	}
-	rec.dataRecord8e = dr
-	rec.IO = make([]ioRecord8e, 0, rec.IOCount)
 
-	for i := 0; i < 5; i++ {
-		var count uint16
-		err = binary.Read(r, binary.BigEndian, &count)
-		if err != nil {
-			return
-		}
+	count, size := d.scanIO(layout8e)
+	rec.IO = make([]ioRecord8e, 0, count)
+	d.readIO(layout8e, size, func(id uint16, value []byte, variable bool) {
+		rec.IO = append(rec.IO, ioRecord8e{ID: id, Value: value, variable: variable})
+	})
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "IO read failed")
+	}
 
-		if i == 4 {
-			// value length is not fixed
-			for j := 0; j < int(count); j++ {
-				var idx uint16
-				var valueLength uint16
-				err = binary.Read(r, binary.BigEndian, &idx)
-				if err != nil {
-					return nil, errors.Wrap(err, "IO id read failed")
-				}
-				err = binary.Read(r, binary.BigEndian, &valueLength)
-				if err != nil {
-					return nil, errors.Wrap(err, "IO value length read failed")
-				}
-				data := make([]byte, valueLength)
-				err = binary.Read(r, binary.BigEndian, &data)
-				if err != nil {
-					return nil, errors.Wrap(err, "IO value read failed")
-				}
-				rec.IO = append(rec.IO, ioRecord8e{ID: idx, Value: data})
-			}
-		} else {
-			length := int(math.Pow(float64(2), float64(i)))
-			for j := 0; j < int(count); j++ {
-				var id uint16
-				data := make([]byte, length)
-				err = binary.Read(r, binary.BigEndian, &id)
-				if err != nil {
-					return nil, errors.Wrap(err, "IO id read failed")
-				}
-				err = binary.Read(r, binary.BigEndian, &data)
-				if err != nil {
-					return nil, errors.Wrap(err, "IO value read failed")
-				}
-				rec.IO = append(rec.IO, ioRecord8e{ID: id, Value: data})
-			}
-		}
+	rec.decodeIO()
+	return
+}
+
+func (d *decoder) record16() (rec *Record16, err error) {
+	rec = new(Record16)
+	dr := &rec.dataRecord16
+	dr.Timestamp = d.uint64()
+	dr.Priority = d.uint8()
+	dr.Longitude, dr.Latitude, dr.Altitude, dr.Angle, dr.Satellites, dr.Speed = d.gpsElement()
+	dr.Event = d.uint16()
+	dr.Generation = d.uint8()
+	dr.IOCount = d.uint8()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "read failed")
+	}
+
+	count, size := d.scanIO(layout16)
+	rec.IO = make([]ioRecord8e, 0, count)
+	d.readIO(layout16, size, func(id uint16, value []byte, _ bool) {
+		rec.IO = append(rec.IO, ioRecord8e{ID: id, Value: value})
+	})
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "IO read failed")
 	}
 	return
 }
@@ -314,7 +419,7 @@ func parseTSM232Record(r io.Reader) (rec *Record, err error) {
 	dr.Speed = uint16(tsm232dr.Speed)
 	rec.dataRecord = dr
 
-	rec.IO = make([]ioRecord, 1, 1)
+	rec.IO = make([]ioRecord, 0, 1)
 	din1Bytes := make([]byte, 1)
 	din1Bytes[0] = byte(tsm232dr.Din1)
 	rec.IO = append(rec.IO, ioRecord{ID: 1, Value: din1Bytes})
@@ -322,54 +427,65 @@ func parseTSM232Record(r io.Reader) (rec *Record, err error) {
 	return
 }
 
-func parseFooter(r io.Reader) (f *footer, err error) {
-	f = new(footer)
-	err = binary.Read(r, binary.BigEndian, f)
-	if err != nil {
-		return nil, errors.Wrap(err, "read failed")
-	}
-	return
-}
+// maxIMEILength bounds the IMEI a device may send in the handshake.
+const maxIMEILength = 32
 
-func parseIMEI(r io.Reader) (imei string, err error) {
+// readIMEI reads the handshake of a TCP device, the length of its IMEI
+// followed by the IMEI in ASCII. The IMEI must be all digits and pass
+// the Luhn check.
+func readIMEI(r io.Reader) (imei string, err error) {
 	var length uint16
 	err = binary.Read(r, binary.BigEndian, &length)
-
 	if err != nil {
 		return
 	}
+	if length == 0 || length > maxIMEILength {
+		return "", errors.Wrapf(errInvalidIMEI, "length %d", length)
+	}
 
 	imeiBytes := make([]byte, length)
 	_, err = io.ReadFull(r, imeiBytes)
 	if err != nil {
 		return "", errors.Wrap(err, "read failed")
 	}
-	return string(imeiBytes), nil
+	imei = string(imeiBytes)
+	if !util.ValidLuhn(imei) {
+		return "", errors.Wrapf(errInvalidIMEI, "%q", imei)
+	}
+	return imei, nil
 }
 
-func isTSM232(r io.Reader) bool {
-	tcph, _ := parseTSM232Header(r)
-	if tcph == nil {
-		return false
+// detect tells whether head starts an IMEI handshake, a length of at most
+// maxIMEILength followed by digits, or a DirectIP message.
+func detect(head []byte) bool {
+	if isTSM232(head) {
+		return true
 	}
-
-	return tcph.Protocol == 1
+	return len(head) >= 3 && head[0] == 0 && head[1] > 0 && head[1] <= maxIMEILength &&
+		head[2] >= '0' && head[2] <= '9'
 }
 
-func ParseForTSM232(r io.Reader) (records []*Record, err error) {
-
-	unusedLen := make([]byte, 25)
-	_, err = io.ReadFull(r, unusedLen)
-
-	var dataLen uint8
-
-	binary.Read(r, binary.BigEndian, &dataLen)
-
-	recordsCount := dataLen / 14
+// isTSM232 tells whether head, the first directIPHeadLength bytes sent over
+// a connection, starts a DirectIP message rather than an IMEI handshake:
+// the DirectIP header of a message long enough for an MO header, followed
+// by the IEI and length of the MO header. The IMEI length never has its
+// high byte set to the DirectIP protocol revision.
+func isTSM232(head []byte) bool {
+	if len(head) < directIPHeadLength || head[0] != directIPProtocolRevision || head[3] != ieiMOHeader {
+		return false
+	}
+	return binary.BigEndian.Uint16(head[1:]) >= 3+moHeaderLength &&
+		binary.BigEndian.Uint16(head[4:]) == moHeaderLength
+}
 
+// ParseForTSM232 decodes the TSM232 records carried in the payload
+// of a DirectIP message.
+func ParseForTSM232(payload []byte) (records []*Record, err error) {
+	recordsCount := len(payload) / tsm232RecordSize
 	records = make([]*Record, recordsCount, recordsCount)
 
-	for i := 0; i < int(recordsCount); i++ {
+	r := bytes.NewReader(payload)
+	for i := 0; i < recordsCount; i++ {
 		var record *Record
 		record, err = parseTSM232Record(r)
 		if err != nil {
@@ -382,26 +498,3 @@ func ParseForTSM232(r io.Reader) (records []*Record, err error) {
 
 	return
 }
-
-func parseTSM232Header(r io.Reader) (tcph *tsm232Header, err error) {
-	tcph = new(tsm232Header)
-	err = binary.Read(r, binary.BigEndian, tcph)
-
-	if err != nil {
-		return nil, errors.Wrap(err, "read failed")
-	}
-	if tcph.Protocol != 1 {
-		return nil, errors.Wrap(err, "not a TSM232 data")
-	}
-	return tcph, err
-}
-
-func parseTSM232IMEI(r io.Reader) (imei string, err error) {
-
-	imeiBytes := make([]byte, 15)
-	_, err = io.ReadFull(r, imeiBytes)
-	if err != nil {
-		return "", errors.Wrap(err, "read failed")
-	}
-	return string(imeiBytes), nil
-}
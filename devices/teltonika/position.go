@@ -0,0 +1,119 @@
+package teltonika
+
+import (
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+)
+
+// Position converts the record to the protocol neutral representation.
+func (r *Record) Position() *common.Position {
+	p := &common.Position{
+		Timestamp:  timestamp(r.Timestamp),
+		Latitude:   coordinate(r.Latitude),
+		Longitude:  coordinate(r.Longitude),
+		Altitude:   float64(r.Altitude),
+		Heading:    float64(r.Angle),
+		Speed:      float64(r.Speed),
+		Satellites: int(r.Satellites),
+		Priority:   int(r.Priority),
+		EventID:    int(r.Event),
+		IO:         make(map[uint16][]byte, len(r.IO)),
+	}
+	for _, io := range r.IO {
+		p.IO[uint16(io.ID)] = io.Value
+	}
+	return p
+}
+
+// Position converts the record to the protocol neutral representation.
+func (r *Record8e) Position() *common.Position {
+	p := &common.Position{
+		Timestamp:  timestamp(r.Timestamp),
+		Latitude:   coordinate(r.Latitude),
+		Longitude:  coordinate(r.Longitude),
+		Altitude:   float64(r.Altitude),
+		Heading:    float64(r.Angle),
+		Speed:      float64(r.Speed),
+		Satellites: int(r.Satellites),
+		Priority:   int(r.Priority),
+		EventID:    int(r.Event),
+		IO:         ioMap(r.IO),
+	}
+	for _, io := range r.IO {
+		if io.Decoded != nil {
+			p.SetAttribute(io.Decoded.Name, io.Decoded.Value)
+		}
+	}
+	return p
+}
+
+// Position converts the record to the protocol neutral representation.
+func (r *Record16) Position() *common.Position {
+	p := &common.Position{
+		Timestamp:  timestamp(r.Timestamp),
+		Latitude:   coordinate(r.Latitude),
+		Longitude:  coordinate(r.Longitude),
+		Altitude:   float64(r.Altitude),
+		Heading:    float64(r.Angle),
+		Speed:      float64(r.Speed),
+		Satellites: int(r.Satellites),
+		Priority:   int(r.Priority),
+		EventID:    int(r.Event),
+		IO:         ioMap(r.IO),
+	}
+	p.SetAttribute("generation", r.Generation)
+	return p
+}
+
+// Positions converts the records returned by Parse. It returns nil
+// for anything that isn't AVL data.
+func Positions(records interface{}) []*common.Position {
+	var positions []*common.Position
+	switch rs := records.(type) {
+	case []*Record:
+		positions = make([]*common.Position, len(rs))
+		for i, r := range rs {
+			positions[i] = r.Position()
+		}
+	case []*Record8e:
+		positions = make([]*common.Position, len(rs))
+		for i, r := range rs {
+			positions[i] = r.Position()
+		}
+	case []*Record16:
+		positions = make([]*common.Position, len(rs))
+		for i, r := range rs {
+			positions[i] = r.Position()
+		}
+	}
+	return positions
+}
+
+// tsm232Positions converts the records of a TSM232 payload. Satellite
+// messages don't report the number of satellites of their fix.
+func tsm232Positions(records []*Record) []*common.Position {
+	positions := Positions(records)
+	for _, p := range positions {
+		p.Satellites = common.UnknownSatellites
+	}
+	return positions
+}
+
+func ioMap(elements []ioRecord8e) map[uint16][]byte {
+	m := make(map[uint16][]byte, len(elements))
+	for _, io := range elements {
+		m[io.ID] = io.Value
+	}
+	return m
+}
+
+// timestamp converts milliseconds since the epoch.
+func timestamp(ms uint64) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+}
+
+// coordinate converts degrees multiplied by 10^7.
+func coordinate(c int32) float64 {
+	return float64(c) / 10000000
+}
@@ -1,64 +1,94 @@
 package teltonika
 
 import (
-	"bytes"
 	"encoding/binary"
 	"io"
 
 	"time"
+
+	"github.com/khiemm/listener/devices/common"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
-	"github.com/thejerf/suture"
-	"github.com/khiemm/listener/devices/common"
-	"github.com/khiemm/listener/util"
 )
 
-func MakeServer(addr string, connSupervisor *suture.Supervisor) suture.Service {
-	s := new(common.Server)
-	s.Name = "teltonika"
-	s.Addr = addr
-	s.ConnectionSupervisor = connSupervisor
-	s.InteractorGenerator = func(s *common.Server) common.Interactor { return Interactor{} }
-	return s
+// defaultTimeout applies when [devices.teltonika] doesn't set a timeout.
+const defaultTimeout = 30 * time.Second
+
+func init() {
+	common.RegisterProtocol(common.Protocol{
+		Name:          "teltonika",
+		NewInteractor: func(s *common.Server) common.Interactor { return &Interactor{} },
+		Detect:        detect,
+	})
+	common.RegisterProtocol(common.Protocol{
+		Name:          "teltonika_udp",
+		Network:       "udp",
+		NewInteractor: func(s *common.Server) common.Interactor { return UDPInteractor{} },
+		DatagramIMEI:  datagramIMEI,
+	})
 }
 
-type Interactor struct{}
+// Interactor handles Teltonika devices connected over TCP. The same port
+// also accepts TSM232 satellite messages forwarded by the Iridium gateway
+// over DirectIP.
+type Interactor struct {
+	// directIP is the message read during a DirectIP handshake. It's
+	// handed to HandleMessage by the first call of ParseMessage.
+	directIP *DirectIPMessage
+	tsm232   bool
+}
 
 // InitializeConnection reads device IMEI from connection, loads the corresponding
 // vehicle from the database, saves its information to fmConnection and
 // sends a confirmation byte to the device.
 // If the device sends an IMEI that's not found in the database,
 // 00 is sent to the device, connection is closed and ErrUnauthorizedDevice
-// is returned.
-func (_ Interactor) InitializeConnection(h *common.Handler) (err error) {
-	h.Conn.SetDeadline(util.MakeTimeout(viper.GetInt("teltonika.timeout")))
-
-	var buff = make([]byte, 10)
-	_, err = io.ReadFull(h.Conn, buff)
-
-	reader := bytes.NewReader(buff)
-
-	var imei string
-
-	tsm232 := isTSM232(reader)
-
-	if tsm232 {
-
-		h.Log().Debug("---isTSM232")
-		imei, err = parseTSM232IMEI(h.Conn)
+// is returned. Malformed IMEIs, and IMEIs the client certificate wasn't
+// issued to, are refused the same way.
+// DirectIP connections carry a whole message instead of an IMEI, which
+// is read here and confirmed once its records are handled. The first
+// bytes are only peeked at to tell the two apart, so whichever path is
+// taken reads the message from its start.
+func (i *Interactor) InitializeConnection(h *common.Handler) (err error) {
+	head, err := h.Peek(1)
+	if err != nil {
+		return
+	}
+	if head[0] == directIPProtocolRevision {
+		head, err = h.Peek(directIPHeadLength)
+		if err != nil {
+			return
+		}
+	}
 
+	if isTSM232(head) {
+		h.Log().Debug("DirectIP message")
+		i.tsm232 = true
+		i.directIP, err = ParseDirectIP(h.Conn)
 		if err != nil {
 			return
 		}
-	} else {
-		var buff2 = make([]byte, 7)
-		_, err = io.ReadFull(h.Conn, buff2)
-		buff = append(buff, buff2...)
-		reader2 := bytes.NewReader(buff)
-		imei, err = parseIMEI(reader2)
+		h.IMEI = i.directIP.Header.IMEI
+		return
+	}
+
+	imei, err := readIMEI(h.Conn)
+	if errors.Cause(err) == errInvalidIMEI {
+		refuse(h)
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = h.VerifyIMEI(imei)
+	if err != nil {
+		refuse(h)
+		return
 	}
 	h.Log().Debug(imei)
+	h.IMEI = imei
 
+	_, err = h.Conn.Write([]byte{1})
 	if err != nil {
 		return
 	}
@@ -78,79 +108,83 @@ func (_ Interactor) InitializeConnection(h *common.Handler) (err error) {
 	// } else {
 	// 	h.ID = vehicle.Id
 	// 	h.Debug = vehicle.Debug
-
-	// 	if tsm232 {
-	// 		records, _ := ParseForTSM232(h.Conn)
-	// 		recordsSlice := make([]interface{}, len(records))
-	// 		for i, r := range records {
-	// 			recordsSlice[i] = r
-	// 		}
-	// 		err = h.SaveRecords(recordsSlice)
-
-	// 		err = binary.Write(h.Conn, binary.BigEndian, uint32(len(records)))
-	// 		h.Conn.Close()
-
-	// 	} else {
-	// 		_, err = h.Conn.Write([]byte{1})
-	// 	}
-
-	// 	if err != nil {
-	// 		return
-	// 	}
 	// }
 	return
 }
 
-func (_ Interactor) ParseMessage(h *common.Handler) (result interface{}, err error) {
-	return Parse(h.Conn)
+// ParseMessage returns AVL data as []*common.Position. Codec 12 replies
+// and DirectIP messages are returned as they were parsed.
+func (i *Interactor) ParseMessage(h *common.Handler) (result interface{}, err error) {
+	if i.directIP != nil {
+		result, i.directIP = i.directIP, nil
+		return
+	}
+	result, err = ParseFrame(h.Conn, maxFrameSize())
+	if err != nil {
+		return nil, err
+	}
+	if positions := Positions(result); positions != nil {
+		return positions, nil
+	}
+	return result, nil
 }
 
-func (_ Interactor) HandleMessage(h *common.Handler, msg interface{}) (err error) {
+func (_ *Interactor) HandleMessage(h *common.Handler, msg interface{}) (err error) {
 	if h.Debug {
 		h.Log().Debugf("Raw message: %x", h.GetLastRawMessage())
 	}
-	if records, ok := msg.([]*Record); ok {
-		records = msg.([]*Record)
-		recordsSlice := make([]interface{}, len(records))
-		for i, r := range records {
-			recordsSlice[i] = r
-		}
-		// err = h.SaveRecords(recordsSlice)
-		// if err != nil {
-		// 	return errors.Wrap(err, "saving records failed")
-		// }
-
-		err = binary.Write(h.Conn, binary.BigEndian, uint32(len(records)))
+	switch m := msg.(type) {
+	case *DirectIPMessage:
+		var records []*Record
+		records, err = ParseForTSM232(m.Payload)
 		if err != nil {
-			return errors.Wrap(err, "couldn't confirm receipt")
+			return errors.Wrap(err, "TSM232 payload parsing failed")
 		}
-	}
-	if records, ok := msg.([]*Record8e); ok {
-		records = msg.([]*Record8e)
-		recordsSlice := make([]interface{}, len(records))
-		for i, r := range records {
-			recordsSlice[i] = r
-		}
-		// err = h.SaveRecords(recordsSlice)
-		// if err != nil {
-		// 	return errors.Wrap(err, "saving records failed")
-		// }
-
-		err = binary.Write(h.Conn, binary.BigEndian, uint32(len(records)))
-		if err != nil {
-			return errors.Wrap(err, "couldn't confirm receipt")
+		// The gateway closes the connection once it gets the confirmation.
+		// A failed one is sent by HandleError.
+		return handlePositions(h, tsm232Positions(records), func() (err error) {
+			_, err = h.Conn.Write(EncodeDirectIPConfirmation(true))
+			return
+		})
+	case []*Response:
+		for _, r := range m {
+			if !h.ResolveCommand(r.Payload) {
+				h.Log().Warnf("Unsolicited command response: %q", r.Payload)
+			}
 		}
+	case []*common.Position:
+		// A zero record count is sent by HandleError when
+		// the positions couldn't be stored.
+		return handlePositions(h, m, func() error {
+			return binary.Write(h.Conn, binary.BigEndian, uint32(len(m)))
+		})
 	}
 	return nil
 }
 
-func (_ Interactor) HandleError(h *common.Handler, _ error) (terminate bool) {
+// handlePositions is where the positions of every Teltonika transport end up.
+// ack sends the transport specific acknowledgement.
+func handlePositions(h *common.Handler, positions []*common.Position, ack func() error) (err error) {
+	nameIO(h, positions)
+	return h.SaveAndAcknowledge(positions, ack)
+}
+
+// EncodeCommand wraps a GPRS command into a Codec 12 frame.
+func (_ *Interactor) EncodeCommand(h *common.Handler, payload []byte) ([]byte, error) {
+	return EncodeCommand(payload), nil
+}
+
+func (i *Interactor) HandleError(h *common.Handler, _ error) (terminate bool) {
+	if i.tsm232 {
+		h.Conn.Write(EncodeDirectIPConfirmation(false))
+		return true
+	}
 	sendError(h.Conn)
 	return true
 }
 
-func (_ Interactor) GetConnectionTimeout(h common.Handler) time.Duration {
-	return time.Duration(viper.GetInt("teltonika.timeout")) * time.Second
+func (_ *Interactor) GetConnectionTimeout(h common.Handler) time.Duration {
+	return defaultTimeout
 }
 
 // func (_ Interactor) MakeDBRecord(h common.Handler, record interface{}) (dbr *models.Record, ior []*models.Parameter) {
@@ -232,29 +266,23 @@ func (_ Interactor) GetConnectionTimeout(h common.Handler) time.Duration {
 // 	return
 // }
 
-// verifyRecord checks whether the record should be saved into database
-// using a set of basic sanity checks.
-func verifyRecord(record interface{}) bool {
-	if r, ok := record.(*Record8e); ok {
-		if r.Latitude == 0 && r.Longitude == 0 {
-			return false
-		}
-		if r.Timestamp > uint64(time.Now().Unix()*1000+2*60*60000) {
-			return false
-		}
+// refuse tells the device it's not accepted.
+func refuse(h *common.Handler) {
+	_, err := h.Conn.Write([]byte{0})
+	if err != nil {
+		h.Log().WithError(err).Error("Error when sending refusal byte to a Teltonika")
 	}
-	if r, ok := record.(*Record); ok {
-		if r.Latitude == 0 && r.Longitude == 0 {
-			return false
-		}
-		if r.Timestamp > uint64(time.Now().Unix()*1000+2*60*60000) {
-			return false
-		}
+}
+
+// maxFrameSize returns the configured limit on the size of a single frame.
+func maxFrameSize() int {
+	if size := viper.GetInt("devices.teltonika.max_frame_size"); size > 0 {
+		return size
 	}
-	return true
+	return DefaultMaxFrameSize
 }
 
-func (_ Interactor) CloseConnection(h common.Handler) (err error) { return nil }
+func (_ *Interactor) CloseConnection(h common.Handler) (err error) { return nil }
 
 func sendError(w io.Writer) {
 	w.Write([]byte{0, 0, 0, 0})
@@ -0,0 +1,76 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// handshake sends the IMEI of a device and returns the reply.
+func handshake(t *testing.T, device io.ReadWriter, imei string) byte {
+	msg := make([]byte, 2+len(imei))
+	binary.BigEndian.PutUint16(msg, uint16(len(imei)))
+	copy(msg[2:], imei)
+	_, err := device.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(device, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply[0]
+}
+
+func TestAcknowledgeStoredRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		storeErr error
+		// ack is the record count the device gets back.
+		ack    uint32
+		stored int
+	}{
+		{"stored", nil, 2, 2},
+		{"store failure", errors.New("database down"), 0, 0},
+	}
+	frame := mustDecodeHex(t, sampleFrames[1].frame)
+	for _, tt := range tests {
+		store := &memStore{err: tt.storeErr}
+		device, done := serve(t, store)
+		if reply := handshake(t, device, "356307042441013"); reply != 1 {
+			t.Fatalf("%s: handshake reply %d", tt.name, reply)
+		}
+		_, err := device.Write(frame)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ack := make([]byte, 4)
+		_, err = io.ReadFull(device, ack)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := binary.BigEndian.Uint32(ack); got != tt.ack {
+			t.Errorf("%s: ack %d, want %d", tt.name, got, tt.ack)
+		}
+		device.Close()
+		<-done
+		if len(store.positions) != tt.stored {
+			t.Errorf("%s: stored %d positions, want %d", tt.name, len(store.positions), tt.stored)
+		}
+	}
+}
+
+func TestRefuseInvalidIMEI(t *testing.T) {
+	device, done := serve(t, &memStore{})
+	if reply := handshake(t, device, "356307042441014"); reply != 0 {
+		t.Errorf("handshake reply %d, want 0", reply)
+	}
+	// The connection is closed after the refusal.
+	if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after refusal: %v", err)
+	}
+	<-done
+}
@@ -0,0 +1,205 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+	"github.com/khiemm/listener/util"
+	"github.com/pkg/errors"
+)
+
+var (
+	errUDPHeader = errors.New("Malformed UDP channel header")
+	// errMalformedDatagram is the cause of the errors of datagrams
+	// that were read but couldn't be decoded.
+	errMalformedDatagram = errors.New("Malformed datagram")
+)
+
+// maxDatagramSize is the size of the largest datagram
+// the 16 bit length of the UDP channel header allows.
+const maxDatagramSize = 2 + 65535
+
+// udpAck is sent back for every datagram, telling the device how many
+// records were accepted.
+type udpAck struct {
+	Length      uint16
+	PacketID    uint16
+	NotUsable   uint8
+	AVLPacketID uint8
+	Accepted    uint8
+}
+
+// UDPPacket is a single AVL datagram.
+type UDPPacket struct {
+	PacketID    uint16
+	AVLPacketID uint8
+	IMEI        string
+	Positions   []*common.Position
+}
+
+// UDPInteractor handles Teltonika devices sending AVL data over UDP.
+// There is no handshake, every datagram carries the device IMEI instead.
+// IO elements are decoded with the settings of [devices.teltonika],
+// io_catalog, model_family, model_families and nx_decoders, shared
+// with the TCP server.
+type UDPInteractor struct{}
+
+// InitializeConnection only makes sure the session has been
+// assigned an IMEI, as UDP devices don't identify themselves upfront.
+func (_ UDPInteractor) InitializeConnection(h *common.Handler) (err error) {
+	if h.IMEI == "" {
+		return common.ErrUnauthorizedDevice
+	}
+	return nil
+}
+
+func (_ UDPInteractor) ParseMessage(h *common.Handler) (result interface{}, err error) {
+	return ParseUDP(h.Conn)
+}
+
+func (_ UDPInteractor) HandleMessage(h *common.Handler, msg interface{}) (err error) {
+	packet, ok := msg.(*UDPPacket)
+	if !ok {
+		return nil
+	}
+	if packet.IMEI != h.IMEI {
+		h.Log().Warnf("Datagram IMEI %s doesn't match session", packet.IMEI)
+		return nil
+	}
+	err = handlePositions(h, packet.Positions, func() error {
+		return sendUDPAck(h, packet, len(packet.Positions))
+	})
+	if err != nil {
+		// Nothing was accepted, so the device resends the whole packet.
+		sendUDPAck(h, packet, 0)
+		return
+	}
+	return nil
+}
+
+func sendUDPAck(h *common.Handler, packet *UDPPacket, accepted int) error {
+	ack := udpAck{
+		Length:      5,
+		PacketID:    packet.PacketID,
+		NotUsable:   1,
+		AVLPacketID: packet.AVLPacketID,
+		Accepted:    uint8(accepted),
+	}
+	return binary.Write(h.Conn, binary.BigEndian, ack)
+}
+
+// HandleError drops malformed datagrams and keeps the session, other
+// errors end it. Dropped datagrams are not acknowledged, so the device
+// resends them.
+func (_ UDPInteractor) HandleError(h *common.Handler, err error) (terminate bool) {
+	if errors.Cause(err) == errMalformedDatagram {
+		h.Log().WithError(err).Warn("Dropping datagram")
+		return false
+	}
+	return true
+}
+
+func (_ UDPInteractor) GetConnectionTimeout(h common.Handler) time.Duration {
+	return defaultTimeout
+}
+
+func (_ UDPInteractor) CloseConnection(h common.Handler) (err error) { return nil }
+
+// ParseUDP reads a single datagram with a single read from r, which
+// returns one datagram per read like the connections of UDP sessions.
+// Datagrams that can't be decoded are errMalformedDatagram, whatever
+// the reason.
+func ParseUDP(r io.Reader) (packet *UDPPacket, err error) {
+	bufp := framePool.Get().(*[]byte)
+	defer framePool.Put(bufp)
+	if cap(*bufp) < maxDatagramSize {
+		*bufp = make([]byte, maxDatagramSize)
+	}
+
+	n, err := r.Read((*bufp)[:maxDatagramSize])
+	if err != nil {
+		return nil, errors.Wrap(err, "datagram read failed")
+	}
+	packet, err = decodeUDP((*bufp)[:n])
+	if err != nil {
+		return nil, errors.Wrap(errMalformedDatagram, err.Error())
+	}
+	return packet, nil
+}
+
+// decodeUDP decodes a whole datagram, whose length must match
+// the one of its UDP channel header.
+func decodeUDP(data []byte) (packet *UDPPacket, err error) {
+	if len(data) < 2 {
+		return nil, errors.Wrapf(errUDPHeader, "%d bytes", len(data))
+	}
+	if size := int(binary.BigEndian.Uint16(data)) + 2; size != len(data) {
+		return nil, errors.Wrapf(errUDPHeader, "length %d in a datagram of %d bytes", size, len(data))
+	}
+
+	d := &decoder{buf: data}
+	packet, err = d.udpHeader()
+	if err != nil {
+		return nil, errors.Wrap(err, "UDP header parsing failed")
+	}
+
+	ph, err := d.packetHeader()
+	if err != nil {
+		return nil, errors.Wrap(err, "packet header parsing failed")
+	}
+	if ph.Codec == codec12 {
+		return nil, errUnrecognizedCodec
+	}
+	records, err := d.records(ph)
+	if err != nil {
+		return nil, err
+	}
+	packet.Positions = Positions(records)
+
+	count := d.uint8()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "record count read failed")
+	}
+	if count != ph.Count {
+		return nil, errors.Wrapf(errCountMismatch, "header %d, footer %d", ph.Count, count)
+	}
+	if d.remaining() != 0 {
+		return nil, errTrailingData
+	}
+	return packet, nil
+}
+
+// udpHeader reads the UDP channel header that precedes the AVL packet
+// header in every datagram.
+func (d *decoder) udpHeader() (packet *UDPPacket, err error) {
+	packet = new(UDPPacket)
+	d.uint16()
+	packet.PacketID = d.uint16()
+	d.uint8()
+	packet.AVLPacketID = d.uint8()
+	imei := d.take(int(d.uint16()))
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "read failed")
+	}
+	packet.IMEI = string(imei)
+	return packet, nil
+}
+
+// datagramIMEI returns the IMEI from the UDP channel header of datagram.
+// IMEIs failing the check digit are refused like over TCP.
+func datagramIMEI(datagram []byte) (imei string, err error) {
+	d := &decoder{buf: datagram}
+	packet, err := d.udpHeader()
+	if err != nil {
+		return "", errUDPHeader
+	}
+	if len(packet.IMEI) == 0 {
+		return "", errUDPHeader
+	}
+	if !util.ValidLuhn(packet.IMEI) {
+		return "", errors.Wrapf(errInvalidIMEI, "%q", packet.IMEI)
+	}
+	return packet.IMEI, nil
+}
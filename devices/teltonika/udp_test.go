@@ -0,0 +1,122 @@
+package teltonika
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/pkg/errors"
+)
+
+// Datagrams of a device with IMEI 352093086403655.
+const (
+	datagramRecord = "003dcafe0105000f33353230393330383634303336353508010000016b4f815b30010000000000000000000000000000000103021503010101425dbc000001"
+	// datagramLong claims to be longer than it is.
+	datagramLong = "0045cafe0105000f33353230393330383634303336353508010000016b4f815b30010000000000000000000000000000000103021503010101425dbc000001"
+	// datagramBadIMEI comes from IMEI 352093086403656,
+	// which fails the check digit.
+	datagramBadIMEI = "003dcafe0105000f33353230393330383634303336353608010000016b4f815b30010000000000000000000000000000000103021503010101425dbc000001"
+	// datagramAck accepts the record of datagramRecord.
+	datagramAck = "0005cafe010501"
+)
+
+func TestDatagramIMEI(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram string
+		imei     string
+		err      error
+	}{
+		{"record", datagramRecord, "352093086403655", nil},
+		{"check digit", datagramBadIMEI, "", errInvalidIMEI},
+		{"no IMEI", "0007cafe01050000", "", errUDPHeader},
+		{"truncated", datagramRecord[:20], "", errUDPHeader},
+	}
+	for _, tt := range tests {
+		imei, err := datagramIMEI(mustDecodeHex(t, tt.datagram))
+		if imei != tt.imei || errors.Cause(err) != tt.err {
+			t.Errorf("%s: IMEI %q with error %v, want %q with %v", tt.name, imei, err, tt.imei, tt.err)
+		}
+	}
+}
+
+// datagrams returns one datagram per read.
+type datagrams [][]byte
+
+func (d *datagrams) Read(b []byte) (int, error) {
+	if len(*d) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*d)[0])
+	*d = (*d)[1:]
+	return n, nil
+}
+
+func TestParseUDPDatagrams(t *testing.T) {
+	r := &datagrams{mustDecodeHex(t, datagramLong), mustDecodeHex(t, datagramRecord)}
+	// A datagram longer than its length isn't read past its end.
+	if _, err := ParseUDP(r); errors.Cause(err) != errMalformedDatagram {
+		t.Errorf("long datagram: %v", err)
+	}
+	packet, err := ParseUDP(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.PacketID != 0xcafe || packet.AVLPacketID != 5 || packet.IMEI != "352093086403655" || len(packet.Positions) != 1 {
+		t.Errorf("packet %+v", packet)
+	}
+	if _, err = ParseUDP(r); errors.Cause(err) != io.EOF {
+		t.Errorf("error %v at the end", err)
+	}
+}
+
+func TestUDPSession(t *testing.T) {
+	store := &memStore{}
+	// Reads of a pipe return one write at a time, like the reads of
+	// the connections of UDP sessions return one datagram.
+	device, done := serveHandler(t, &common.Handler{
+		IMEI:       "352093086403655",
+		Store:      store,
+		Interactor: UDPInteractor{},
+	})
+	defer func() {
+		device.Close()
+		<-done
+	}()
+	ack := make([]byte, len(datagramAck)/2)
+	for _, datagram := range []string{datagramRecord, datagramLong, datagramRecord} {
+		_, err := device.Write(mustDecodeHex(t, datagram))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if datagram == datagramLong {
+			// Malformed datagrams are dropped without an ack.
+			continue
+		}
+		_, err = io.ReadFull(device, ack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(ack) != datagramAck {
+			t.Errorf("ack %x, want %s", ack, datagramAck)
+		}
+	}
+	if len(store.positions) != 2 {
+		t.Errorf("%d positions stored, want 2", len(store.positions))
+	}
+}
+
+func TestUDPHandleError(t *testing.T) {
+	h := &common.Handler{Logger: log.New()}
+	h.Logger.Out = ioutil.Discard
+	var i UDPInteractor
+	if i.HandleError(h, errors.Wrap(errMalformedDatagram, "bad length")) {
+		t.Error("session ended by a malformed datagram")
+	}
+	if !i.HandleError(h, io.EOF) {
+		t.Error("session kept after EOF")
+	}
+}
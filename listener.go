@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"math"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	_ "github.com/khiemm/listener/devices/gt06"
+	_ "github.com/khiemm/listener/devices/queclink"
+	_ "github.com/khiemm/listener/devices/ruptela"
 	"github.com/khiemm/listener/devices/teltonika"
+	"github.com/khiemm/listener/pkg/archive"
+	"github.com/khiemm/listener/pkg/storage"
 	"github.com/khiemm/listener/util"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/spf13/viper"
 	"github.com/thejerf/suture"
 )
@@ -31,18 +40,85 @@ func main() {
 		Log:              func(msg string) { log.Infof("suture: %s", msg) },
 	})
 
-	teltonikaServer := teltonika.MakeServer(viper.GetString("teltonika.address"), connSupervisor)
-	
+	err := storage.Connect()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't connect to the database")
+	}
+	defer storage.Disconnect()
+	store := storage.MySQLStore{}
+	validator, err := common.LoadValidator()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid validation config")
+	}
+
+	err = teltonika.LoadNXDecoders()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid NX decoder config")
+	}
+
+	servers, err := common.ConfiguredServers(connSupervisor)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid devices config")
+	}
+	if len(servers) == 0 {
+		log.Warn("No protocol enabled in the devices config")
+	}
+
+	var frameArchive *archive.Archive
+	if viper.GetBool("archive.enabled") {
+		frameArchive, err = archive.New(archive.LoadConfig())
+		if err != nil {
+			log.WithError(err).Fatal("Couldn't create frame archive")
+		}
+	}
+
 	supervisor := suture.NewSimple("root")
+	if frameArchive != nil {
+		supervisor.Add(frameArchive)
+	}
 	supervisor.Add(connSupervisor)
-	supervisor.Add(teltonikaServer)
+	for _, s := range servers {
+		s.Store = store
+		s.Validator = validator
+		s.Quarantine = store
+		s.Installations = store
+		if frameArchive != nil {
+			s.Archiver = frameArchive
+		}
+		supervisor.Add(s)
+	}
 
 	supervisor.ServeBackground()
+	var commandServer *http.Server
+	if addr := viper.GetString("commands.address"); addr != "" {
+		commandServer = &http.Server{
+			Addr: addr,
+			Handler: &common.CommandAPI{
+				Servers: servers,
+				Timeout: viper.GetDuration("commands.timeout"),
+			},
+		}
+		go func() {
+			log.WithField("addr", addr).Info("Listening for commands")
+			err := commandServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.WithError(err).Fatal("Command API failed")
+			}
+		}()
+	}
+	if interval := viper.GetDuration("metrics.log_interval"); interval > 0 {
+		go metrics.Log(metrics.DefaultRegistry, interval, log.StandardLogger())
+	}
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
 	<-sigchan
 	log.Info("Terminating")
+	if commandServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		commandServer.Shutdown(ctx)
+		cancel()
+	}
 	supervisor.Stop()
 	log.Info("Terminated")
 }
\ No newline at end of file
@@ -0,0 +1,357 @@
+// Package archive keeps the raw frames exchanged with devices in rotating,
+// gzip compressed, append-only segment files. Every frame is a line of
+// JSON, so segments can be inspected with zcat and jq.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/khiemm/listener/devices/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	segmentPrefix = "frames-"
+	segmentSuffix = ".jsonl.gz"
+	// segmentTimeFormat sorts lexically in chronological order.
+	segmentTimeFormat = "20060102T150405.000000000"
+	queueSize         = 4096
+	flushInterval     = time.Second
+)
+
+// Entry is a single archived frame.
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"src"`
+	IMEI       string    `json:"imei,omitempty"`
+	RemoteAddr string    `json:"addr"`
+	Network    string    `json:"net"`
+	Direction  string    `json:"dir"`
+	Handshake  bool      `json:"handshake,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Data       HexBytes  `json:"data"`
+}
+
+// HexBytes is encoded in JSON as a hex string.
+type HexBytes []byte
+
+func (b HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *HexBytes) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return
+	}
+	*b, err = hex.DecodeString(s)
+	return
+}
+
+// Config bounds the archive. Zero values disable the respective limit.
+type Config struct {
+	Dir string
+	// SegmentSize and SegmentAge trigger the rotation of the current segment,
+	// SegmentSize counting compressed bytes.
+	SegmentSize int64
+	SegmentAge  time.Duration
+	// MaxSize and MaxAge trigger the removal of the oldest segments.
+	MaxSize int64
+	MaxAge  time.Duration
+}
+
+// LoadConfig reads the [archive] section of the config.
+func LoadConfig() Config {
+	return Config{
+		Dir:         viper.GetString("archive.dir"),
+		SegmentSize: viper.GetInt64("archive.segment_size"),
+		SegmentAge:  viper.GetDuration("archive.segment_age"),
+		MaxSize:     viper.GetInt64("archive.max_size"),
+		MaxAge:      viper.GetDuration("archive.max_age"),
+	}
+}
+
+// Archive writes frames to segments from a single goroutine. It implements
+// common.Archiver and suture.Service.
+type Archive struct {
+	Config
+	frames  chan *common.RawFrame
+	stop    chan struct{}
+	dropped int64
+
+	file    *os.File
+	counter *countingWriter
+	gz      *gzip.Writer
+	opened  time.Time
+}
+
+// New creates the archive directory if needed.
+func New(c Config) (a *Archive, err error) {
+	if c.Dir == "" {
+		return nil, errors.New("archive directory not set")
+	}
+	err = os.MkdirAll(c.Dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create archive directory")
+	}
+	return &Archive{
+		Config: c,
+		frames: make(chan *common.RawFrame, queueSize),
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Archive queues a frame. Frames are dropped, and counted, when the queue
+// is full so that a slow disk never stalls the devices.
+func (a *Archive) Archive(f *common.RawFrame) {
+	select {
+	case a.frames <- f:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+// Serve writes queued frames until Stop is called.
+func (a *Archive) Serve() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	defer a.closeSegment()
+	a.prune()
+	for {
+		select {
+		case f := <-a.frames:
+			err := a.write(f)
+			if err != nil {
+				log.WithError(err).WithField("src", "archive").Error("Couldn't archive frame")
+				a.closeSegment()
+			}
+		case <-ticker.C:
+			a.flush()
+		case <-a.stop:
+			// Write what's already queued before closing the segment.
+			for {
+				select {
+				case f := <-a.frames:
+					a.write(f)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Stop makes Serve return once the queued frames are written.
+func (a *Archive) Stop() {
+	a.stop <- struct{}{}
+}
+
+func (a *Archive) write(f *common.RawFrame) (err error) {
+	if a.gz == nil || a.segmentFull(f.Time) {
+		err = a.rotate(f.Time)
+		if err != nil {
+			return
+		}
+	}
+	line, err := json.Marshal(Entry{
+		Time:       f.Time,
+		Source:     f.Source,
+		IMEI:       f.IMEI,
+		RemoteAddr: f.RemoteAddr,
+		Network:    f.Network,
+		Direction:  f.Direction,
+		Handshake:  f.Handshake,
+		Outcome:    f.Outcome,
+		Data:       f.Data,
+	})
+	if err != nil {
+		return
+	}
+	_, err = a.gz.Write(append(line, '\n'))
+	return
+}
+
+func (a *Archive) segmentFull(now time.Time) bool {
+	return (a.SegmentSize > 0 && a.counter.n >= a.SegmentSize) ||
+		(a.SegmentAge > 0 && now.Sub(a.opened) >= a.SegmentAge)
+}
+
+// flush makes the frames written so far readable from the segment,
+// and reports dropped frames.
+func (a *Archive) flush() {
+	if dropped := atomic.SwapInt64(&a.dropped, 0); dropped > 0 {
+		log.WithField("src", "archive").Warnf("Dropped %d frames, archive queue full", dropped)
+	}
+	if a.gz == nil {
+		return
+	}
+	err := a.gz.Flush()
+	if err != nil {
+		log.WithError(err).WithField("src", "archive").Error("Couldn't flush segment")
+		a.closeSegment()
+	}
+}
+
+// rotate opens a new segment for the frames from first on. SegmentAge
+// counts from first, so that it compares the times of frames only.
+func (a *Archive) rotate(first time.Time) (err error) {
+	a.closeSegment()
+	a.prune()
+	a.opened = first
+	name := filepath.Join(a.Dir, segmentPrefix+time.Now().UTC().Format(segmentTimeFormat)+segmentSuffix)
+	a.file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open segment")
+	}
+	a.counter = &countingWriter{w: a.file}
+	a.gz = gzip.NewWriter(a.counter)
+	return nil
+}
+
+func (a *Archive) closeSegment() {
+	if a.gz == nil {
+		return
+	}
+	err := a.gz.Close()
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.WithError(err).WithField("src", "archive").Error("Couldn't close segment")
+	}
+	a.gz, a.file, a.counter = nil, nil, nil
+}
+
+// prune removes the oldest closed segments until the archive fits
+// MaxSize and MaxAge.
+func (a *Archive) prune() {
+	segments, err := Segments(a.Dir)
+	if err != nil {
+		log.WithError(err).WithField("src", "archive").Error("Couldn't list segments")
+		return
+	}
+	type segment struct {
+		path string
+		info os.FileInfo
+	}
+	var closed []segment
+	var total int64
+	for _, path := range segments {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if a.file != nil && path == a.file.Name() {
+			continue
+		}
+		closed = append(closed, segment{path, info})
+		total += info.Size()
+	}
+
+	for _, s := range closed {
+		tooBig := a.MaxSize > 0 && total > a.MaxSize
+		tooOld := a.MaxAge > 0 && time.Since(s.info.ModTime()) > a.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		err = os.Remove(s.path)
+		if err != nil {
+			log.WithError(err).WithField("src", "archive").Error("Couldn't remove segment")
+			return
+		}
+		total -= s.info.Size()
+	}
+}
+
+// Segments returns the segment files in dir from the oldest to the newest.
+func Segments(dir string) (paths []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, segmentPrefix) && strings.HasSuffix(name, segmentSuffix) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(paths)
+	return
+}
+
+// Reader reads the entries of a segment.
+type Reader struct {
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+// NewReader reads a segment from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "not a segment")
+	}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	scanner.Split(scanEntries)
+	return &Reader{gz, scanner}, nil
+}
+
+// scanEntries splits lines like bufio.ScanLines, but drops a last line
+// without a newline, which is an entry cut short.
+func scanEntries(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
+
+// Next returns the next entry, or io.EOF after the last one. A segment
+// cut short, e.g. by a crash, ends at its last complete entry.
+func (r *Reader) Next() (e *Entry, err error) {
+	if !r.scanner.Scan() {
+		err = r.scanner.Err()
+		if err == nil || err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	e = new(Entry)
+	err = json.Unmarshal(r.scanner.Bytes(), e)
+	if err != nil {
+		return nil, fmt.Errorf("malformed entry: %v", err)
+	}
+	return e, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	cw.n += int64(n)
+	return
+}
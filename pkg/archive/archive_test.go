@@ -0,0 +1,231 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+)
+
+func frame(t time.Time, direction string, data string) *common.RawFrame {
+	return &common.RawFrame{
+		Time:       t,
+		Source:     "teltonika",
+		IMEI:       "356307042441013",
+		RemoteAddr: "203.0.113.7:56324",
+		Network:    "tcp",
+		Direction:  direction,
+		Outcome:    common.OutcomeOK,
+		Data:       []byte(data),
+	}
+}
+
+// serve runs a until the frames are archived and returns the entries
+// of its segments.
+func serve(t *testing.T, a *Archive, frames ...*common.RawFrame) [][]*Entry {
+	done := make(chan struct{})
+	go func() {
+		a.Serve()
+		close(done)
+	}()
+	for _, f := range frames {
+		a.Archive(f)
+	}
+	a.Stop()
+	<-done
+	return readSegments(t, a.Dir)
+}
+
+func readSegments(t *testing.T, dir string) (segments [][]*Entry) {
+	paths, err := Segments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, readEntries(t, b))
+	}
+	return
+}
+
+func readEntries(t *testing.T, segment []byte) (entries []*Entry) {
+	r, err := NewReader(bytes.NewReader(segment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	a, err := New(Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	in := frame(now, common.DirectionIn, "\x00\x0f356307042441013")
+	in.Handshake = true
+	out := frame(now.Add(time.Millisecond), common.DirectionOut, "\x01")
+	failed := frame(now.Add(2*time.Millisecond), common.DirectionIn, "\x00\x00\x00\x00\xff")
+	failed.Outcome = "malformed packet"
+	segments := serve(t, a, in, out, failed)
+	if len(segments) != 1 {
+		t.Fatalf("%d segments", len(segments))
+	}
+	entries := segments[0]
+	if len(entries) != 3 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	for i, f := range []*common.RawFrame{in, out, failed} {
+		want := &Entry{
+			Time:       f.Time,
+			Source:     f.Source,
+			IMEI:       f.IMEI,
+			RemoteAddr: f.RemoteAddr,
+			Network:    f.Network,
+			Direction:  f.Direction,
+			Handshake:  f.Handshake,
+			Outcome:    f.Outcome,
+			Data:       f.Data,
+		}
+		if !entries[i].Time.Equal(want.Time) {
+			t.Errorf("entry %d: time %s, want %s", i, entries[i].Time, want.Time)
+		}
+		entries[i].Time = want.Time
+		if !reflect.DeepEqual(entries[i], want) {
+			t.Errorf("entry %d: %+v, want %+v", i, entries[i], want)
+		}
+	}
+}
+
+func TestArchiveRotation(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		config Config
+		times  []time.Duration
+		counts []int
+	}{
+		{"size", Config{SegmentSize: 1}, []time.Duration{0, 0, 0}, []int{1, 1, 1}},
+		{"age", Config{SegmentAge: time.Hour}, []time.Duration{0, time.Minute, 2 * time.Hour, 2 * time.Hour}, []int{2, 2}},
+		{"no limit", Config{}, []time.Duration{0, 2 * time.Hour, 0}, []int{3}},
+	}
+	for _, tt := range tests {
+		tt.config.Dir = t.TempDir()
+		a, err := New(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frames []*common.RawFrame
+		for _, d := range tt.times {
+			frames = append(frames, frame(now.Add(d), common.DirectionIn, "\x01"))
+		}
+		var counts []int
+		for _, entries := range serve(t, a, frames...) {
+			counts = append(counts, len(entries))
+		}
+		if !reflect.DeepEqual(counts, tt.counts) {
+			t.Errorf("%s: segments of %v entries, want %v", tt.name, counts, tt.counts)
+		}
+	}
+}
+
+func TestArchivePrune(t *testing.T) {
+	// Segments of 100 bytes, the oldest modified 3 days ago
+	// and the newest one now.
+	names := []string{
+		"frames-20261001T000000.000000000.jsonl.gz",
+		"frames-20261002T000000.000000000.jsonl.gz",
+		"frames-20261003T000000.000000000.jsonl.gz",
+		"frames-20261004T000000.000000000.jsonl.gz",
+	}
+	tests := []struct {
+		name   string
+		config Config
+		left   int
+	}{
+		{"max size", Config{MaxSize: 250}, 2},
+		{"max age", Config{MaxAge: 36 * time.Hour}, 2},
+		{"both", Config{MaxSize: 150, MaxAge: 36 * time.Hour}, 1},
+		{"no limit", Config{}, 4},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for i, name := range names {
+			path := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(path, make([]byte, 100), 0644); err != nil {
+				t.Fatal(err)
+			}
+			modified := time.Now().Add(time.Duration(i-3) * 24 * time.Hour)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Other files are never removed.
+		other := filepath.Join(dir, "notes.txt")
+		if err := ioutil.WriteFile(other, make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tt.config.Dir = dir
+		a, err := New(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.prune()
+		left, err := Segments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]string, 0, tt.left)
+		for _, name := range names[len(names)-tt.left:] {
+			want = append(want, filepath.Join(dir, name))
+		}
+		if !reflect.DeepEqual(left, want) {
+			t.Errorf("%s: %v left, want %v", tt.name, left, want)
+		}
+		if _, err = os.Stat(other); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// TestReadTruncatedSegment checks that a segment cut short, as by a crash,
+// is read up to its last complete entry.
+func TestReadTruncatedSegment(t *testing.T) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(`{"src":"teltonika","dir":"in","data":"000f"}` + "\n"))
+	gz.Write([]byte(`{"src":"teltonika","dir":"out","data":"01"}` + "\n"))
+	gz.Flush()
+	flushed := b.Len()
+	gz.Write([]byte(`{"src":"teltonika","dir":"in","data":"00000000"}` + "\n"))
+	gz.Close()
+
+	for _, size := range []int{flushed, flushed + 4, (flushed + b.Len()) / 2} {
+		entries := readEntries(t, b.Bytes()[:size])
+		if len(entries) != 2 || entries[1].Direction != common.DirectionOut {
+			t.Errorf("cut at %d of %d bytes: %d entries", size, b.Len(), len(entries))
+		}
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("000f\n"))); err == nil {
+		t.Error("hex read as a segment")
+	}
+}
@@ -4,11 +4,13 @@ package storage
 
 import (
 	"database/sql"
+	_ "embed"
 	"errors"
 	"fmt"
 
 	log "github.com/Sirupsen/logrus"
 	_ "github.com/go-sql-driver/mysql" //Just registering the driver
+	"github.com/spf13/viper"
 	"gopkg.in/gorp.v1"
 )
 
@@ -19,6 +21,11 @@ var (
 	ErrNoDatabaseConnection = errors.New("storage: couldn't connect to mysql database")
 )
 
+// schema creates the tables mapped by Connect.
+//
+//go:embed schema.sql
+var schema string
+
 // var db *sql.DB
 
 type Album struct {
@@ -35,10 +42,25 @@ func Connect() (err error) {
 		return ErrAlreadyConnected
 	}
 
-	err = mysqlConnect("root", "root", "localhost:3306", "listener", 16, false)
+	err = mysqlConnect(
+		viper.GetString("db.username"),
+		viper.GetString("db.password"),
+		viper.GetString("db.server"),
+		viper.GetString("db.name"),
+		viper.GetInt("db.pool_size"),
+		viper.GetBool("db.trace"),
+	)
 	if err != nil {
 		return
 	}
+	Db.AddTableWithName(Position{}, "positions").SetKeys(true, "ID")
+	Db.AddTableWithName(QuarantinedPosition{}, "quarantine").SetKeys(true, "ID")
+	if viper.GetBool("db.create_tables") {
+		err = CreateTables()
+		if err != nil {
+			return
+		}
+	}
 	// // Capture connection properties.
 	// cfg := mysql.Config{
 	// 	User:   "root",
@@ -56,6 +78,19 @@ func Connect() (err error) {
 	return
 }
 
+// CreateTables creates the tables the listener writes to,
+// unless they already exist.
+func CreateTables() (err error) {
+	if Db == nil {
+		return ErrNoDatabaseConnection
+	}
+	_, err = Db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("storage: couldn't create tables: %v", err)
+	}
+	return nil
+}
+
 // Disconnect drains the connection pool and releases their associated resources.
 func Disconnect() (err error) {
 	if Db != nil {
@@ -69,7 +104,7 @@ func Disconnect() (err error) {
 }
 
 func mysqlConnect(username, password, addr, dbName string, poolSize int, trace bool) (err error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?multiStatements=true",
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?multiStatements=true&parseTime=true",
 		username, password, addr, dbName)
 	sqlDb, err := sql.Open("mysql", dsn)
 	if err != nil {
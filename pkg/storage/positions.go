@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/khiemm/listener/devices/common"
+	"github.com/pkg/errors"
+)
+
+// Position is a row of the positions table.
+type Position struct {
+	ID         int64     `db:"id"`
+	Vehicle    int64     `db:"vehicle"`
+	IMEI       string    `db:"imei"`
+	Source     string    `db:"source"`
+	Datetime   time.Time `db:"datetime"`
+	Latitude   float64   `db:"latitude"`
+	Longitude  float64   `db:"longitude"`
+	Altitude   float64   `db:"altitude"`
+	Angle      float64   `db:"angle"`
+	Speed      float64   `db:"speed"`
+	Satellites int       `db:"satellites"`
+	EventID    int       `db:"event_id"`
+	// IO holds the raw IO elements as a JSON object of hex strings.
+	IO string `db:"io"`
+	// Attributes holds the decoded values as a JSON object.
+	Attributes string    `db:"attributes"`
+	Created    time.Time `db:"created"`
+}
+
+// QuarantinedPosition is a row of the quarantine table, a position
+// together with the validation rule that rejected it.
+type QuarantinedPosition struct {
+	Position
+	Rule   string `db:"rule"`
+	Reason string `db:"reason"`
+}
+
+// MySQLStore stores positions in the global connection pool.
+type MySQLStore struct{}
+
+// SavePositions inserts all the positions in a single transaction,
+// so that either every position of a packet is stored or none is.
+func (MySQLStore) SavePositions(h *common.Handler, positions []*common.Position) (err error) {
+	if Db == nil {
+		return ErrNoDatabaseConnection
+	}
+	rows := make([]interface{}, 0, len(positions))
+	for _, p := range positions {
+		var row *Position
+		row, err = makePosition(h, p)
+		if err != nil {
+			return
+		}
+		rows = append(rows, row)
+	}
+	return insert(rows)
+}
+
+// QuarantinePositions inserts all the rejections in a single transaction.
+func (MySQLStore) QuarantinePositions(h *common.Handler, rejections []*common.Rejection) (err error) {
+	if Db == nil {
+		return ErrNoDatabaseConnection
+	}
+	rows := make([]interface{}, 0, len(rejections))
+	for _, r := range rejections {
+		var row *Position
+		row, err = makePosition(h, r.Position)
+		if err != nil {
+			return
+		}
+		rows = append(rows, &QuarantinedPosition{Position: *row, Rule: r.Rule, Reason: r.Reason})
+	}
+	return insert(rows)
+}
+
+// InstalledAt returns the installation date of a device from the devices
+// table, or the zero time when the device or its date isn't there.
+func (MySQLStore) InstalledAt(imei string) (t time.Time, err error) {
+	if Db == nil {
+		return t, ErrNoDatabaseConnection
+	}
+	var installed sql.NullTime
+	err = Db.Db.QueryRow("SELECT installed_at FROM devices WHERE imei = ?", imei).Scan(&installed)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
+	if err != nil {
+		return t, errors.Wrap(err, "installation date query failed")
+	}
+	if installed.Valid {
+		t = installed.Time
+	}
+	return t, nil
+}
+
+func insert(rows []interface{}) (err error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "couldn't begin transaction")
+	}
+	err = tx.Insert(rows...)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "insert failed")
+	}
+	return errors.Wrap(tx.Commit(), "commit failed")
+}
+
+func makePosition(h *common.Handler, p *common.Position) (row *Position, err error) {
+	io := make(map[string]string, len(p.IO))
+	for id, value := range p.IO {
+		io[strconv.Itoa(int(id))] = hex.EncodeToString(value)
+	}
+	ioJSON, err := json.Marshal(io)
+	if err != nil {
+		return
+	}
+	attributes := []byte("{}")
+	if len(p.Attributes) > 0 {
+		attributes, err = json.Marshal(p.Attributes)
+		if err != nil {
+			return nil, errors.Wrap(err, "attributes can't be encoded")
+		}
+	}
+	return &Position{
+		Vehicle:    h.ID,
+		IMEI:       h.IMEI,
+		Source:     h.Name,
+		Datetime:   p.Timestamp.UTC(),
+		Latitude:   p.Latitude,
+		Longitude:  p.Longitude,
+		Altitude:   p.Altitude,
+		Angle:      p.Heading,
+		Speed:      p.Speed,
+		Satellites: p.Satellites,
+		EventID:    p.EventID,
+		IO:         string(ioJSON),
+		Attributes: string(attributes),
+		Created:    time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,56 @@
+-- Tables of the positions received by the listener. Created by Connect
+-- when db.create_tables is set, every statement must be idempotent.
+
+CREATE TABLE IF NOT EXISTS positions (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	vehicle BIGINT NOT NULL DEFAULT 0,
+	imei VARCHAR(32) NOT NULL,
+	source VARCHAR(32) NOT NULL,
+	datetime DATETIME(3) NOT NULL,
+	latitude DOUBLE NOT NULL,
+	longitude DOUBLE NOT NULL,
+	altitude DOUBLE NOT NULL,
+	angle DOUBLE NOT NULL,
+	speed DOUBLE NOT NULL,
+	satellites INT NOT NULL,
+	event_id INT NOT NULL,
+	-- Raw IO elements, a JSON object of hex strings by IO ID.
+	io TEXT NOT NULL,
+	-- Decoded values, a JSON object.
+	attributes TEXT NOT NULL,
+	created DATETIME(3) NOT NULL,
+	PRIMARY KEY (id),
+	KEY positions_imei_datetime (imei, datetime)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Positions rejected by a validation rule, kept for auditing.
+CREATE TABLE IF NOT EXISTS quarantine (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	vehicle BIGINT NOT NULL DEFAULT 0,
+	imei VARCHAR(32) NOT NULL,
+	source VARCHAR(32) NOT NULL,
+	datetime DATETIME(3) NOT NULL,
+	latitude DOUBLE NOT NULL,
+	longitude DOUBLE NOT NULL,
+	altitude DOUBLE NOT NULL,
+	angle DOUBLE NOT NULL,
+	speed DOUBLE NOT NULL,
+	satellites INT NOT NULL,
+	event_id INT NOT NULL,
+	io TEXT NOT NULL,
+	attributes TEXT NOT NULL,
+	created DATETIME(3) NOT NULL,
+	rule VARCHAR(64) NOT NULL,
+	reason VARCHAR(255) NOT NULL,
+	PRIMARY KEY (id),
+	KEY quarantine_imei_datetime (imei, datetime),
+	KEY quarantine_rule (rule)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Devices known to the listener. Positions older than installed_at are
+-- rejected by the before_install validation rule.
+CREATE TABLE IF NOT EXISTS devices (
+	imei VARCHAR(32) NOT NULL,
+	installed_at DATETIME NULL,
+	PRIMARY KEY (imei)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
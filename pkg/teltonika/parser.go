@@ -8,8 +8,8 @@ import (
 	"io"
 	"log"
 	"math"
-	"strings"
 
+	"github.com/khiemm/listener/devices/teltonika"
 	"github.com/pkg/errors"
 )
 
@@ -301,26 +301,15 @@ func parseRecord8e(r io.Reader) (rec *Record8e, err error) {
 
 func parseBeacon() {
 	s := "11210102030405060708090a0b0c0d0e0f1023262326bf210102030405060708090a0b0c0d0e0f1023532353c0210102030405060708090a0b0c0d0e0f1023502350c1210102030405060708090a0b0c0d0e0f1023512351bf210102030405060708090a0b0c0d0e0f1023282328bc210102030405060708090a0b0c0d0e0f1020d120d1c02110190d0c0b0a0908070605040302010000020018a1"
-	x := s[2:]
-	y := strings.Split(x, "21")
-	v := y[1:]
-	for _, z := range v {
-		uuid := z[:32]
-		major := z[32:36]
-		minor := z[36:40]
-		rssi := z[40:]
-		fmt.Println(uuid, major, minor, rssi)
-		// decoded, err := hex.DecodeString(z)
-		// if err != nil {
-		// 	log.Fatal(err)
-		// }
-		// fmt.Println(decoded)
-		// 	reader := bytes.NewReader(decoded)
-		// 	b := new(BeaconData)
-		// err = binary.Read(reader, binary.BigEndian, b)
-		// if err != nil {
-		// 	log.Fatal(err)
-		// }
-		// fmt.Println(b)
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	beacons, err := teltonika.ParseBeacons(decoded)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, b := range beacons {
+		fmt.Println(b.UUID, b.Major, b.Minor, b.RSSI)
 	}
 }
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
@@ -12,16 +14,46 @@ func InitializeViper() (err error) {
 	viper.AddConfigPath("../config")
 	viper.AddConfigPath("./config")
 
+	// Nested keys are set as LISTENER_DEVICES_TELTONIKA_TIMEOUT.
 	viper.SetEnvPrefix("listener")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
 	err = viper.ReadInConfig()
 	return
 }
 
+// crc16Tables caches the lookup table of every polynomial used with Crc16.
+var crc16Tables sync.Map
+
+// Crc16 computes the reflected CRC-16 of data with the given (reversed)
+// polynomial and a zero initial value, e.g. 0xA001 for CRC-16/IBM.
 func Crc16(data []byte, poly uint16) (crc uint16) {
+	table := crc16Table(poly)
+	for i := range data {
+		crc = crc>>8 ^ table[byte(crc)^data[i]]
+	}
+	return
+}
+
+// CrcX25 computes the CRC-ITU of data as used by GT06 devices, i.e. the
+// X.25 variant with an initial value of 0xFFFF and an inverted result.
+func CrcX25(data []byte) uint16 {
+	table := crc16Table(0x8408)
+	crc := uint16(0xFFFF)
 	for i := range data {
-		crc = crc ^ uint16(data[i])
+		crc = crc>>8 ^ table[byte(crc)^data[i]]
+	}
+	return ^crc
+}
+
+func crc16Table(poly uint16) *[256]uint16 {
+	if table, ok := crc16Tables.Load(poly); ok {
+		return table.(*[256]uint16)
+	}
+	table := new([256]uint16)
+	for i := range table {
+		crc := uint16(i)
 		for ucBit := 0; ucBit < 8; ucBit++ {
 			ucCarry := byte(crc & 1)
 			crc >>= 1
@@ -29,10 +61,52 @@ func Crc16(data []byte, poly uint16) (crc uint16) {
 				crc = crc ^ poly
 			}
 		}
+		table[i] = crc
 	}
-	return
+	crc16Tables.Store(poly, table)
+	return table
 }
 
 func MakeTimeout(timeout int) time.Time {
 	return time.Now().Add(time.Duration(timeout) * time.Second)
-}
\ No newline at end of file
+}
+
+// LuhnCheckDigit returns the check digit that makes digits followed by
+// it pass the Luhn algorithm, as used by IMEIs.
+func LuhnCheckDigit(digits string) int {
+	sum := 0
+	double := true
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+// ValidIMEI tells whether imei is 15 digits with a valid check digit.
+func ValidIMEI(imei string) bool {
+	return len(imei) == 15 && ValidLuhn(imei)
+}
+
+// ValidLuhn tells whether id is at least two digits, the last of which is
+// the Luhn check digit of the others. It validates the identifiers of
+// devices that may send longer ones than an IMEI.
+func ValidLuhn(id string) bool {
+	if len(id) < 2 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '0' || id[i] > '9' {
+			return false
+		}
+	}
+	last := len(id) - 1
+	return LuhnCheckDigit(id[:last]) == int(id[last]-'0')
+}
@@ -0,0 +1,62 @@
+package util
+
+import "testing"
+
+// check is the input of the CRC catalogue check values.
+var check = []byte("123456789")
+
+func TestCrc16(t *testing.T) {
+	// CRC-16/ARC, as used by Teltonika.
+	if crc := Crc16(check, 0xA001); crc != 0xBB3D {
+		t.Errorf("CRC-16/ARC %04x, want bb3d", crc)
+	}
+}
+
+func TestCrcX25(t *testing.T) {
+	if crc := CrcX25(check); crc != 0x906E {
+		t.Errorf("CRC-16/X-25 %04x, want 906e", crc)
+	}
+	// The length, protocol number and serial number of a GT06 login ack.
+	if crc := CrcX25([]byte{0x05, 0x01, 0x00, 0x01}); crc != 0xD9DC {
+		t.Errorf("login ack CRC %04x, want d9dc", crc)
+	}
+}
+
+func TestValidIMEI(t *testing.T) {
+	tests := []struct {
+		imei  string
+		valid bool
+	}{
+		{"353288040073284", true},
+		{"356307042441013", true},
+		{"356307042441014", false},
+		{"35630704244101", false},
+		{"35630704244101a", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := ValidIMEI(tt.imei); got != tt.valid {
+			t.Errorf("%q: %t, want %t", tt.imei, got, tt.valid)
+		}
+	}
+}
+
+func TestValidLuhn(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"356307042441013", true},
+		// Longer identifiers, e.g. sent by Teltonika devices.
+		{"3563070424410130000", true},
+		{"35630704244101300006", false},
+		{"18", true},
+		{"8", false},
+		{"1a", false},
+	}
+	for _, tt := range tests {
+		if got := ValidLuhn(tt.id); got != tt.valid {
+			t.Errorf("%q: %t, want %t", tt.id, got, tt.valid)
+		}
+	}
+}